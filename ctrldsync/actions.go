@@ -0,0 +1,111 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Rule actions ("do") used by the Control D API
+var actionNames = map[int]string{
+	0: "block",
+	1: "bypass",
+	2: "spoof",
+	3: "redirect",
+}
+
+// Parse an action name or number
+func parseAction(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "allow" {
+		return 1, nil
+	}
+	for do, name := range actionNames {
+		if s == name || s == fmt.Sprint(do) {
+			return do, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown action %q (want block, bypass or allow, spoof or redirect)", s)
+}
+
+// Readable name of an action, e.g. block; unknown codes are shown as "action N"
+func actionLabel(do int) string {
+	if name, ok := actionNames[do]; ok {
+		return name
+	}
+	return fmt.Sprintf("action %d", do)
+}
+
+// Readable name of a folder status
+func statusLabel(status int) string {
+	if status == 0 {
+		return "disabled"
+	}
+	return "enabled"
+}
+
+// Action and status together, e.g. "block" or "bypass, disabled"
+func actionStatusLabel(a Action) string {
+	if a.Status == 0 {
+		return actionLabel(a.Do) + ", disabled"
+	}
+	return actionLabel(a.Do)
+}
+
+// Parse a folder status: 1, enabled or on; 0, disabled or off
+func parseStatus(s string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "enabled", "on", "true":
+		return 1, nil
+	case "0", "disabled", "off", "false":
+		return 0, nil
+	}
+	return 0, fmt.Errorf("unknown status %q (want enabled or disabled)", s)
+}
+
+// Sources (URLs or short names like spam-tlds) whose folders are always allow folders
+var allowLists []string
+
+// Report whether a source is forced to allow by ALLOW_LISTS or allow_lists
+func allowListed(src string) bool {
+	u, _ := splitSource(src)
+	for _, entry := range allowLists {
+		if strings.EqualFold(entry, u) || strings.EqualFold(entry, listShortName(src)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Action remapping applied to every synced folder, e.g. block=bypass
+var actionRemap map[int]int
+
+// Parse "from=to,from=to"
+func parseRemap(s string) (map[int]int, error) {
+	remap := make(map[int]int)
+	for _, pair := range splitList(s) {
+		from, to, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid remap %q, expected from=to", pair)
+		}
+		f, err := parseAction(from)
+		if err != nil {
+			return nil, err
+		}
+		t, err := parseAction(to)
+		if err != nil {
+			return nil, err
+		}
+		remap[f] = t
+	}
+	return remap, nil
+}
+
+// Apply the global action remapping to a folder
+func remapAction(folder *FolderData) {
+	to, ok := actionRemap[folder.Group.Action.Do]
+	if !ok || to == folder.Group.Action.Do {
+		return
+	}
+	logger.Printf("Folder '%s': action remapped %s→%s", strings.TrimSpace(folder.Group.Group), actionLabel(folder.Group.Action.Do), actionLabel(to))
+	folder.Group.Action.Do = to
+}
@@ -0,0 +1,90 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Limits that escalate a run's severity when exceeded; zero disables a check
+type AlertThresholds struct {
+	MaxDuration      time.Duration
+	MaxFailedBatches int
+	MaxDriftRules    int
+
+	// Alert when a folder's rule count is off from its source by more than MaxRuleDelta for RuleDeltaRuns runs in a row
+	MaxRuleDelta  int
+	RuleDeltaRuns int
+}
+
+// Read ALERT_MAX_DURATION, ALERT_MAX_FAILED_BATCHES, ALERT_MAX_DRIFT, ALERT_MAX_RULE_DELTA and ALERT_RULE_DELTA_RUNS
+func loadAlertThresholds() (AlertThresholds, error) {
+	t := AlertThresholds{RuleDeltaRuns: 3}
+	if v := getenv("ALERT_MAX_DURATION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return t, fmt.Errorf("ALERT_MAX_DURATION: %w", err)
+		}
+		t.MaxDuration = d
+	}
+	for name, dst := range map[string]*int{
+		"ALERT_MAX_FAILED_BATCHES": &t.MaxFailedBatches,
+		"ALERT_MAX_DRIFT":          &t.MaxDriftRules,
+		"ALERT_MAX_RULE_DELTA":     &t.MaxRuleDelta,
+		"ALERT_RULE_DELTA_RUNS":    &t.RuleDeltaRuns,
+	} {
+		if v := getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return t, fmt.Errorf("%s: %w", name, err)
+			}
+			*dst = n
+		}
+	}
+	return t, nil
+}
+
+// Check a report against the thresholds, escalating it and sending ALERT_WEBHOOK_URL on a breach
+func checkAlerts(report *RunReport, t AlertThresholds) {
+	failedBatches, drift := 0, 0
+	for _, p := range report.Profiles {
+		drift += p.DriftRules
+		for _, f := range p.Folders {
+			failedBatches += f.FailedBatches
+		}
+	}
+
+	if t.MaxDuration > 0 && report.Duration > t.MaxDuration {
+		report.Alerts = append(report.Alerts, fmt.Sprintf("run took %s (limit %s)", report.Duration, t.MaxDuration))
+	}
+	if t.MaxFailedBatches > 0 && failedBatches > t.MaxFailedBatches {
+		report.Alerts = append(report.Alerts, fmt.Sprintf("%d batches failed (limit %d)", failedBatches, t.MaxFailedBatches))
+	}
+	if t.MaxDriftRules > 0 && drift > t.MaxDriftRules {
+		report.Alerts = append(report.Alerts, fmt.Sprintf("%d rules drifted since the last sync (limit %d)", drift, t.MaxDriftRules))
+	}
+	if t.MaxRuleDelta > 0 {
+		for _, p := range report.Profiles {
+			ps, _ := getProfileState(p.ProfileID)
+			for name, f := range ps.Folders {
+				if f.RuleDeltaStreak >= t.RuleDeltaRuns {
+					report.Alerts = append(report.Alerts, fmt.Sprintf("profile %s folder '%s' is %d rules off its source for %d runs (limit %d)", maskID(p.ProfileID), name, f.RuleDelta, f.RuleDeltaStreak, t.MaxRuleDelta))
+				}
+			}
+		}
+	}
+	if len(report.Alerts) == 0 {
+		return
+	}
+
+	report.Severity = "critical"
+	for _, a := range report.Alerts {
+		logger.Printf("ALERT: %s", a)
+	}
+
+	if url := getenv("ALERT_WEBHOOK_URL"); url != "" {
+		if err := postWebhook(url, getenv("WEBHOOK_SECRET"), "alert", report); err != nil {
+			warnf("could not send alert: %v", err)
+		}
+	}
+}
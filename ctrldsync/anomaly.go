@@ -0,0 +1,204 @@
+package ctrldsync
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	SourceSizeHistory   = 30   // sizes kept per source, one per content change
+	AnomalyMinHistory   = 5    // size changes seen before a source is judged
+	AnomalyMinSpread    = 0.02 // floor of the typical change, so a list that barely moves isn't flagged for a 3% step
+	DefaultAnomalySigma = 4.0
+)
+
+// Standard deviations a size change may differ from a source's usual changes before it is flagged; 0 disables
+var anomalySigma = DefaultAnomalySigma
+
+// Leave the folders of flagged sources as they are until approved
+var quarantineAnomalies bool
+
+// A source whose size changed unusually, held back from syncs until approved
+type QuarantinedSource struct {
+	Folder   string    `json:"folder"`
+	Since    time.Time `json:"since"`
+	Previous int       `json:"previous"` // rules before the change
+	Current  int       `json:"current"`
+	Version  string    `json:"version"`
+	Sigma    float64   `json:"sigma"` // how unusual the change was
+}
+
+// Compare a new size of a source against the changes seen before; returns how many
+// standard deviations the change is from the usual, and whether there was history enough to tell
+func sizeDeviation(sizes []int, current int) (float64, bool) {
+	if len(sizes) < AnomalyMinHistory+1 {
+		return 0, false
+	}
+	changes := make([]float64, 0, len(sizes)-1)
+	for i := 1; i < len(sizes); i++ {
+		changes = append(changes, sizeChange(sizes[i-1], sizes[i]))
+	}
+	mean := 0.0
+	for _, c := range changes {
+		mean += c
+	}
+	mean /= float64(len(changes))
+	variance := 0.0
+	for _, c := range changes {
+		variance += (c - mean) * (c - mean)
+	}
+	spread := math.Max(math.Sqrt(variance/float64(len(changes))), AnomalyMinSpread)
+	return (sizeChange(sizes[len(sizes)-1], current) - mean) / spread, true
+}
+
+// Relative size change as a log ratio, so a doubling and a halving weigh the same
+func sizeChange(from, to int) float64 {
+	return math.Log(float64(to+1) / float64(from+1))
+}
+
+// Check a changed source's size and update its history and quarantine; callers hold stateMutex
+func checkSourceSize(src string, prev *SourceState, next *SourceState) {
+	var sizes []int
+	if prev != nil {
+		sizes = prev.Sizes
+		if len(sizes) == 0 {
+			sizes = []int{prev.Count}
+		}
+	}
+	next.Sizes = sizes
+	if prev != nil && prev.Version == next.Version {
+		return
+	}
+	current := next.Count
+
+	sigma, judged := sizeDeviation(sizes, current)
+	q := state.Quarantine[src]
+	if anomalySigma <= 0 || !judged || math.Abs(sigma) <= anomalySigma {
+		if q != nil {
+			logger.Printf("Folder '%s': %s is back to a usual size (%s rules); lifting its quarantine", next.Folder, listShortName(src), formatNumber(current))
+			delete(state.Quarantine, src)
+		}
+		next.Sizes = appendSize(sizes, current)
+		return
+	}
+
+	previous := sizes[len(sizes)-1]
+	warnf("folder '%s': %s changed from %s to %s rules, %.1f standard deviations from its usual changes", next.Folder, listShortName(src), formatNumber(previous), formatNumber(current), math.Abs(sigma))
+	if !quarantineAnomalies {
+		next.Sizes = appendSize(sizes, current)
+		return
+	}
+	// A held-back size stays out of the history until approved, so it doesn't become the new normal
+	if state.Quarantine == nil {
+		state.Quarantine = make(map[string]*QuarantinedSource)
+	}
+	if q == nil {
+		q = &QuarantinedSource{Since: time.Now().UTC()}
+		state.Quarantine[src] = q
+	}
+	q.Folder, q.Previous, q.Current, q.Version, q.Sigma = next.Folder, previous, current, next.Version, math.Abs(sigma)
+}
+
+func appendSize(sizes []int, n int) []int {
+	sizes = append(append([]int(nil), sizes...), n)
+	if len(sizes) > SourceSizeHistory {
+		sizes = sizes[len(sizes)-SourceSizeHistory:]
+	}
+	return sizes
+}
+
+// The quarantine of a source, if it is held back
+func quarantined(src string) *QuarantinedSource {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	if q := state.Quarantine[src]; q != nil {
+		c := *q
+		return &c
+	}
+	return nil
+}
+
+// Warn about a quarantined source whose folder is left as it is
+func warnQuarantined(src string, q *QuarantinedSource) {
+	warnf("folder '%s': left as it is, %s is quarantined since %s (%s → %s rules); run \"ctrld-hagezi-sync quarantine approve %s\" to sync it",
+		q.Folder, listShortName(src), q.Since.Format("2006-01-02 15:04"), formatNumber(q.Previous), formatNumber(q.Current), listShortName(src))
+}
+
+// quarantine [--json] | quarantine approve <source|short name|all>...
+func runQuarantineCommand(args []string) int {
+	fs := flag.NewFlagSet("quarantine", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the quarantined sources as JSON")
+	fs.Parse(args)
+
+	if err := loadState(stateFilePath()); err != nil {
+		logger.Printf("Failed to load state: %v", err)
+		return 1
+	}
+
+	if fs.Arg(0) != "approve" {
+		stateMutex.Lock()
+		defer stateMutex.Unlock()
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(state.Quarantine)
+			return 0
+		}
+		if len(state.Quarantine) == 0 {
+			fmt.Println("No sources are quarantined")
+			return 0
+		}
+		srcs := make([]string, 0, len(state.Quarantine))
+		for src := range state.Quarantine {
+			srcs = append(srcs, src)
+		}
+		sort.Strings(srcs)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "LIST\tFOLDER\tSINCE\tRULES BEFORE\tRULES NOW\tSIGMA")
+		for _, src := range srcs {
+			q := state.Quarantine[src]
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%.1f\n", listShortName(src), q.Folder, q.Since.Format("2006-01-02 15:04"), formatNumber(q.Previous), formatNumber(q.Current), q.Sigma)
+		}
+		w.Flush()
+		return 0
+	}
+
+	targets := fs.Args()[1:]
+	if len(targets) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: ctrld-hagezi-sync quarantine approve <list URL, short name or all>...")
+		return 2
+	}
+	stateMutex.Lock()
+	approved := 0
+	for src, q := range state.Quarantine {
+		for _, t := range targets {
+			if t == "all" || t == src || strings.EqualFold(t, listShortName(src)) {
+				// The approved size becomes the baseline for the next change
+				if s := state.Sources[src]; s != nil {
+					s.Sizes = appendSize(s.Sizes, q.Current)
+				}
+				delete(state.Quarantine, src)
+				fmt.Printf("Approved %s: folder '%s' syncs with %s rules from the next run\n", listShortName(src), q.Folder, formatNumber(q.Current))
+				approved++
+				break
+			}
+		}
+	}
+	stateMutex.Unlock()
+	if approved == 0 {
+		fmt.Fprintln(os.Stderr, "No quarantined source matches")
+		return 1
+	}
+	if err := saveState(); err != nil {
+		logger.Printf("Failed to save state: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,170 @@
+package ctrldsync
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// How one source folder is covered by a profile
+type AuditFolder struct {
+	Name      string `json:"name"`
+	Do        int    `json:"do"`
+	Rules     int    `json:"rules"`
+	Covered   int    `json:"covered"`   // present in an enabled folder with the same action
+	Conflicts int    `json:"conflicts"` // present in an enabled folder with a different action
+}
+
+// Comparison of a profile against a set of sources
+type Audit struct {
+	Profile   string        `json:"profile"`
+	Folders   []AuditFolder `json:"folders"`
+	Rules     int           `json:"rules"`
+	Covered   int           `json:"covered"`
+	Conflicts int           `json:"conflicts"`
+	Extra     int           `json:"extra"` // profile rules in no source folder
+}
+
+// Percentage of source rules covered
+func (a Audit) Coverage() float64 {
+	if a.Rules == 0 {
+		return 0
+	}
+	return float64(a.Covered) * 100 / float64(a.Rules)
+}
+
+// Compare a profile's enabled folders with the given sources without changing anything
+func auditProfile(profileID string, urls []string) (Audit, error) {
+	audit := Audit{Profile: profileID}
+
+	groups, err := listFolderDetails(profileID)
+	if err != nil {
+		return audit, err
+	}
+
+	// Effective action of every rule in an enabled folder, skipping the tool's own marker folders
+	actions := make(map[string]int)
+	for _, g := range groups {
+		name := strings.TrimSpace(g.Group)
+		if g.Action.Status != 1 || name == ManifestFolderName || isLockFolder(name) {
+			continue
+		}
+		rules, err := listFolderRules(profileID, interfaceToString(g.PK))
+		if err != nil {
+			return audit, fmt.Errorf("failed to read folder '%s': %w", name, err)
+		}
+		for _, rule := range rules {
+			actions[rule] = g.Action.Do
+		}
+	}
+
+	inSource := make(map[string]bool)
+	for _, url := range urls {
+		data, err := ghGet(url)
+		if err != nil {
+			return audit, fmt.Errorf("failed to fetch %s: %w", url, err)
+		}
+		applyOverrides(profileID, &data)
+
+		folder := AuditFolder{Name: strings.TrimSpace(data.Group.Group), Do: data.Group.Action.Do}
+		for _, rule := range data.Rules {
+			if rule.PK == "" || inSource[rule.PK] {
+				continue
+			}
+			inSource[rule.PK] = true
+			folder.Rules++
+			if do, exists := actions[rule.PK]; exists {
+				if do == folder.Do {
+					folder.Covered++
+				} else {
+					folder.Conflicts++
+				}
+			}
+		}
+		audit.Folders = append(audit.Folders, folder)
+		audit.Rules += folder.Rules
+		audit.Covered += folder.Covered
+		audit.Conflicts += folder.Conflicts
+	}
+
+	for rule := range actions {
+		if !inSource[rule] {
+			audit.Extra++
+		}
+	}
+	return audit, nil
+}
+
+// audit --profile <profile> [--preset <name>] [--json]
+func runAuditCommand(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	profile := fs.String("profile", "", "profile to audit (ID or name)")
+	presetName := fs.String("preset", "", "compare with this preset instead of lists.txt")
+	asJSON := fs.Bool("json", false, "print the audit as JSON")
+	fs.Parse(args)
+
+	token = getenv("TOKEN")
+	if token == "" || *profile == "" {
+		fmt.Fprintln(os.Stderr, "usage: ctrld-hagezi-sync audit --profile <profile> [--preset <name>] [--json] (TOKEN required)")
+		return 2
+	}
+
+	var urls []string
+	if *presetName != "" {
+		p, ok := findPreset(*presetName)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown preset %q\n", *presetName)
+			return 2
+		}
+		urls = p.URLs()
+	} else {
+		var err error
+		if urls, err = loadLists(); err != nil {
+			logger.Printf("Failed to load %s: %v", listsOrigin(), err)
+			return 1
+		}
+	}
+
+	overrides, err := loadOverrides(overridesFilePath())
+	if err != nil {
+		logger.Printf("Failed to load overrides: %v", err)
+		return 1
+	}
+	folderOverrides = overrides
+
+	if err := initClients(); err != nil {
+		logger.Printf("Failed to set up HTTP clients: %v", err)
+		return 1
+	}
+
+	profileID := resolveProfile(*profile)
+	audit, err := auditProfile(profileID, urls)
+	if err != nil {
+		logger.Printf("Audit of profile %s failed: %v", maskID(profileID), err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(audit)
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FOLDER\tACTION\tRULES\tCOVERED\tCONFLICTS\tCOVERAGE")
+	for _, f := range audit.Folders {
+		pct := 0.0
+		if f.Rules > 0 {
+			pct = float64(f.Covered) * 100 / float64(f.Rules)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%.1f%%\n", f.Name, actionLabel(f.Do), formatNumber(f.Rules), formatNumber(f.Covered), formatNumber(f.Conflicts), pct)
+	}
+	w.Flush()
+	fmt.Printf("\nProfile %s: %.1f%% of %s source rules covered, %s with a different action, %s rules not in any source\n",
+		maskID(profileID), audit.Coverage(), formatNumber(audit.Rules), formatNumber(audit.Conflicts), formatNumber(audit.Extra))
+	return 0
+}
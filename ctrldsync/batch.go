@@ -0,0 +1,41 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Largest encoded request body for one batch of rules; batches over it are split
+const DefaultBatchMaxBytes = 128 << 10
+
+var MaxBatchBytes = DefaultBatchMaxBytes
+
+// Split hostnames into batches of at most BatchSize entries and MaxBatchBytes of encoded form data
+func splitBatches(hostnames []string, baseBytes int) [][]string {
+	var batches [][]string
+	var batch []string
+	size := baseBytes
+	for _, hostname := range hostnames {
+		field := len(url.QueryEscape(fmt.Sprintf("hostnames[%d]", len(batch)))) + len(url.QueryEscape(hostname)) + 2 // "=" and "&"
+		if len(batch) > 0 && (len(batch) >= BatchSize || size+field > MaxBatchBytes) {
+			batches = append(batches, batch)
+			batch, size = nil, baseBytes
+			field = len(url.QueryEscape("hostnames[0]")) + len(url.QueryEscape(hostname)) + 2
+		}
+		batch = append(batch, hostname)
+		size += field
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// Encoded size of the form fields sent with every batch
+func batchBaseBytes(data map[string]string) int {
+	form := url.Values{}
+	for k, v := range data {
+		form.Set(k, v)
+	}
+	return len(form.Encode())
+}
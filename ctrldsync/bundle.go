@@ -0,0 +1,228 @@
+package ctrldsync
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bumped when the bundle layout changes incompatibly
+const BundleFormat = 1
+
+// Everything a sync needs to know about the desired state, with every source already fetched
+type Bundle struct {
+	Format  int       `json:"format"`
+	Created time.Time `json:"created"`
+	Version string    `json:"version"` // tool version that built it
+
+	Lists        []string            `json:"lists"`                   // global lists, presets expanded
+	ProfileLists map[string][]string `json:"profile_lists,omitempty"` // from ctrld-sync.yaml
+	ProfileTags  map[string][]string `json:"profile_tags,omitempty"`  // from tags.txt
+	TagLists     map[string][]string `json:"tag_lists,omitempty"`     // from lists-<tag>.txt
+	Overrides    []FolderOverride    `json:"overrides,omitempty"`     // from overrides.txt
+
+	// Fetched folder of every source above, keyed by source entry
+	Sources map[string]BundleFolder `json:"sources"`
+}
+
+// One fetched source, before overrides
+type BundleFolder struct {
+	Name      string   `json:"name"`
+	Do        int      `json:"do"`
+	Status    int      `json:"status"`
+	Version   string   `json:"version"`
+	Release   string   `json:"release,omitempty"` // tag of a GitHub release asset source
+	Rules     []string `json:"rules"`
+	Lines     []int    `json:"lines,omitempty"` // source line (or folder JSON position) of each rule
+	IPEntries []string `json:"ip_entries,omitempty"`
+}
+
+// Set by --from-bundle: every source comes from the bundle and nothing is downloaded
+var bundleMode bool
+
+// Read and check a bundle file
+func loadBundle(filename string) (Bundle, error) {
+	var b Bundle
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return b, err
+	}
+	if err := json.Unmarshal(data, &b); err != nil {
+		return b, fmt.Errorf("%s: %w", filename, err)
+	}
+	if b.Format != BundleFormat {
+		return b, fmt.Errorf("%s: bundle format %d, this version reads %d", filename, b.Format, BundleFormat)
+	}
+	if len(b.Lists) == 0 {
+		return b, fmt.Errorf("%s: bundle has no lists", filename)
+	}
+	return b, nil
+}
+
+// Make a bundle the source of the lists, tags, overrides and folder data for this run
+func applyBundle(b Bundle) {
+	bundleMode = true
+	FolderURLs = b.Lists
+	configProfileLists = b.ProfileLists
+	folderOverrides = b.Overrides
+	profileTagMap = b.ProfileTags
+	if profileTagMap == nil {
+		profileTagMap = map[string][]string{}
+	}
+
+	// Tags without a list in the bundle had no lists-<tag>.txt when it was built
+	tagListsMutex.Lock()
+	tagLists = b.TagLists
+	if tagLists == nil {
+		tagLists = make(map[string][]string)
+	}
+	tagListsFrozen = true
+	tagListsMutex.Unlock()
+
+	cacheMutex.Lock()
+	for src, f := range b.Sources {
+		data := FolderData{
+			Group:     Group{Group: f.Name, Action: Action{Do: f.Do, Status: f.Status}},
+			Rules:     make([]Rule, len(f.Rules)),
+			Source:    src,
+			Version:   f.Version,
+			Release:   f.Release,
+			IPEntries: f.IPEntries,
+		}
+		for i, h := range f.Rules {
+			data.Rules[i] = Rule{PK: h}
+			if i < len(f.Lines) {
+				data.Rules[i].Line = f.Lines[i]
+			}
+		}
+		cache[src] = data
+	}
+	cacheMutex.Unlock()
+}
+
+// Resolve the configured lists, tags and overrides and fetch every source
+func buildBundle() (Bundle, error) {
+	b := Bundle{
+		Format:       BundleFormat,
+		Created:      time.Now().UTC(),
+		Version:      Version,
+		ProfileLists: configProfileLists,
+		ProfileTags:  profileTagMap,
+		TagLists:     make(map[string][]string),
+		Overrides:    folderOverrides,
+		Sources:      make(map[string]BundleFolder),
+	}
+
+	var err error
+	if b.Lists, err = loadLists(); err != nil {
+		return b, fmt.Errorf("%s: %w", listsOrigin(), err)
+	}
+	files, _ := filepath.Glob(filepath.Join(listsDir, "lists-*.txt"))
+	for _, filename := range files {
+		tag := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(filename), "lists-"), ".txt")
+		if b.TagLists[tag], err = loadFolderURLs(filename); err != nil {
+			return b, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+
+	sources := append([]string{}, b.Lists...)
+	for _, lists := range []map[string][]string{b.ProfileLists, b.TagLists} {
+		for _, urls := range lists {
+			sources = append(sources, urls...)
+		}
+	}
+	failed := 0
+	for _, src := range sources {
+		if _, done := b.Sources[src]; done {
+			continue
+		}
+		data, err := ghGet(src)
+		if err != nil {
+			logger.Printf("Failed to fetch %s: %v", src, err)
+			failed++
+			continue
+		}
+		folder := BundleFolder{
+			Name:      strings.TrimSpace(data.Group.Group),
+			Do:        data.Group.Action.Do,
+			Status:    data.Group.Action.Status,
+			Version:   data.Version,
+			Release:   data.Release,
+			IPEntries: data.IPEntries,
+		}
+		rules := make([]Rule, 0, len(data.Rules))
+		for _, r := range data.Rules {
+			if r.PK != "" {
+				rules = append(rules, r)
+			}
+		}
+		sort.SliceStable(rules, func(i, j int) bool { return rules[i].PK < rules[j].PK })
+		folder.Rules = make([]string, len(rules))
+		folder.Lines = make([]int, len(rules))
+		for i, r := range rules {
+			folder.Rules[i], folder.Lines[i] = r.PK, r.Line
+		}
+		b.Sources[src] = folder
+	}
+	if failed > 0 {
+		return b, fmt.Errorf("%d sources could not be fetched; a bundle must be complete", failed)
+	}
+	return b, nil
+}
+
+// bundle [-o file]: write the resolved desired state as one JSON file
+func runBundleCommand(args []string) int {
+	fs := flag.NewFlagSet("bundle", flag.ExitOnError)
+	output := fs.String("o", "", "write the bundle to this file instead of stdout")
+	fs.Parse(args)
+
+	var err error
+	if folderOverrides, err = loadOverrides(overridesFilePath()); err != nil {
+		logger.Printf("Failed to load %s: %v", overridesFilePath(), err)
+		return 1
+	}
+	tagsFile := getenv("TAGS_FILE")
+	if tagsFile == "" {
+		tagsFile = DefaultTagsFile
+	}
+	if profileTagMap, err = loadProfileTags(tagsFile); err != nil {
+		logger.Printf("Failed to load %s: %v", tagsFile, err)
+		return 1
+	}
+	if err := initClients(); err != nil {
+		logger.Printf("Failed to set up HTTP clients: %v", err)
+		return 1
+	}
+
+	b, err := buildBundle()
+	if err != nil {
+		logger.Printf("Failed to build bundle: %v", err)
+		return 1
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		logger.Printf("Failed to encode bundle: %v", err)
+		return 1
+	}
+	data = append(data, '\n')
+
+	if *output == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		logger.Printf("Failed to write %s: %v", *output, err)
+		return 1
+	}
+	rules := 0
+	for _, f := range b.Sources {
+		rules += len(f.Rules)
+	}
+	logger.Printf("Wrote %s: %d sources, %s rules", *output, len(b.Sources), formatNumber(rules))
+	return 0
+}
@@ -0,0 +1,287 @@
+package ctrldsync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hosts a cache proxy fetches from unless --allow-hosts says otherwise
+const DefaultProxyHosts = "raw.githubusercontent.com"
+
+// Read-through cache proxy that other instances fetch their sources from (SOURCE_CACHE), or "" to fetch directly
+var sourceCacheURL string
+
+// Route a source download through the cache proxy. Sources with credentials and signed
+// object storage requests are fetched directly, so nothing private lands in the shared cache.
+func viaSourceCache(src string) (string, bool) {
+	if sourceCacheURL == "" || !(strings.HasPrefix(src, "https://") || strings.HasPrefix(src, "http://")) {
+		return "", false
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", false
+	}
+	if _, private := sourceAuth.Load(sourceAuthKey(u)); private {
+		return "", false
+	}
+	if _, signed := objectURLs.Load(objectKey(u)); signed {
+		return "", false
+	}
+	target := strings.TrimSuffix(sourceCacheURL, "/") + "/fetch?url=" + url.QueryEscape(src)
+	if token := getenv("SOURCE_CACHE_TOKEN"); token != "" {
+		if parsed, err := url.Parse(target); err == nil {
+			h := make(http.Header)
+			h.Set("Authorization", "Bearer "+token)
+			sourceAuth.Store(sourceAuthKey(parsed), h)
+		}
+	}
+	return target, true
+}
+
+// Cached upstream response, stored next to its body
+type proxyEntry struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	ContentType  string    `json:"content_type,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+type cacheProxy struct {
+	dir   string
+	ttl   time.Duration
+	hosts map[string]bool
+	token string
+
+	// One upstream fetch per URL at a time; concurrent misses wait for it
+	mu       sync.Mutex
+	inflight map[string]*sync.Mutex
+}
+
+func (p *cacheProxy) paths(src string) (meta, body string) {
+	sum := sha256.Sum256([]byte(src))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(p.dir, name+".json"), filepath.Join(p.dir, name+".body")
+}
+
+func (p *cacheProxy) load(src string) (*proxyEntry, []byte) {
+	metaPath, bodyPath := p.paths(src)
+	raw, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, nil
+	}
+	var e proxyEntry
+	if json.Unmarshal(raw, &e) != nil || e.URL != src {
+		return nil, nil
+	}
+	body, err := os.ReadFile(bodyPath)
+	if err != nil {
+		return nil, nil
+	}
+	return &e, body
+}
+
+// Write body then metadata, each through a temp file, so readers never see a half-written entry
+func (p *cacheProxy) store(e *proxyEntry, body []byte) error {
+	metaPath, bodyPath := p.paths(e.URL)
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		path string
+		data []byte
+	}{{bodyPath, body}, {metaPath, raw}} {
+		tmp := f.path + ".tmp"
+		if err := os.WriteFile(tmp, f.data, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, f.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *cacheProxy) lock(src string) func() {
+	p.mu.Lock()
+	l, ok := p.inflight[src]
+	if !ok {
+		l = &sync.Mutex{}
+		p.inflight[src] = l
+	}
+	p.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// Cached copy of src, revalidated or refetched once older than the TTL; stale copies
+// are served when the upstream fails. status is HIT, MISS, REVALIDATED or STALE.
+func (p *cacheProxy) get(src string) (e *proxyEntry, body []byte, status string, err error) {
+	unlock := p.lock(src)
+	defer unlock()
+
+	e, body = p.load(src)
+	if e != nil && time.Since(e.Fetched) < p.ttl {
+		return e, body, "HIT", nil
+	}
+
+	req, err := http.NewRequest("GET", src, nil)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if e != nil {
+		if e.ETag != "" {
+			req.Header.Set("If-None-Match", e.ETag)
+		}
+		if e.LastModified != "" {
+			req.Header.Set("If-Modified-Since", e.LastModified)
+		}
+	}
+	resp, err := ghClient.Do(req)
+	if err == nil && resp.StatusCode == http.StatusNotModified && e != nil {
+		resp.Body.Close()
+		e.Fetched = time.Now().UTC()
+		if err := p.store(e, body); err != nil {
+			logger.Printf("Failed to update cache entry for %s: %v", src, err)
+		}
+		return e, body, "REVALIDATED", nil
+	}
+	if err == nil && resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("upstream answered HTTP %d", resp.StatusCode)
+	}
+	var fresh []byte
+	if err == nil {
+		fresh, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err != nil {
+		if e != nil {
+			logger.Printf("Serving stale %s (fetched %s): %v", src, e.Fetched.Format(time.RFC3339), err)
+			return e, body, "STALE", nil
+		}
+		return nil, nil, "", err
+	}
+
+	e = &proxyEntry{
+		URL:          src,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		ContentType:  resp.Header.Get("Content-Type"),
+		Fetched:      time.Now().UTC(),
+	}
+	if err := p.store(e, fresh); err != nil {
+		logger.Printf("Failed to cache %s: %v", src, err)
+	}
+	logger.Printf("Fetched %s (%d bytes)", src, len(fresh))
+	return e, fresh, "MISS", nil
+}
+
+func (p *cacheProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/healthz" {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	if r.URL.Path != "/fetch" || (r.Method != "GET" && r.Method != "HEAD") {
+		http.NotFound(w, r)
+		return
+	}
+	if p.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+p.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	src := r.URL.Query().Get("url")
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		http.Error(w, "url must be an http(s) URL", http.StatusBadRequest)
+		return
+	}
+	if !p.hosts[strings.ToLower(u.Hostname())] {
+		http.Error(w, "host not allowed: "+u.Hostname(), http.StatusForbidden)
+		return
+	}
+
+	e, body, status, err := p.get(src)
+	if err != nil {
+		logger.Printf("Failed to fetch %s: %v", src, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("X-Cache", status)
+	if e.ContentType != "" {
+		w.Header().Set("Content-Type", e.ContentType)
+	}
+	// A strong validator of the cached body lets clients resume interrupted downloads
+	sum := sha256.Sum256(body)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, "", e.Fetched, bytes.NewReader(body))
+}
+
+// cache-proxy [--listen addr] [--dir path] [--ttl d] [--allow-hosts list]
+func runCacheProxyCommand(args []string) int {
+	fs := flag.NewFlagSet("cache-proxy", flag.ExitOnError)
+	listen := fs.String("listen", envOr("CACHE_PROXY_LISTEN", ":8080"), "address to serve on")
+	dir := fs.String("dir", getenv("CACHE_PROXY_DIR"), "directory for cached sources (default: under the user cache directory)")
+	ttl := fs.Duration("ttl", 10*time.Minute, "serve cached sources this long before checking upstream again")
+	allowHosts := fs.String("allow-hosts", envOr("CACHE_PROXY_HOSTS", DefaultProxyHosts), "comma-separated hosts the proxy fetches from")
+	fs.Parse(args)
+
+	if *dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			cacheDir = os.TempDir()
+		}
+		*dir = filepath.Join(cacheDir, "ctrld-hagezi-sync", "proxy")
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		logger.Printf("Failed to create cache directory: %v", err)
+		return 1
+	}
+	if err := initClients(); err != nil {
+		logger.Printf("Failed to set up HTTP clients: %v", err)
+		return 1
+	}
+
+	p := &cacheProxy{
+		dir:      *dir,
+		ttl:      *ttl,
+		hosts:    make(map[string]bool),
+		token:    getenv("CACHE_PROXY_TOKEN"),
+		inflight: make(map[string]*sync.Mutex),
+	}
+	for _, h := range splitList(*allowHosts) {
+		p.hosts[strings.ToLower(h)] = true
+	}
+	auth := "no token required"
+	if p.token != "" {
+		auth = "CACHE_PROXY_TOKEN required"
+	}
+	logger.Printf("Cache proxy on %s for %s (cache %s, ttl %v, %s)", *listen, strings.Join(splitList(*allowHosts), ", "), *dir, *ttl, auth)
+	if err := http.ListenAndServe(*listen, p); err != nil {
+		logger.Printf("Cache proxy stopped: %v", err)
+		return 1
+	}
+	return 0
+}
+
+func envOr(name, fallback string) string {
+	if v := getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,176 @@
+package ctrldsync
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Runs in a row a folder must fail before reports call it persistent
+const PersistentFailureRuns = 2
+
+// A folder that failed completely, retried first on the next run
+type CarryoverFolder struct {
+	Folder string    `json:"folder,omitempty"`
+	Error  string    `json:"error"`
+	Since  time.Time `json:"since"` // first failure in the current streak
+	Runs   int       `json:"runs"`  // failed runs in a row
+}
+
+// A carried-over folder that kept failing, as shown in reports
+type PersistentFailure struct {
+	Profile string `json:"profile"`
+	Source  string `json:"source"`
+	CarryoverFolder
+}
+
+// Sources of a profile that failed last run and how this run went for them
+type carryoverRun struct {
+	profileID string
+	previous  map[string]CarryoverFolder
+	failed    map[string]CarryoverFolder
+	synced    map[string]bool
+}
+
+func newCarryoverRun(profileID string) *carryoverRun {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	previous := make(map[string]CarryoverFolder)
+	if ps, exists := state.Profiles[profileID]; exists {
+		for src, c := range ps.Carryover {
+			previous[src] = *c
+		}
+	}
+	return &carryoverRun{
+		profileID: profileID,
+		previous:  previous,
+		failed:    make(map[string]CarryoverFolder),
+		synced:    make(map[string]bool),
+	}
+}
+
+// Move sources that failed last run to the front, keeping the order otherwise
+func (c *carryoverRun) prioritize(urls []string) []string {
+	var retry, rest []string
+	for _, u := range urls {
+		if _, ok := c.previous[u]; ok {
+			retry = append(retry, u)
+		} else {
+			rest = append(rest, u)
+		}
+	}
+	if len(retry) > 0 {
+		names := make([]string, len(retry))
+		for i, u := range retry {
+			names[i] = c.name(u)
+		}
+		logger.Printf("Profile %s: retrying %d folders carried over from the last run first (%s)", maskID(c.profileID), len(retry), strings.Join(names, ", "))
+	}
+	return append(retry, rest...)
+}
+
+// Report whether a source failed last run
+func (c *carryoverRun) carried(src string) bool {
+	_, ok := c.previous[src]
+	return ok
+}
+
+// Folder name of a source, falling back to its file name when it never got that far
+func (c *carryoverRun) name(src string) string {
+	if f := c.failed[src].Folder; f != "" {
+		return f
+	}
+	if f := c.previous[src].Folder; f != "" {
+		return f
+	}
+	return listShortName(src)
+}
+
+// Record a folder that failed completely this run
+func (c *carryoverRun) fail(src, folder, err string) {
+	// Keep the first line only; API errors can carry a whole HTML page
+	err, _, _ = strings.Cut(err, "\n")
+	if len(err) > 200 {
+		err = err[:200] + "..."
+	}
+	c.failed[src] = CarryoverFolder{Folder: folder, Error: strings.TrimSpace(err)}
+}
+
+// Record a folder that synced this run
+func (c *carryoverRun) succeed(src string) {
+	c.synced[src] = true
+}
+
+// Store the outcome; sources neither failed nor synced, e.g. deferred ones, keep their entry
+func (c *carryoverRun) save(listed []string) {
+	now := time.Now().UTC()
+	inList := make(map[string]bool, len(listed))
+	for _, u := range listed {
+		inList[u] = true
+	}
+
+	next := make(map[string]*CarryoverFolder)
+	for src, prev := range c.previous {
+		// A partial run can't tell whether a source was dropped from the lists
+		if c.synced[src] || (!inList[src] && len(onlyLists) == 0 && !stdinMode && !folderFilter.active()) {
+			continue
+		}
+		entry := prev
+		next[src] = &entry
+	}
+	for src, f := range c.failed {
+		entry := f
+		entry.Since, entry.Runs = now, 1
+		if prev, ok := c.previous[src]; ok {
+			entry.Since, entry.Runs = prev.Since, prev.Runs+1
+			if entry.Folder == "" {
+				entry.Folder = prev.Folder
+			}
+		}
+		if entry.Runs >= PersistentFailureRuns {
+			warnf("folder '%s' failed %d runs in a row: %s", c.name(src), entry.Runs, entry.Error)
+		}
+		next[src] = &entry
+	}
+	for src := range c.synced {
+		if _, ok := c.previous[src]; ok {
+			logger.Printf("Profile %s: folder '%s' carried over from the last run synced again", maskID(c.profileID), c.name(src))
+		}
+	}
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	ps := profileStateLocked(c.profileID)
+	if len(next) == 0 {
+		ps.Carryover = nil
+	} else {
+		ps.Carryover = next
+	}
+}
+
+// Carried-over folders of the given profiles that failed several runs in a row
+func persistentFailures(results []ProfileResult) []PersistentFailure {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	var failures []PersistentFailure
+	for _, r := range results {
+		ps, exists := state.Profiles[r.ProfileID]
+		if !exists {
+			continue
+		}
+		for src, c := range ps.Carryover {
+			if c.Runs >= PersistentFailureRuns {
+				failures = append(failures, PersistentFailure{Profile: r.ProfileID, Source: src, CarryoverFolder: *c})
+			}
+		}
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].Profile != failures[j].Profile {
+			return failures[i].Profile < failures[j].Profile
+		}
+		return failures[i].Source < failures[j].Source
+	})
+	return failures
+}
@@ -0,0 +1,103 @@
+package ctrldsync
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Longest delay chaos mode adds to a slowed-down request
+const ChaosMaxDelay = 3 * time.Second
+
+// Flags registered but left out of -help
+var hiddenFlags = make(map[string]bool)
+
+// Keep a flag out of the usage message
+func hideFlag(fs *flag.FlagSet, name string) {
+	hiddenFlags[name] = true
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+		visible.SetOutput(fs.Output())
+		fs.VisitAll(func(f *flag.Flag) {
+			if !hiddenFlags[f.Name] {
+				visible.Var(f.Value, f.Name, f.Usage)
+			}
+		})
+		visible.PrintDefaults()
+	}
+}
+
+// Fault rate from CHAOS, 0 when unset or invalid
+func envChaosRate() float64 {
+	rate, _ := strconv.ParseFloat(getenv("CHAOS"), 64)
+	return rate
+}
+
+// Transport that randomly fails or slows down requests to exercise retries
+type chaosTransport struct {
+	next http.RoundTripper
+	rate float64
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	roll := rand.Float64()
+	switch {
+	case roll < t.rate/3:
+		return chaosResponse(req, http.StatusTooManyRequests), nil
+	case roll < 2*t.rate/3:
+		return chaosResponse(req, http.StatusInternalServerError), nil
+	case roll < t.rate:
+		delay := time.Duration(rand.Int63n(int64(ChaosMaxDelay)))
+		logger.Printf("Chaos: delaying %s %s by %v", req.Method, req.URL.Path, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// Synthetic error response that never reached the server
+func chaosResponse(req *http.Request, status int) *http.Response {
+	logger.Printf("Chaos: injecting HTTP %d for %s %s", status, req.Method, req.URL.Path)
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	body := `{"success":false,"error":{"message":"injected by chaos mode"}}`
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	resp.Header.Set("Content-Type", "application/json")
+	if status == http.StatusTooManyRequests {
+		resp.Header.Set("Retry-After", "1")
+	}
+	return resp
+}
+
+// Inject faults into API requests; refuses to run against the real Control D API
+func enableChaos(rate float64) error {
+	if rate > 1 {
+		return fmt.Errorf("fault rate %v must be between 0 and 1", rate)
+	}
+	if APIBase == DefaultAPIBase {
+		return fmt.Errorf("only available with API_BASE pointed at a mock server")
+	}
+	next := apiClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	apiClient.Transport = &chaosTransport{next: next, rate: rate}
+	logger.Printf("Chaos mode: failing or slowing %.0f%% of requests to %s", rate*100, APIBase)
+	return nil
+}
@@ -0,0 +1,150 @@
+package ctrldsync
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Print the available subcommands
+func printCommands() {
+	fmt.Fprintf(os.Stderr, `usage: ctrld-hagezi-sync [command] [flags] [profile...]
+
+Commands:
+  sync           sync lists to the selected profiles (the default)
+  delete         remove synced folders from the selected profiles
+  bundle         write the resolved lists, overrides and every fetched rule to one JSON file
+  pause          hold off syncs and deletes, for a while or until resumed
+  resume         lift a pause
+  quarantine     show or approve lists held back after an unusual size change
+  jobs           run the named jobs from ctrld-sync.yaml, one after another or in parallel
+  list-folders   show the folders in the selected profiles
+  promote        make one profile's synced folders match another's
+  audit          compare an existing profile with the lists, read-only
+  presets        list, show or expand the built-in list presets
+  digest         summarize upstream list changes since the last digest
+  impact         count the queries in an exported query log that candidate lists would have matched
+  upstream-diff  show the domains added and removed upstream since the last sync
+  history        show per-run metrics
+  sweep          find (or delete) synced folders whose list is gone
+  state          export or import the local state file
+  snapshot       back up every folder and rule of the selected profiles
+  restore        recreate a snapshot in its profile or another one
+  cache-proxy    serve the lists to other instances from one shared cache
+  stress         run full syncs against a built-in mock API and check the result
+  version        print the version
+  help           show this message
+
+Run "ctrld-hagezi-sync <command> -h" for a command's flags.
+`)
+}
+
+// Whether a first argument that is no command can be taken as profile IDs, comma-separated:
+// letters and digits with at least one digit, so a mistyped command isn't synced as a profile
+func looksLikeProfileIDs(arg string) bool {
+	for _, id := range strings.Split(arg, ",") {
+		digit := false
+		for _, c := range id {
+			switch {
+			case c >= '0' && c <= '9':
+				digit = true
+			case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			default:
+				return false
+			}
+		}
+		if !digit {
+			return false
+		}
+	}
+	return true
+}
+
+// Folder as shown by list-folders
+type ListedFolder struct {
+	Profile string `json:"profile"`
+	Name    string `json:"name"`
+	PK      string `json:"pk"`
+	Do      int    `json:"do"`
+	Status  int    `json:"status"`
+	Rules   int    `json:"rules"`
+	Managed bool   `json:"managed"`
+}
+
+// list-folders [--json] [profile...]
+func runListFoldersCommand(args []string) int {
+	fs := flag.NewFlagSet("list-folders", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print folders as JSON")
+	fs.Parse(args)
+
+	token = getenv("TOKEN")
+	entries := fs.Args()
+	if len(entries) == 0 {
+		entries = splitList(getenv("PROFILE"))
+	}
+	if token == "" || len(entries) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: ctrld-hagezi-sync list-folders [--json] <profile...> (TOKEN required; PROFILE used when no profiles are given)")
+		return 2
+	}
+	if err := initClients(); err != nil {
+		logger.Printf("Failed to set up HTTP clients: %v", err)
+		return 1
+	}
+	if err := loadState(stateFilePath()); err != nil {
+		warnf("could not load state: %v", err)
+	}
+
+	var folders []ListedFolder
+	failed := false
+	for _, entry := range entries {
+		profileID := resolveProfile(entry)
+		groups, err := listFolderDetails(profileID)
+		if err != nil {
+			logger.Printf("Profile %s: %v", maskID(profileID), err)
+			failed = true
+			continue
+		}
+		ps, _ := getProfileState(profileID)
+		for _, g := range groups {
+			name := strings.TrimSpace(g.Group)
+			_, managed := ps.Folders[name]
+			folders = append(folders, ListedFolder{
+				Profile: profileID,
+				Name:    name,
+				PK:      interfaceToString(g.PK),
+				Do:      g.Action.Do,
+				Status:  g.Action.Status,
+				Rules:   g.Count,
+				Managed: managed || name == ManifestFolderName || isLockFolder(name),
+			})
+		}
+	}
+	sort.SliceStable(folders, func(i, j int) bool {
+		if folders[i].Profile != folders[j].Profile {
+			return folders[i].Profile < folders[j].Profile
+		}
+		return folders[i].Name < folders[j].Name
+	})
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(folders)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PROFILE\tFOLDER\tACTION\tSTATUS\tRULES\tMANAGED")
+		for _, f := range folders {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\n", maskID(f.Profile), f.Name, actionLabel(f.Do), statusLabel(f.Status), formatNumber(f.Rules), f.Managed)
+		}
+		w.Flush()
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
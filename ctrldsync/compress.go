@@ -0,0 +1,116 @@
+package ctrldsync
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Largest list a compressed source may expand to, so a corrupt or hostile archive can't exhaust memory
+const MaxDecompressedSize = 1 << 30
+
+// File extensions of compressed sources, dropped along with the list's own extension from its short name
+var compressedExts = []string{".gz", ".zst", ".zip"}
+
+// Expand a gzip, zstd or zip body, recognized by its magic bytes rather than the URL;
+// other bodies are returned as they are with an empty kind. A zip archive must hold one
+// list, or the file=<name or glob> option picks it.
+func decompressSource(body []byte, member string) (out []byte, kind string, err error) {
+	switch {
+	case bytes.HasPrefix(body, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, "gzip", err
+		}
+		defer zr.Close()
+		out, err = readLimited(zr)
+		return out, "gzip", err
+
+	case bytes.HasPrefix(body, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderMaxMemory(MaxDecompressedSize))
+		if err != nil {
+			return nil, "zstd", err
+		}
+		defer zr.Close()
+		out, err = readLimited(zr)
+		return out, "zstd", err
+
+	case bytes.HasPrefix(body, []byte("PK\x03\x04")):
+		out, err = unzipMember(body, member)
+		return out, "zip", err
+	}
+	if member != "" {
+		return nil, "", fmt.Errorf("file=%s given, but the source is not a zip archive", member)
+	}
+	return body, "", nil
+}
+
+func unzipMember(body []byte, member string) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+	var matches []*zip.File
+	var names []string
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		names = append(names, f.Name)
+		if member == "" {
+			matches = append(matches, f)
+		} else if ok, _ := path.Match(member, f.Name); ok || f.Name == member {
+			matches = append(matches, f)
+		}
+	}
+	switch {
+	case len(matches) == 0 && member != "":
+		return nil, fmt.Errorf("zip archive has no file matching %q (it holds %s)", member, strings.Join(names, ", "))
+	case len(matches) == 0:
+		return nil, fmt.Errorf("zip archive is empty")
+	case len(matches) > 1 && member == "":
+		return nil, fmt.Errorf("zip archive holds several files (%s); pick one with file=<name>", strings.Join(names, ", "))
+	case len(matches) > 1:
+		matched := make([]string, len(matches))
+		for i, f := range matches {
+			matched[i] = f.Name
+		}
+		return nil, fmt.Errorf("zip archive has several files matching %q: %s", member, strings.Join(matched, ", "))
+	}
+	if matches[0].UncompressedSize64 > MaxDecompressedSize {
+		return nil, fmt.Errorf("%s expands to more than %d MB", matches[0].Name, MaxDecompressedSize>>20)
+	}
+	rc, err := matches[0].Open()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", matches[0].Name, err)
+	}
+	defer rc.Close()
+	return readLimited(rc)
+}
+
+func readLimited(r io.Reader) ([]byte, error) {
+	out, err := io.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > MaxDecompressedSize {
+		return nil, fmt.Errorf("expands to more than %d MB", MaxDecompressedSize>>20)
+	}
+	return out, nil
+}
+
+// Strip a compression extension, e.g. "ads.txt.gz" becomes "ads.txt"
+func trimCompressedExt(name string) string {
+	for _, ext := range compressedExts {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
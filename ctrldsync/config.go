@@ -0,0 +1,326 @@
+package ctrldsync
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultConfigFile is read from the working directory when CONFIG_FILE is not set
+const DefaultConfigFile = "ctrld-sync.yaml"
+
+// Settings from the config file; environment variables win over every field
+type Config struct {
+	Token       string   `yaml:"token"`       // TOKEN
+	Profiles    []string `yaml:"profiles"`    // PROFILE
+	Lists       []string `yaml:"lists"`       // replaces lists.txt
+	Concurrency int      `yaml:"concurrency"` // CONCURRENCY
+	BatchSize   int      `yaml:"batch_size"`  // BATCH_SIZE
+	MaxRetries  int      `yaml:"max_retries"` // MAX_RETRIES
+
+	BatchConcurrency int `yaml:"batch_concurrency"` // BATCH_CONCURRENCY
+
+	BatchMaxBytes int    `yaml:"batch_max_bytes"` // BATCH_MAX_BYTES
+	RetryDelay    string `yaml:"retry_delay"`     // RETRY_DELAY
+	HTTPTimeout   string `yaml:"http_timeout"`    // HTTP_TIMEOUT
+
+	// Sources (URLs or short names) always synced as allow folders
+	AllowLists []string `yaml:"allow_lists"` // ALLOW_LISTS
+
+	// Lists for specific profiles (by ID or name) instead of the global ones
+	ProfileLists map[string][]string `yaml:"profile_lists"`
+
+	// Named jobs for the jobs command, each with its own token, profiles and lists
+	Jobs []Job `yaml:"jobs"`
+
+	// Values for {name} placeholders in lists, e.g. variant: pro
+	Variables map[string]string `yaml:"variables"` // VAR_<NAME>
+}
+
+// List lines and per-profile list lines from the config file, turned into URLs by loadLists
+// so that commands without lists don't fetch include: manifests
+var (
+	configListLines        []string
+	configProfileListLines map[string][]string
+)
+
+// Source URLs per lowercased profile ID or name from the config file, set by loadLists
+var configProfileLists map[string][]string
+
+// Config file path from CONFIG_FILE
+func configFilePath() string {
+	if path := getenv("CONFIG_FILE"); path != "" {
+		return path
+	}
+	return DefaultConfigFile
+}
+
+// Load the config file; a missing file is an empty config
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Apply the config file, letting environment variables override it
+func applyConfig(path string) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	// Fill in TOKEN and PROFILE so every command picks them up the usual way
+	if getenv("TOKEN") == "" && cfg.Token != "" {
+		setenv("TOKEN", cfg.Token)
+	}
+	if getenv("PROFILE") == "" && len(cfg.Profiles) > 0 {
+		setenv("PROFILE", strings.Join(cfg.Profiles, ","))
+	}
+
+	listVars = make(map[string]string, len(cfg.Variables))
+	for name, value := range cfg.Variables {
+		listVars[strings.ToLower(name)] = value
+	}
+
+	seen := make(map[string]bool)
+	for i, job := range cfg.Jobs {
+		if job.Name == "" {
+			return fmt.Errorf("%s: jobs[%d]: name is required", path, i)
+		}
+		if seen[job.Name] {
+			return fmt.Errorf("%s: jobs: duplicate name %q", path, job.Name)
+		}
+		seen[job.Name] = true
+	}
+	configJobs = cfg.Jobs
+
+	allowLists = cfg.AllowLists
+	if v := getenv("ALLOW_LISTS"); v != "" {
+		allowLists = splitList(v)
+	}
+
+	configListLines = cfg.Lists
+	configProfileListLines = cfg.ProfileLists
+
+	for _, setting := range []struct {
+		env   string
+		value int
+		dst   *int
+	}{
+		{"CONCURRENCY", cfg.Concurrency, &MaxConcurrentProfiles},
+		{"BATCH_CONCURRENCY", cfg.BatchConcurrency, &MaxConcurrentBatches},
+		{"BATCH_SIZE", cfg.BatchSize, &BatchSize},
+		{"MAX_RETRIES", cfg.MaxRetries, &MaxRetries},
+		{"BATCH_MAX_BYTES", cfg.BatchMaxBytes, &MaxBatchBytes},
+	} {
+		value := setting.value
+		if v := getenv(setting.env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", setting.env, err)
+			}
+			value = n
+		}
+		if value < 0 {
+			return fmt.Errorf("%s must not be negative", setting.env)
+		}
+		if value > 0 {
+			*setting.dst = value
+		}
+	}
+
+	for _, setting := range []struct {
+		env   string
+		value string
+		dst   *time.Duration
+	}{
+		{"RETRY_DELAY", cfg.RetryDelay, &RetryDelay},
+		{"HTTP_TIMEOUT", cfg.HTTPTimeout, &HTTPTimeout},
+	} {
+		value := setting.value
+		if v := getenv(setting.env); v != "" {
+			value = v
+		}
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", setting.env, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("%s must be positive", setting.env)
+		}
+		*setting.dst = d
+	}
+
+	setBatchConcurrency()
+	return nil
+}
+
+// Settings of a run started through a Syncer, read in place of the process environment;
+// nil for the command, which only has its environment
+var runEnv map[string]string
+
+func getenv(name string) string {
+	v, _ := lookupEnv(name)
+	return v
+}
+
+func lookupEnv(name string) (string, bool) {
+	if v, ok := runEnv[name]; ok {
+		return v, true
+	}
+	return os.LookupEnv(name)
+}
+
+func setenv(name, value string) {
+	if runEnv != nil {
+		runEnv[name] = value
+		return
+	}
+	os.Setenv(name, value)
+}
+
+// Environment for commands the run starts, such as hooks
+func environ() []string {
+	env := os.Environ()
+	for name, value := range runEnv {
+		env = append(env, name+"="+value)
+	}
+	return env
+}
+
+// A non-negative integer from the environment; 0 when unset
+func envInt(name string) (int, error) {
+	v := getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%s must not be negative", name)
+	}
+	return n, nil
+}
+
+// A non-negative duration from the environment; def when unset
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v := getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s must not be negative", name)
+	}
+	return d, nil
+}
+
+// Size the batch push slots from MaxConcurrentBatches, or one per concurrent profile when it is 0
+func setBatchConcurrency() {
+	batchSlots = MaxConcurrentBatches
+	if batchSlots == 0 {
+		batchSlots = MaxConcurrentProfiles
+	}
+	batchScheduler = newFairScheduler(batchSlots)
+}
+
+// DefaultListsFile holds one source URL or preset:<name> per line
+const DefaultListsFile = "lists.txt"
+
+// Set from --sources and --lists-file; SOURCES and LISTS_FILE are used when empty
+var listSources, listsFile string
+
+func sourcesSetting() string {
+	if listSources != "" {
+		return listSources
+	}
+	return getenv("SOURCES")
+}
+
+func listsFileSetting() string {
+	if listsFile != "" {
+		return listsFile
+	}
+	return getenv("LISTS_FILE")
+}
+
+// Where the source lists come from, for log messages
+func listsOrigin() string {
+	switch {
+	case sourcesSetting() != "":
+		return "SOURCES"
+	case listsFileSetting() != "":
+		return listsFileSetting()
+	case len(configListLines) > 0:
+		return configFilePath()
+	}
+	return DefaultListsFile
+}
+
+// Source URLs from SOURCES, LISTS_FILE, the config file or lists.txt, in that order;
+// also resolves the config file's per-profile lists
+func loadLists() ([]string, error) {
+	configProfileLists = nil
+	for profile, lines := range configProfileListLines {
+		urls, err := parseListLines(lines)
+		if err != nil {
+			return nil, fmt.Errorf("%s: profile_lists: %s: %w", configFilePath(), profile, err)
+		}
+		if configProfileLists == nil {
+			configProfileLists = make(map[string][]string)
+		}
+		configProfileLists[strings.ToLower(strings.TrimSpace(profile))] = urls
+	}
+
+	switch {
+	case sourcesSetting() != "":
+		return parseListLines(splitList(sourcesSetting()))
+	case listsFileSetting() != "":
+		return loadFolderURLs(listsFileSetting())
+	case len(configListLines) > 0:
+		urls, err := parseListLines(configListLines)
+		if err != nil {
+			return nil, fmt.Errorf("%s: lists: %w", configFilePath(), err)
+		}
+		if urls != nil {
+			return urls, nil
+		}
+	}
+	return loadFolderURLs(DefaultListsFile)
+}
+
+// Lists the config file assigns to a profile by ID or name; nil when it has none
+func configListsFor(profileID string) []string {
+	if len(configProfileLists) == 0 {
+		return nil
+	}
+	if urls, ok := configProfileLists[strings.ToLower(profileID)]; ok {
+		return urls
+	}
+	if name := profileName(profileID); name != "" {
+		return configProfileLists[strings.ToLower(name)]
+	}
+	return nil
+}
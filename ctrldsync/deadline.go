@@ -0,0 +1,80 @@
+package ctrldsync
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Rough time to push one batch of rules, used to plan work against --max-duration
+const EstimatedBatchDuration = 2 * time.Second
+
+// When the run must finish; zero means no limit
+var runDeadline time.Time
+
+// Estimated work planned by the profiles still in progress. Profiles running at once share the
+// time left: together they get it once per batch slot, as their pushes share those slots.
+var (
+	plannedWork      time.Duration
+	plannedWorkMutex sync.Mutex
+)
+
+// Estimate how long recreating a folder with this many rules takes
+func estimateFolderDuration(rules int) time.Duration {
+	batches := (rules + BatchSize - 1) / BatchSize
+	return FolderCreationDelay + time.Duration(batches)*EstimatedBatchDuration
+}
+
+// Report whether the run is out of time
+func deadlinePassed() bool {
+	return !runDeadline.IsZero() && time.Now().After(runDeadline)
+}
+
+// Order folders so carried-over, high-priority, block and small folders go first, and defer those that won't
+// fit before the deadline next to the work other profiles have planned; release hands the time back once
+// the profile is done
+func planFolders(folders []FolderData) (planned, deferred []FolderData, release func()) {
+	if runDeadline.IsZero() {
+		return folders, nil, func() {}
+	}
+
+	sorted := append([]FolderData(nil), folders...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].CarriedOver != sorted[j].CarriedOver {
+			return sorted[i].CarriedOver
+		}
+		if sorted[i].Priority != sorted[j].Priority {
+			return sorted[i].Priority > sorted[j].Priority
+		}
+		bi, bj := sorted[i].Group.Action.Do == 0, sorted[j].Group.Action.Do == 0
+		if bi != bj {
+			return bi
+		}
+		return len(sorted[i].Rules) < len(sorted[j].Rules)
+	})
+
+	plannedWorkMutex.Lock()
+	defer plannedWorkMutex.Unlock()
+
+	// A profile pushes one batch at a time, so its own work must fit in the time left too
+	var budget time.Duration
+	remaining := time.Until(runDeadline)
+	shared := remaining * time.Duration(batchSlots)
+	for _, folder := range sorted {
+		estimate := estimateFolderDuration(len(folder.Rules))
+		if budget+estimate > remaining || plannedWork+budget+estimate > shared {
+			warnf("deferring folder '%s' (%d rules, ~%v) to stay within --max-duration", folder.Group.Group, len(folder.Rules), estimate.Round(time.Second))
+			deferred = append(deferred, folder)
+			continue
+		}
+		budget += estimate
+		planned = append(planned, folder)
+	}
+	plannedWork += budget
+
+	return planned, deferred, func() {
+		plannedWorkMutex.Lock()
+		plannedWork -= budget
+		plannedWorkMutex.Unlock()
+	}
+}
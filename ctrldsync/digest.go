@@ -0,0 +1,209 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Domains kept as examples per digest entry
+const DigestSampleSize = 10
+
+// Last fetched content of a source
+type SourceState struct {
+	Folder  string    `json:"folder"`
+	Version string    `json:"version"`
+	Fetched time.Time `json:"fetched"`
+	Count   int       `json:"count"`
+	Rules   []string  `json:"rules,omitempty"` // only in state files of older versions; the content is in the rules cache
+
+	// Rule counts of the last content changes, oldest first, for spotting unusual jumps
+	Sizes []int `json:"sizes,omitempty"`
+}
+
+// Upstream change of one source seen during a run
+type DigestEntry struct {
+	Time          time.Time `json:"time"`
+	Folder        string    `json:"folder"`
+	Source        string    `json:"source"`
+	Added         int       `json:"added"`
+	Removed       int       `json:"removed"`
+	AddedSample   []string  `json:"added_sample,omitempty"`
+	RemovedSample []string  `json:"removed_sample,omitempty"`
+	PreviousTotal int       `json:"previous_total"`
+	CurrentTotal  int       `json:"current_total"`
+}
+
+var (
+	sourcesSeenMutex sync.Mutex
+	sourcesSeen      = make(map[string]bool)
+)
+
+// Compare a freshly fetched source with its last fetched content, once per run
+func recordSourceChange(data FolderData) {
+	sourcesSeenMutex.Lock()
+	seen := sourcesSeen[data.Source]
+	sourcesSeen[data.Source] = true
+	sourcesSeenMutex.Unlock()
+	if seen || data.Source == "" {
+		return
+	}
+
+	rules := sortedRules(data)
+
+	stateMutex.Lock()
+	prev := state.Sources[data.Source]
+	stateMutex.Unlock()
+
+	d := diffSource(prev, data)
+	if prev == nil || prev.Version != data.Version || !isCached("sources", data.Source) {
+		if err := saveCached("sources", data.Source, rules); err != nil {
+			warnf("could not cache the content of %s: %v", listShortName(data.Source), err)
+		}
+	}
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	if state.Sources == nil {
+		state.Sources = make(map[string]*SourceState)
+	}
+	next := &SourceState{
+		Folder:  strings.TrimSpace(data.Group.Group),
+		Version: data.Version,
+		Fetched: time.Now().UTC(),
+		Count:   len(rules),
+	}
+	checkSourceSize(data.Source, prev, next)
+	state.Sources[data.Source] = next
+	if d == nil {
+		return
+	}
+	upstreamDiffsMutex.Lock()
+	upstreamDiffs = append(upstreamDiffs, *d)
+	upstreamDiffsMutex.Unlock()
+
+	state.Digest = append(state.Digest, DigestEntry{
+		Time:          time.Now().UTC(),
+		Folder:        d.Folder,
+		Source:        data.Source,
+		Added:         len(d.Added),
+		Removed:       len(d.Removed),
+		AddedSample:   sample(d.Added),
+		RemovedSample: sample(d.Removed),
+		PreviousTotal: prev.Count,
+		CurrentTotal:  len(rules),
+	})
+}
+
+// Elements only in b (added) and only in a (removed); both inputs sorted
+func diffSorted(a, b []string) (added, removed []string) {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || (i < len(a) && a[i] < b[j]):
+			removed = append(removed, a[i])
+			i++
+		case i == len(a) || b[j] < a[i]:
+			added = append(added, b[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return added, removed
+}
+
+func sample(list []string) []string {
+	if len(list) > DigestSampleSize {
+		return list[:DigestSampleSize]
+	}
+	return list
+}
+
+// Per-folder totals over a digest period
+type DigestFolder struct {
+	Folder  string `json:"folder"`
+	Changes int    `json:"changes"`
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+	Total   int    `json:"total"`
+}
+
+type Digest struct {
+	From    time.Time      `json:"from"`
+	To      time.Time      `json:"to"`
+	Folders []DigestFolder `json:"folders"`
+	Added   int            `json:"added"`
+	Removed int            `json:"removed"`
+}
+
+// Summarize accumulated changes by folder
+func buildDigest(entries []DigestEntry) Digest {
+	d := Digest{To: time.Now().UTC()}
+	byFolder := make(map[string]*DigestFolder)
+	for _, e := range entries {
+		if d.From.IsZero() || e.Time.Before(d.From) {
+			d.From = e.Time
+		}
+		f, ok := byFolder[e.Folder]
+		if !ok {
+			f = &DigestFolder{Folder: e.Folder}
+			byFolder[e.Folder] = f
+		}
+		f.Changes++
+		f.Added += e.Added
+		f.Removed += e.Removed
+		f.Total = e.CurrentTotal
+		d.Added += e.Added
+		d.Removed += e.Removed
+	}
+	for _, f := range byFolder {
+		d.Folders = append(d.Folders, *f)
+	}
+	sort.Slice(d.Folders, func(i, j int) bool { return d.Folders[i].Folder < d.Folders[j].Folder })
+	return d
+}
+
+// digest: print and send the accumulated upstream changes, then start a new period
+func runDigestCommand(args []string) int {
+	if err := loadState(stateFilePath()); err != nil {
+		logger.Printf("Failed to load state: %v", err)
+		return 1
+	}
+
+	stateMutex.Lock()
+	entries := state.Digest
+	stateMutex.Unlock()
+
+	if len(entries) == 0 {
+		fmt.Println("No upstream changes recorded since the last digest")
+		return 0
+	}
+
+	d := buildDigest(entries)
+	fmt.Printf("Upstream changes %s – %s\n\n", d.From.Format("2006-01-02"), d.To.Format("2006-01-02"))
+	for _, f := range d.Folders {
+		fmt.Printf("  %-30s +%s / -%s over %d update(s), now %s rules\n", f.Folder, formatNumber(f.Added), formatNumber(f.Removed), f.Changes, formatNumber(f.Total))
+	}
+	fmt.Printf("\n  %-30s +%s / -%s\n", "Total", formatNumber(d.Added), formatNumber(d.Removed))
+
+	if url := getenv("WEBHOOK_URL"); url != "" {
+		if err := postWebhook(url, getenv("WEBHOOK_SECRET"), "digest", d); err != nil {
+			logger.Printf("Failed to send digest: %v", err)
+			return 1
+		}
+	}
+
+	stateMutex.Lock()
+	state.Digest = nil
+	stateMutex.Unlock()
+	if err := saveState(); err != nil {
+		logger.Printf("Failed to save state: %v", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,115 @@
+package ctrldsync
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver used for allowlist checks when CHECK_RESOLVER is not set
+const DefaultCheckResolver = "1.1.1.1:53"
+
+// Sampled allowlist domains resolved per folder; 0 disables the check
+var allowlistCheckSample int
+
+var (
+	checkResolver = &net.Resolver{}
+
+	// Sources already checked this run, so a list shared by several profiles is checked once
+	checkedSources      = make(map[string]bool)
+	checkedSourcesMutex sync.Mutex
+)
+
+// Point the allowlist check at a specific DNS server instead of the system resolver
+func setCheckResolver(addr string) {
+	if !strings.Contains(addr, ":") {
+		addr += ":53"
+	}
+	checkResolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// Report whether a domain is known not to exist; errors are lookups that failed for other reasons
+func domainIsDead(host string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := checkResolver.LookupHost(ctx, host)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return true, nil
+	}
+	return false, err
+}
+
+// Resolve a sample of a bypass folder's domains and warn about the ones that no longer exist
+func checkAllowlist(folder FolderData) {
+	if allowlistCheckSample <= 0 || folder.Group.Action.Do != 1 || len(folder.Rules) == 0 {
+		return
+	}
+	checkedSourcesMutex.Lock()
+	done := checkedSources[folder.Source]
+	checkedSources[folder.Source] = true
+	checkedSourcesMutex.Unlock()
+	if done {
+		return
+	}
+
+	hosts := make([]string, 0, len(folder.Rules))
+	for _, rule := range folder.Rules {
+		// Wildcard-style entries such as *.example.com can't be looked up as written
+		if rule.PK != "" && !strings.Contains(rule.PK, "*") {
+			hosts = append(hosts, rule.PK)
+		}
+	}
+	rand.Shuffle(len(hosts), func(i, j int) { hosts[i], hosts[j] = hosts[j], hosts[i] })
+	if len(hosts) > allowlistCheckSample {
+		hosts = hosts[:allowlistCheckSample]
+	}
+
+	var (
+		dead   []string
+		failed int
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, 10)
+	)
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			isDead, err := domainIsDead(host)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+			} else if isDead {
+				dead = append(dead, host)
+			}
+		}(host)
+	}
+	wg.Wait()
+
+	name := strings.TrimSpace(folder.Group.Group)
+	if failed == len(hosts) {
+		warnf("allow folder '%s': could not check any sampled domain, is the resolver reachable?", name)
+		return
+	}
+	if len(dead) == 0 {
+		logger.Printf("Allow folder '%s': all %d checked domains resolve", name, len(hosts)-failed)
+		return
+	}
+	sort.Strings(dead)
+	warnf("allow folder '%s': %d of %d checked domains don't resolve and may be dead entries (%s)", name, len(dead), len(hosts)-failed, strings.Join(sample(dead), ", "))
+}
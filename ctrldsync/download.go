@@ -0,0 +1,304 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sources smaller than this are always fetched over a single connection
+const MinParallelDownloadSize = 4 << 20
+
+// Number of concurrent ranged connections per source download (1 disables splitting)
+const DefaultDownloadConnections = 1
+
+var downloadConnections = DefaultDownloadConnections
+
+// Fetch the body of a source, resolving git, object storage and pinned sources first, then verifying and expanding it
+func fetchSourceBody(src string) ([]byte, error) {
+	body, err := fetchSourceData(src)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySource(src, body); err != nil {
+		return nil, err
+	}
+	_, opts := splitSource(src)
+	out, kind, err := decompressSource(body, opts.Get("file"))
+	if err != nil {
+		if kind != "" {
+			return nil, fmt.Errorf("decompressing %s: %w", kind, err)
+		}
+		return nil, err
+	}
+	if kind != "" {
+		logger.Printf("Decompressed %s (%s, %d → %d bytes)", listShortName(src), kind, len(body), len(out))
+	}
+	return out, nil
+}
+
+// Fetch a source as it is stored, before decompression
+func fetchSourceData(src string) ([]byte, error) {
+	u, opts := splitSource(src)
+	ref := opts.Get("ref")
+
+	if isGitSource(u) {
+		repo := strings.TrimPrefix(u, GitSourcePrefix)
+		path := strings.Trim(opts.Get("path"), "/")
+		// GitHub serves any branch, tag or commit over plain HTTPS, so no clone is needed
+		if owner, ok := strings.CutPrefix(repo, "https://github.com/"); ok {
+			if ref == "" {
+				ref = "HEAD"
+			}
+			owner = strings.TrimSuffix(strings.TrimSuffix(owner, "/"), ".git")
+			return downloadSource(fmt.Sprintf("https://raw.githubusercontent.com/%s/%s/%s", owner, ref, path))
+		}
+		return gitShow(repo, ref, path)
+	}
+
+	if isReleaseSource(u) {
+		return fetchReleaseAsset(src, ref)
+	}
+
+	if target, ok, err := objectStoreURL(u); ok {
+		if err != nil {
+			return nil, err
+		}
+		return downloadSource(target)
+	}
+
+	if ref != "" {
+		if repo, current, ok := rawGitHubParts(u); ok {
+			u = strings.Replace(u, repo+"/"+current+"/", repo+"/"+ref+"/", 1)
+		}
+	}
+	if err := registerSourceAuth(u, opts); err != nil {
+		return nil, err
+	}
+	return downloadSource(u)
+}
+
+// Download a source, splitting large files into concurrent ranged chunks when enabled
+func downloadSource(url string) ([]byte, error) {
+	if filename, ok := localSourcePath(url); ok {
+		return os.ReadFile(filename)
+	}
+	if target, ok := viaSourceCache(url); ok {
+		body, err := downloadResumable(target)
+		if err == nil {
+			return body, nil
+		}
+		warnf("source cache failed for %s, fetching it directly: %v", url, err)
+	}
+	if downloadConnections > 1 {
+		body, err := downloadParallel(url, downloadConnections)
+		if err == nil {
+			return body, nil
+		}
+		if err != errNotSplittable {
+			logger.Printf("Parallel download of %s failed, falling back to a single connection: %v", url, err)
+		}
+	}
+	return downloadResumable(url)
+}
+
+// Path of a file:// URL or plain local path; false for network URLs
+func localSourcePath(src string) (string, bool) {
+	if strings.HasPrefix(src, "file://") {
+		u, err := url.Parse(src)
+		if err != nil {
+			return strings.TrimPrefix(src, "file://"), true
+		}
+		// file://relative/path puts the first element in the host
+		return u.Host + u.Path, true
+	}
+	return src, !strings.Contains(src, "://")
+}
+
+var errNotSplittable = fmt.Errorf("source can't be split into ranges")
+
+// Download a source in concurrent ranged chunks
+func downloadParallel(url string, connections int) ([]byte, error) {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Byte ranges refer to the identity encoding
+	req.Header.Set("Accept-Encoding", "identity")
+
+	resp, err := ghClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	size := resp.ContentLength
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" || etag == "" || size < MinParallelDownloadSize {
+		return nil, errNotSplittable
+	}
+
+	buf := make([]byte, size)
+	chunkSize := (size + int64(connections) - 1) / int64(connections)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, connections)
+	for start := int64(0); start < size; start += chunkSize {
+		end := start + chunkSize
+		if end > size {
+			end = size
+		}
+		wg.Add(1)
+		go func(start, end int64) {
+			defer wg.Done()
+			if err := downloadRange(url, etag, buf[start:end], start); err != nil {
+				errs <- err
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	logger.Printf("Downloaded %s in %d parallel chunks (%d bytes)", url, connections, size)
+	return buf, nil
+}
+
+// Fill dst with the bytes of url starting at offset, retrying on failure
+func downloadRange(url, etag string, dst []byte, offset int64) error {
+	var lastErr error
+	for attempt := 0; attempt < MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(RetryDelay * time.Duration(1<<(attempt-1)))
+		}
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(dst))-1))
+
+		resp, err := ghClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusPartialContent || rangeStart(resp) != int(offset) || resp.Header.Get("ETag") != etag {
+			resp.Body.Close()
+			return fmt.Errorf("unexpected response for range at %d: HTTP %d", offset, resp.StatusCode)
+		}
+
+		_, err = io.ReadFull(resp.Body, dst)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+// Download a source, resuming interrupted transfers with Range requests
+func downloadResumable(url string) ([]byte, error) {
+	var (
+		buf      []byte
+		etag     string
+		expected int64 = -1
+		lastErr  error
+	)
+
+	for attempt := 0; attempt < MaxRetries; attempt++ {
+		if attempt > 0 {
+			waitTime := RetryDelay * time.Duration(1<<(attempt-1))
+			logger.Printf("Download of %s failed (attempt %d/%d): %v. Retrying in %v...", url, attempt, MaxRetries, lastErr, waitTime)
+			time.Sleep(waitTime)
+		}
+
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resuming := len(buf) > 0 && etag != ""
+		if resuming {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(buf)))
+			req.Header.Set("If-Range", etag)
+		}
+
+		resp, err := ghClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusPartialContent && resuming && rangeStart(resp) == len(buf):
+			logger.Printf("Resuming download of %s at byte %d", url, len(buf))
+		case resp.StatusCode == http.StatusOK:
+			buf = buf[:0]
+			etag = ""
+			expected = -1
+			if !resp.Uncompressed {
+				expected = resp.ContentLength
+			}
+			// Offsets into a transparently decompressed body can't be resumed
+			if resp.Header.Get("Accept-Ranges") == "bytes" && !resp.Uncompressed {
+				etag = resp.Header.Get("ETag")
+			}
+		case resp.StatusCode == http.StatusPartialContent:
+			// Unexpected range; start over from zero
+			resp.Body.Close()
+			buf, etag, expected = buf[:0], "", -1
+			lastErr = fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+			continue
+		default:
+			resp.Body.Close()
+			lastErr = fmt.Errorf("HTTP %d", resp.StatusCode)
+			if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+				return nil, lastErr
+			}
+			continue
+		}
+
+		chunk, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		buf = append(buf, chunk...)
+		if err != nil {
+			lastErr = fmt.Errorf("interrupted after %d bytes: %w", len(buf), err)
+			continue
+		}
+		if expected >= 0 && int64(len(buf)) != expected {
+			lastErr = fmt.Errorf("truncated download: got %d of %d bytes", len(buf), expected)
+			if int64(len(buf)) > expected {
+				buf, etag = buf[:0], ""
+			}
+			continue
+		}
+		return buf, nil
+	}
+
+	return nil, lastErr
+}
+
+// Start offset of a 206 response, or -1 if it can't be parsed
+func rangeStart(resp *http.Response) int {
+	// Content-Range: bytes <start>-<end>/<size>
+	cr := strings.TrimPrefix(resp.Header.Get("Content-Range"), "bytes ")
+	dash := strings.IndexByte(cr, '-')
+	if dash < 0 {
+		return -1
+	}
+	start, err := strconv.Atoi(cr[:dash])
+	if err != nil {
+		return -1
+	}
+	return start
+}
@@ -0,0 +1,192 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Print what a sync would do without changing anything
+var dryRun bool
+
+// Lists a dry run is limited to (--only); the profile's own lists when empty
+var onlyLists []string
+
+// Resolve --only entries to list URLs. Entries may be URLs, preset:<name>, local files or list short names,
+// which are looked up in the configured lists and the presets and otherwise taken to be a Hagezi folder.
+func resolveOnlyLists(entries []string) ([]string, error) {
+	known := append([]string{}, FolderURLs...)
+	for _, urls := range configProfileLists {
+		known = append(known, urls...)
+	}
+	for _, p := range presets() {
+		known = append(known, p.URLs()...)
+	}
+
+	var urls []string
+	for _, entry := range entries {
+		if strings.Contains(entry, "://") || strings.HasPrefix(entry, "preset:") {
+			expanded, err := parseListLines([]string{entry})
+			if err != nil {
+				return nil, err
+			}
+			urls = append(urls, expanded...)
+			continue
+		}
+		// A local list file
+		if _, err := os.Stat(entry); err == nil {
+			urls = append(urls, entry)
+			continue
+		}
+		url := ""
+		for _, u := range known {
+			if strings.EqualFold(listShortName(u), entry) {
+				url = u
+				break
+			}
+		}
+		if url == "" {
+			url = HageziFolderBase + entry + "-folder.json"
+			logger.Printf("'%s' is not a configured list, using %s", entry, url)
+		}
+		urls = append(urls, url)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no lists given")
+	}
+	return urls, nil
+}
+
+// Lists a dry run plans for a profile
+func planLists(profileID string) []string {
+	if len(onlyLists) > 0 {
+		return onlyLists
+	}
+	return listsForProfile(profileID)
+}
+
+// Work out which folders a run would delete and recreate, and how many rules it would push, using only reads
+func planProfile(profileID string, deleteOnly bool) ProfileResult {
+	result := ProfileResult{ProfileID: profileID}
+	logger.Printf("[dry-run] Planning profile %s", maskID(profileID))
+
+	var folders []FolderData
+	unfetched := make(map[string]bool)
+	lists := planLists(profileID)
+	for _, url := range lists {
+		data, err := ghGet(url)
+		if err != nil {
+			result.fail("Failed to fetch folder data from %s: %v", url, err)
+			if name := unfetchedFolderName(profileID, url); name != "" {
+				unfetched[strings.ToLower(name)] = true
+			}
+			continue
+		}
+		if q := quarantined(url); q != nil {
+			warnQuarantined(url, q)
+			unfetched[strings.ToLower(strings.TrimSpace(data.Group.Group))] = true
+			continue
+		}
+		if !folderFilter.selects(strings.TrimSpace(data.Group.Group)) {
+			continue
+		}
+		applyOverrides(profileID, &data)
+		remapAction(&data)
+		checkAllowlist(data)
+		folders = append(folders, data)
+	}
+	folders, incomplete := dropIncomplete(mergeFolders(folders), unfetched)
+	for _, name := range incomplete {
+		result.fail("Folder '%s': would be left as it is, one of its merged sources couldn't be fetched", name)
+	}
+	sortByPriority(folders)
+	folders, deferred, releasePlan := planFolders(folders)
+	defer releasePlan()
+
+	groups, err := listFolderDetails(profileID)
+	if err != nil {
+		result.fail("Failed to list existing folders: %v", err)
+		return result
+	}
+	existing := make(map[string]APIGroup)
+	for _, g := range groups {
+		existing[strings.TrimSpace(g.Group)] = g
+	}
+	if n := plannedNewRules(folders, groups); !deleteOnly && maxNewRules > 0 && n > maxNewRules {
+		logger.Printf("[dry-run] Profile %s: would add %s rules, more than --max-new-rules %s; a real sync needs confirmation or --force", maskID(profileID), formatNumber(n), formatNumber(maxNewRules))
+	}
+
+	targets := make(map[string]bool)
+	for _, folder := range folders {
+		targets[strings.TrimSpace(folder.Group.Group)] = true
+	}
+	if deleteOnly {
+		targets[ManifestFolderName] = true
+	}
+	for i := len(folders) - 1; i >= 0; i-- {
+		name := strings.TrimSpace(folders[i].Group.Group)
+		if g, ok := existing[name]; ok {
+			logger.Printf("[dry-run] Profile %s: would delete folder '%s' (%s rules)", maskID(profileID), name, formatNumber(g.Count))
+		}
+	}
+	if deleteOnly {
+		if g, ok := existing[ManifestFolderName]; ok {
+			logger.Printf("[dry-run] Profile %s: would delete folder '%s' (%s rules)", maskID(profileID), ManifestFolderName, formatNumber(g.Count))
+		}
+		result.Success = len(result.Errors) == 0
+		return result
+	}
+
+	if deleteOrphans && !folderFilter.active() && len(onlyLists) == 0 {
+		keep := make(map[string]bool)
+		for name := range unfetched {
+			keep[name] = true
+		}
+		for _, folder := range folders {
+			keep[strings.ToLower(strings.TrimSpace(folder.Group.Group))] = true
+		}
+		for _, folder := range deferred {
+			keep[strings.ToLower(strings.TrimSpace(folder.Group.Group))] = true
+		}
+		for _, o := range profileOrphans(profileID, lists, keep) {
+			if g, ok := existing[o.Name]; ok && interfaceToString(g.PK) == o.Folder.PK {
+				logger.Printf("[dry-run] Profile %s: would delete orphaned folder '%s' (%s rules; its list %s is no longer configured)", maskID(profileID), o.Name, formatNumber(g.Count), listShortName(o.Folder.Source))
+				targets[o.Name] = true
+			}
+		}
+	}
+
+	existingRules := make(map[string]bool)
+	if !noDedup {
+		if existingRules, err = getAllExistingRules(profileID, targets); err != nil {
+			result.fail("Failed to get existing rules: %v", err)
+			return result
+		}
+	}
+
+	for _, folder := range folders {
+		name := strings.TrimSpace(folder.Group.Group)
+		fr := FolderResult{Name: name, Source: folder.Source, Version: folder.Version, Release: folder.Release, Do: folder.Group.Action.Do, Status: folder.Group.Action.Status, Success: true}
+		for _, rule := range folder.Rules {
+			if rule.PK == "" {
+				continue
+			}
+			fr.SourceRules++
+			if key := dedupKey(rule.PK); existingRules[key] {
+				fr.Duplicates++
+			} else {
+				existingRules[key] = true
+				fr.Rules++
+			}
+		}
+		logger.Printf("[dry-run] Profile %s: would create folder '%s' (%s) and push %s rules (%s duplicates skipped)",
+			maskID(profileID), name, actionStatusLabel(Action{Do: fr.Do, Status: fr.Status}), formatNumber(fr.Rules), formatNumber(fr.Duplicates))
+		result.Folders = append(result.Folders, fr)
+	}
+	for _, folder := range deferred {
+		logger.Printf("[dry-run] Profile %s: would defer folder '%s' to stay within --max-duration", maskID(profileID), strings.TrimSpace(folder.Group.Group))
+	}
+
+	result.Success = len(result.Errors) == 0
+	return result
+}
@@ -0,0 +1,110 @@
+package ctrldsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Newline-delimited JSON progress events for GUIs and wrapper scripts
+var (
+	eventsMutex  sync.Mutex
+	eventsWriter io.WriteCloser
+)
+
+// A progress event, as handed to a Syncer's observers
+type Event struct {
+	Name    string                 // run_started, folder_synced, batch_failed, profile_planned, profile_finished or run_finished
+	Time    time.Time              // when the sync emitted it
+	Profile string                 // profile the event is about, if any
+	Folder  string                 // folder the event is about, if any
+	Fields  map[string]interface{} // every field of the event, as written to the event stream
+}
+
+// Receives every event of a run started through a Syncer, one at a time
+var eventObserver func(Event)
+
+// Open the event stream on a file path or an inherited file descriptor
+func openEvents(filename string, fd int) error {
+	switch {
+	case filename != "":
+		f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		eventsWriter = f
+	case fd > 0:
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+		if f == nil {
+			return fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		eventsWriter = f
+	}
+	return nil
+}
+
+// Close the event stream
+func closeEvents() {
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+
+	if eventsWriter != nil {
+		eventsWriter.Close()
+		eventsWriter = nil
+	}
+}
+
+// Emit one event; fields are merged with the event name and timestamp
+func emitEvent(event string, fields map[string]interface{}) {
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+
+	if eventsWriter == nil && eventObserver == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	payload := map[string]interface{}{
+		"event": event,
+		"time":  now.Format(time.RFC3339Nano),
+	}
+	for k, v := range fields {
+		payload[k] = v
+	}
+
+	if eventObserver != nil {
+		e := Event{Name: event, Time: now, Fields: payload}
+		e.Profile, _ = fields["profile"].(string)
+		e.Folder, _ = fields["folder"].(string)
+		eventObserver(e)
+	}
+	if eventsWriter == nil {
+		return
+	}
+
+	line, err := json.Marshal(payload)
+	if err != nil {
+		warnf("could not encode %s event: %v", event, err)
+		return
+	}
+	if _, err := eventsWriter.Write(append(line, '\n')); err != nil {
+		warnf("could not write %s event: %v", event, err)
+	}
+}
+
+// Emit the outcome of one profile, with every folder result, for wrappers that need more than the counts
+func emitProfileResult(event string, result ProfileResult) {
+	emitEvent(event, map[string]interface{}{
+		"profile":     result.ProfileID,
+		"success":     result.Success,
+		"folders":     len(result.Folders),
+		"duration":    result.Duration.Seconds(),
+		"errors":      result.Errors,
+		"results":     result.Folders,
+		"skipped":     result.Skipped,
+		"drift_rules": result.DriftRules,
+	})
+}
@@ -0,0 +1,63 @@
+package ctrldsync
+
+import "sync"
+
+// Hands out a fixed number of slots, serving waiting profiles round-robin so one large profile can't starve the rest
+type fairScheduler struct {
+	mu     sync.Mutex
+	free   int
+	queues map[string][]chan struct{}
+	order  []string // profiles with waiters, in round-robin order
+	next   int
+}
+
+func newFairScheduler(slots int) *fairScheduler {
+	return &fairScheduler{free: slots, queues: make(map[string][]chan struct{})}
+}
+
+// Batch pushes in flight across all profiles, and how many there may be
+var (
+	batchSlots     = MaxConcurrentProfiles
+	batchScheduler = newFairScheduler(batchSlots)
+)
+
+// Wait for a slot on behalf of a profile
+func (s *fairScheduler) acquire(key string) {
+	s.mu.Lock()
+	if s.free > 0 && len(s.order) == 0 {
+		s.free--
+		s.mu.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	if len(s.queues[key]) == 0 {
+		s.order = append(s.order, key)
+	}
+	s.queues[key] = append(s.queues[key], ch)
+	s.mu.Unlock()
+	<-ch
+}
+
+// Return a slot, handing it to the next profile in turn that is waiting
+func (s *fairScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.order) == 0 {
+		s.free++
+		return
+	}
+	if s.next >= len(s.order) {
+		s.next = 0
+	}
+	key := s.order[s.next]
+	ch := s.queues[key][0]
+	s.queues[key] = s.queues[key][1:]
+	if len(s.queues[key]) == 0 {
+		delete(s.queues, key)
+		s.order = append(s.order[:s.next], s.order[s.next+1:]...)
+	} else {
+		s.next++
+	}
+	close(ch)
+}
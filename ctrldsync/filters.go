@@ -0,0 +1,95 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Folder name patterns limiting which folders a run touches
+type FolderFilter struct {
+	Include []folderPattern
+	Exclude []folderPattern
+}
+
+// A glob, or a regular expression written as /expr/
+type folderPattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+var folderFilter FolderFilter
+
+// Parse comma-separated include and exclude patterns
+func parseFolderFilter(include, exclude string) (FolderFilter, error) {
+	var f FolderFilter
+	var err error
+	if f.Include, err = parseFolderPatterns(include); err != nil {
+		return f, err
+	}
+	if f.Exclude, err = parseFolderPatterns(exclude); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+func parseFolderPatterns(list string) ([]folderPattern, error) {
+	var patterns []folderPattern
+	for _, p := range splitList(list) {
+		if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+			re, err := regexp.Compile("(?i)" + p[1:len(p)-1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression %s: %w", p, err)
+			}
+			patterns = append(patterns, folderPattern{re: re})
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+		patterns = append(patterns, folderPattern{glob: strings.ToLower(p)})
+	}
+	return patterns, nil
+}
+
+func (p folderPattern) matches(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	ok, _ := path.Match(p.glob, strings.ToLower(name))
+	return ok
+}
+
+// Report whether any of the patterns matches a name
+func matchesAny(patterns []folderPattern, name string) bool {
+	for _, p := range patterns {
+		if p.matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether a folder passes the filter
+func (f FolderFilter) selects(name string) bool {
+	for _, p := range f.Exclude {
+		if p.matches(name) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, p := range f.Include {
+		if p.matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether any folder could be filtered out
+func (f FolderFilter) active() bool {
+	return len(f.Include) > 0 || len(f.Exclude) > 0
+}
@@ -0,0 +1,637 @@
+package ctrldsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Source entries carry their options in the URL fragment, e.g.
+// https://example.com/ads.txt#action=block&name=Ads, so one string identifies a source everywhere.
+// In lists.txt they are written after the URL: https://example.com/ads.txt name=Ads action=block
+
+// Split a source entry into the URL to download and its options
+func splitSource(src string) (string, url.Values) {
+	u, fragment, ok := strings.Cut(src, "#")
+	if !ok {
+		return src, url.Values{}
+	}
+	opts, err := url.ParseQuery(fragment)
+	if err != nil {
+		return src, url.Values{}
+	}
+	return u, opts
+}
+
+// Turn a lists.txt line "<url> key=value ..." into a source entry
+func sourceEntry(line string) (string, error) {
+	fields, err := splitOptionFields(line)
+	if err != nil {
+		return "", err
+	}
+	if len(fields) == 0 {
+		return "", nil
+	}
+	src, opts := splitSource(fields[0])
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key == "" {
+			return "", fmt.Errorf("invalid option %q, expected key=value", field)
+		}
+		if key = strings.ToLower(key); key == "header" {
+			opts.Add(key, value)
+		} else {
+			opts.Set(key, value)
+		}
+	}
+	if err := checkSourceOptions(src, opts); err != nil {
+		return "", fmt.Errorf("%s: %w", src, err)
+	}
+	if len(opts) == 0 {
+		return src, nil
+	}
+	return src + "#" + opts.Encode(), nil
+}
+
+// Split on whitespace, keeping double-quoted values such as name="Ad servers" together
+func splitOptionFields(line string) ([]string, error) {
+	var fields []string
+	var current strings.Builder
+	inQuotes, started := false, false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			started = true
+		case !inQuotes && (r == ' ' || r == '\t'):
+			if started {
+				fields = append(fields, current.String())
+				current.Reset()
+				started = false
+			}
+		default:
+			current.WriteRune(r)
+			started = true
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote in %q", line)
+	}
+	if started {
+		fields = append(fields, current.String())
+	}
+	return fields, nil
+}
+
+// Reject unknown option names and values early, when the lists are loaded
+func checkSourceOptions(src string, opts url.Values) error {
+	for key := range opts {
+		switch key {
+		case "format":
+			if f := opts.Get(key); f != "json" && listFormats[f] == nil {
+				return fmt.Errorf("unknown format %q", f)
+			}
+		case "action", "do":
+			if _, err := parseAction(opts.Get(key)); err != nil {
+				return err
+			}
+		case "status":
+			if _, err := parseStatus(opts.Get(key)); err != nil {
+				return err
+			}
+		case "name", "path", "ref", "basic", "bearer", "header", "file", "sha256", "minisign", "gpg", "sig":
+		default:
+			return fmt.Errorf("unknown option %q", key)
+		}
+	}
+	if _, ok, err := objectStoreURL(src); ok && err != nil {
+		return err
+	}
+	if err := checkAuthOptions(src, opts); err != nil {
+		return err
+	}
+	if err := checkVerifyOptions(opts); err != nil {
+		return err
+	}
+	return checkGitOptions(src, opts)
+}
+
+// Short name of a list: its file name without extension or "-folder", e.g. spam-tlds
+func listShortName(src string) string {
+	u, opts := splitSource(src)
+	if p := opts.Get("path"); p != "" {
+		u = p
+	}
+	name := trimCompressedExt(path.Base(u))
+	name = strings.TrimSuffix(name, path.Ext(name))
+	return strings.TrimSuffix(name, "-folder")
+}
+
+// Turns a list body into rules tagged with their line, counting lines that hold no usable hostname
+type listParser func(body []byte) (rules []Rule, skipped int)
+
+// Line-based list formats by name; Control D folder JSON is handled separately as "json"
+var listFormats = map[string]listParser{
+	"domains": parseDomainList,
+	"hosts":   parseHostsList,
+	"adblock": parseAdblockList,
+	"dnsmasq": parseDnsmasqList,
+	"unbound": parseUnboundList,
+	"rpz":     parseRPZList,
+}
+
+// Lines looked at when guessing a format
+const formatSniffLines = 50
+
+// Guess the format of a body that isn't folder JSON from its first entries
+func detectFormat(body []byte) string {
+	votes := make(map[string]int)
+	lines := 0
+	eachLine(body, func(_ int, line string) {
+		if lines >= formatSniffLines {
+			return
+		}
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "[Adblock"), strings.HasPrefix(line, "||"), strings.HasPrefix(line, "@@"), strings.Contains(line, "##"):
+			votes["adblock"]++
+		case strings.HasPrefix(line, "address=/"), strings.HasPrefix(line, "local=/"), strings.HasPrefix(line, "server=/"):
+			votes["dnsmasq"]++
+		case strings.HasPrefix(line, "local-zone:"), strings.HasPrefix(line, "local-data:"), line == "server:":
+			votes["unbound"]++
+		case strings.HasPrefix(line, "$ORIGIN"), strings.HasPrefix(line, "$TTL"), strings.Contains(strings.ToUpper(line), " CNAME "):
+			votes["rpz"]++
+		case strings.HasPrefix(line, "#"), strings.HasPrefix(line, "!"), strings.HasPrefix(line, ";"):
+			return
+		case len(fields) >= 2 && net.ParseIP(fields[0]) != nil:
+			votes["hosts"]++
+		default:
+			votes["domains"]++
+		}
+		lines++
+	})
+	best := "domains"
+	for _, format := range []string{"hosts", "adblock", "dnsmasq", "unbound", "rpz"} {
+		if votes[format] > votes[best] {
+			best = format
+		}
+	}
+	return best
+}
+
+// Build folder data from a downloaded source in any supported format
+func parseSource(src string, body []byte) (FolderData, error) {
+	_, opts := splitSource(src)
+	format := opts.Get("format")
+	if format == "" {
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+			format = "json"
+		} else {
+			format = detectFormat(body)
+		}
+	}
+
+	var data FolderData
+	if format == "json" {
+		// Unmarshal rejects documents that end early, unlike a streaming decoder
+		if err := json.Unmarshal(body, &data); err != nil {
+			return FolderData{}, fmt.Errorf("invalid folder JSON (%d bytes, possibly truncated): %w", len(body), err)
+		}
+		if strings.TrimSpace(data.Group.Group) == "" {
+			return FolderData{}, fmt.Errorf("folder JSON has no group name")
+		}
+		for i := range data.Rules {
+			data.Rules[i].Line = i + 1
+		}
+		// An action or status set on the source wins over the one in the file
+		sourceAction(opts, &data.Group.Action)
+		forceAllow(src, &data)
+		checkWildcards(&data)
+		return data, nil
+	}
+
+	rules, skipped := listFormats[format](body)
+	if len(rules) == 0 {
+		return FolderData{}, fmt.Errorf("no hostnames found in %s list (%d lines skipped)", format, skipped)
+	}
+	name := opts.Get("name")
+	if name == "" {
+		name = listShortName(src)
+	}
+	if skipped > 0 {
+		warnf("source %s (%s format): skipped %d lines that don't block a whole hostname", listShortName(src), format, skipped)
+	}
+
+	// Plain lists carry no action of their own; they make an enabled block folder unless the source says otherwise
+	data.Group = Group{Group: name, Action: Action{Do: 0, Status: 1}}
+	sourceAction(opts, &data.Group.Action)
+	data.Rules = rules
+	forceAllow(src, &data)
+	checkWildcards(&data)
+	return data, nil
+}
+
+// Apply the action (action= or do=) and status= options of a source; checked when the lists were loaded
+func sourceAction(opts url.Values, action *Action) {
+	if a := opts.Get("action"); a != "" {
+		action.Do, _ = parseAction(a)
+	} else if a := opts.Get("do"); a != "" {
+		action.Do, _ = parseAction(a)
+	}
+	if s := opts.Get("status"); s != "" {
+		action.Status, _ = parseStatus(s)
+	}
+}
+
+// Turn the folder of an ALLOW_LISTS source into an allow folder, whatever action it came with
+func forceAllow(src string, data *FolderData) {
+	if !allowListed(src) || data.Group.Action.Do == 1 {
+		return
+	}
+	logger.Printf("Folder '%s': treated as an allow folder (ALLOW_LISTS), source action was %s", strings.TrimSpace(data.Group.Group), actionLabel(data.Group.Action.Do))
+	data.Group.Action.Do = 1
+}
+
+// Normalize a rule that may be a wildcard like *.example.com; empty when it can't be pushed
+func cleanRule(s string) string {
+	s = strings.TrimSpace(s)
+	if rest, ok := strings.CutPrefix(s, "*."); ok {
+		if h := cleanHostname(rest); h != "" {
+			return "*." + h
+		}
+		return ""
+	}
+	return cleanHostname(s)
+}
+
+// Report whether a rule matches subdomains rather than one name
+func isWildcard(rule string) bool {
+	return strings.HasPrefix(rule, "*.")
+}
+
+// Drop rules Control D can't take (a "*" anywhere but a leading "*.") and exact entries
+// that a wildcard in the same folder already covers, e.g. ads.example.com next to *.example.com
+func checkWildcards(data *FolderData) {
+	wildcards := make(map[string]bool)
+	for _, r := range data.Rules {
+		if isWildcard(r.PK) {
+			wildcards[strings.ToLower(strings.TrimPrefix(r.PK, "*."))] = true
+		}
+	}
+
+	name := strings.TrimSpace(data.Group.Group)
+	var invalid []string
+	covered := 0
+	kept := data.Rules[:0]
+	for _, r := range data.Rules {
+		switch {
+		case strings.Contains(r.PK, "*") && cleanRule(r.PK) == "":
+			invalid = append(invalid, r.PK)
+			continue
+		case len(wildcards) > 0 && !isWildcard(r.PK) && coveredByWildcard(strings.ToLower(r.PK), wildcards):
+			covered++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	data.Rules = kept
+
+	if len(invalid) > 0 {
+		warnf("folder '%s': left out %d wildcard rules in a form Control D doesn't accept, only a leading *. is supported (%s)", name, len(invalid), strings.Join(sample(invalid), ", "))
+	}
+	if covered > 0 {
+		logger.Printf("Folder '%s': dropped %d entries already covered by its wildcard rules", name, covered)
+	}
+}
+
+// Report whether a parent domain of host has a wildcard rule
+func coveredByWildcard(host string, wildcards map[string]bool) bool {
+	for i := strings.IndexByte(host, '.'); i >= 0; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		if wildcards[host] {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalize a candidate hostname; empty when it can't be one
+func cleanHostname(s string) string {
+	s = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(s), "."))
+	if s == "" || len(s) > 253 || !strings.Contains(s, ".") || strings.HasPrefix(s, ".") {
+		return ""
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' || r > 127) {
+			return ""
+		}
+	}
+	return s
+}
+
+// Call fn with each trimmed line that isn't blank and its 1-based line number
+func eachLine(body []byte, fn func(n int, line string)) {
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			fn(n, line)
+		}
+	}
+}
+
+// Call fn with each line that isn't blank or a #/! comment, trailing comments removed
+func eachListLine(body []byte, fn func(n int, line string)) {
+	eachLine(body, func(n int, line string) {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" || strings.HasPrefix(line, "!") {
+			return
+		}
+		fn(n, line)
+	})
+}
+
+// One hostname per line
+func parseDomainList(body []byte) ([]Rule, int) {
+	var rules []Rule
+	skipped := 0
+	eachListLine(body, func(n int, line string) {
+		if h := cleanRule(line); h != "" {
+			rules = append(rules, Rule{PK: h, Line: n})
+		} else {
+			skipped++
+		}
+	})
+	return rules, skipped
+}
+
+// Names every hosts file maps to loopback; never rules
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// /etc/hosts style: an address followed by one or more hostnames, e.g. 0.0.0.0 ads.example.com
+func parseHostsList(body []byte) ([]Rule, int) {
+	var rules []Rule
+	skipped := 0
+	eachListLine(body, func(n int, line string) {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			skipped++
+			return
+		}
+		for _, field := range fields[1:] {
+			if hostsLocalNames[strings.ToLower(field)] {
+				continue
+			}
+			if h := cleanHostname(field); h != "" {
+				rules = append(rules, Rule{PK: h, Line: n})
+			} else {
+				skipped++
+			}
+		}
+	})
+	return rules, skipped
+}
+
+// Filter options that still apply to a whole domain at the DNS level
+var adblockDomainOptions = map[string]bool{
+	"important":   true,
+	"third-party": true,
+	"3p":          true,
+	"all":         true,
+	"document":    true,
+	"doc":         true,
+	"popup":       true,
+}
+
+// Adblock Plus / uBlock Origin / AdGuard filters: keeps ||domain^ blocking rules and skips
+// exceptions, cosmetic filters, regular expressions, paths and anything with page-level options
+func parseAdblockList(body []byte) ([]Rule, int) {
+	var rules []Rule
+	skipped := 0
+	eachLine(body, func(n int, line string) {
+		if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+			return
+		}
+		if h := adblockHostname(line); h != "" {
+			rules = append(rules, Rule{PK: h, Line: n})
+		} else {
+			skipped++
+		}
+	})
+	return rules, skipped
+}
+
+// Hostname blocked by a ||domain^ filter; empty for any other kind of filter
+func adblockHostname(filter string) string {
+	rest, ok := strings.CutPrefix(filter, "||")
+	if !ok {
+		return ""
+	}
+	rest, options, _ := strings.Cut(rest, "$")
+	if options != "" {
+		for _, opt := range strings.Split(options, ",") {
+			if !adblockDomainOptions[strings.ToLower(strings.TrimSpace(opt))] {
+				return ""
+			}
+		}
+	}
+	// Without the trailing separator ||example.com also matches example.community, which no DNS rule can express
+	rest, ok = strings.CutSuffix(rest, "^")
+	if !ok || strings.ContainsAny(rest, "/^*|") {
+		return ""
+	}
+	return cleanHostname(rest)
+}
+
+// dnsmasq: address=/domain/# (or any sink address), local=/domain/ and server=/domain/ with no upstream;
+// several domains may share one line as in address=/a.com/b.com/#
+func parseDnsmasqList(body []byte) ([]Rule, int) {
+	var rules []Rule
+	skipped := 0
+	eachLine(body, func(n int, line string) {
+		// "#" is also dnsmasq's null address, so only whole-line comments are comments here
+		if strings.HasPrefix(line, "#") {
+			return
+		}
+		key, value, ok := strings.Cut(line, "=")
+		parts := strings.Split(value, "/")
+		if !ok || len(parts) < 3 || parts[0] != "" {
+			skipped++
+			return
+		}
+		domains, target := parts[1:len(parts)-1], parts[len(parts)-1]
+		switch key {
+		case "address":
+			// Any target is a block or a spoof to a sink; both keep the name from resolving normally
+		case "local", "server":
+			if target != "" {
+				// server=/domain/1.2.3.4 forwards rather than blocks
+				skipped++
+				return
+			}
+		default:
+			skipped++
+			return
+		}
+		for _, d := range domains {
+			if h := cleanHostname(d); h != "" {
+				rules = append(rules, Rule{PK: h, Line: n})
+			} else {
+				skipped++
+			}
+		}
+	})
+	return rules, skipped
+}
+
+// unbound local-zone types that stop a name from resolving
+var unboundBlockingZones = map[string]bool{
+	"always_nxdomain": true,
+	"always_refuse":   true,
+	"always_null":     true,
+	"refuse":          true,
+	"static":          true,
+	"deny":            true,
+	"inform_deny":     true,
+	"redirect":        true,
+}
+
+// unbound: local-zone: "domain" always_nxdomain (or another blocking type) and local-data: "domain A 0.0.0.0"
+func parseUnboundList(body []byte) ([]Rule, int) {
+	var rules []Rule
+	skipped := 0
+	eachListLine(body, func(n int, line string) {
+		if line == "server:" {
+			return
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			skipped++
+			return
+		}
+		fields := strings.Fields(strings.ReplaceAll(strings.TrimSpace(value), `"`, " "))
+		var candidate string
+		switch strings.TrimSpace(key) {
+		case "local-zone":
+			if len(fields) == 2 && unboundBlockingZones[strings.ToLower(fields[1])] {
+				candidate = fields[0]
+			}
+		case "local-data":
+			if len(fields) >= 1 {
+				candidate = fields[0]
+			}
+		}
+		if h := cleanHostname(candidate); h != "" {
+			rules = append(rules, Rule{PK: h, Line: n})
+		} else {
+			skipped++
+		}
+	})
+	return rules, skipped
+}
+
+// RPZ targets that block: NXDOMAIN (CNAME .), NODATA (CNAME *.) and silently dropping the query
+var rpzBlockingTargets = map[string]bool{
+	".":         true,
+	"*.":        true,
+	"rpz-drop.": true,
+}
+
+// Response Policy Zone files: "name CNAME ." records, with optional TTL and class, relative to $ORIGIN.
+// Passthru and other policies are skipped; *.name records become wildcard rules.
+func parseRPZList(body []byte) ([]Rule, int) {
+	var rules []Rule
+	seen := make(map[string]bool)
+	skipped := 0
+	origin := ""
+	eachLine(body, func(n int, line string) {
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) > 1 {
+				origin = strings.ToLower(strings.TrimSuffix(fields[1], "."))
+			}
+			return
+		case "$TTL", "@", "$INCLUDE":
+			return
+		}
+
+		// name [ttl] [class] type target
+		var rtype, target string
+		for i := 1; i+1 < len(fields); i++ {
+			if t := strings.ToUpper(fields[i]); t != "IN" && !isNumber(t) {
+				rtype, target = t, strings.ToLower(fields[i+1])
+				break
+			}
+		}
+		if rtype == "SOA" || rtype == "NS" {
+			return
+		}
+		if rtype != "CNAME" || !rpzBlockingTargets[target] {
+			skipped++
+			return
+		}
+
+		name := strings.ToLower(fields[0])
+		if strings.HasSuffix(name, ".") {
+			// Absolute names carry the zone origin, which isn't part of the domain
+			name = strings.TrimSuffix(name, ".")
+			switch {
+			case origin == "":
+			case name == origin:
+				// The zone apex itself, not a policy for a domain
+				name = ""
+			case strings.HasSuffix(name, "."+origin):
+				name = strings.TrimSuffix(name, "."+origin)
+			}
+		}
+		h := cleanRule(name)
+		if h == "" {
+			skipped++
+			return
+		}
+		if !seen[h] {
+			seen[h] = true
+			rules = append(rules, Rule{PK: h, Line: n})
+		}
+	})
+	return rules, skipped
+}
+
+func isNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,29 @@
+package ctrldsync
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRPZListOrigin(t *testing.T) {
+	body := []byte(`$ORIGIN rpz.
+ads.example.com.rpz. CNAME .
+ads.evilrpz. CNAME .
+rpz. CNAME .
+tracker.example.net CNAME .
+`)
+	rules, skipped := parseRPZList(body)
+
+	var got []string
+	for _, r := range rules {
+		got = append(got, r.PK)
+	}
+	// Only whole labels are the origin: ads.evilrpz stays as it is and the apex itself is no rule
+	want := []string{"ads.example.com", "ads.evilrpz", "tracker.example.net"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rules = %v, want %v", got, want)
+	}
+	if skipped != 1 {
+		t.Errorf("skipped = %d, want 1", skipped)
+	}
+}
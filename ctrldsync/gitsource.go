@@ -0,0 +1,113 @@
+package ctrldsync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Scheme prefix of git repository sources, e.g. git+https://github.com/hagezi/dns-blocklists path=controld/spam-tlds-folder.json ref=2024.1201
+const GitSourcePrefix = "git+"
+
+// Report whether a source is a git repository
+func isGitSource(src string) bool {
+	return strings.HasPrefix(src, GitSourcePrefix)
+}
+
+// Check the path and ref options against the kind of source they're given on
+func checkGitOptions(src string, opts url.Values) error {
+	if isGitSource(src) {
+		if strings.Trim(opts.Get("path"), "/") == "" {
+			return fmt.Errorf("git sources need path=<file in the repository>")
+		}
+		return nil
+	}
+	if opts.Has("path") {
+		return fmt.Errorf("path is only for git+ sources")
+	}
+	if isReleaseSource(src) {
+		_, _, err := releaseParts(src)
+		return err
+	}
+	if opts.Has("ref") {
+		if _, _, ok := rawGitHubParts(src); !ok {
+			return fmt.Errorf("ref is only for git+, github-release:// and raw.githubusercontent.com sources")
+		}
+	}
+	return nil
+}
+
+// Split a raw.githubusercontent.com URL into its repository ("owner/repo"), ref and path
+func rawGitHubParts(src string) (repo string, ref string, ok bool) {
+	rest, found := strings.CutPrefix(src, "https://raw.githubusercontent.com/")
+	if !found {
+		return "", "", false
+	}
+	parts := strings.SplitN(rest, "/", 4)
+	if len(parts) < 4 {
+		return "", "", false
+	}
+	return parts[0] + "/" + parts[1], parts[2], true
+}
+
+// Serializes git commands on the shared checkout cache
+var gitMutex sync.Mutex
+
+// Read one file of a repository at a ref by fetching just that commit into a cached bare repository
+func gitShow(repo, ref, path string) ([]byte, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("git sources outside GitHub need git installed: %w", err)
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	sum := sha256.Sum256([]byte(repo))
+	dir := filepath.Join(cacheDir, "ctrld-hagezi-sync", "git", hex.EncodeToString(sum[:])[:16])
+
+	gitMutex.Lock()
+	defer gitMutex.Unlock()
+
+	if _, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		if _, err := runGit(dir, "init", "--bare", "-q"); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := runGit(dir, "fetch", "-q", "--depth", "1", repo, ref); err != nil {
+		return nil, fmt.Errorf("fetching %s from %s: %w", ref, repo, err)
+	}
+	body, err := runGit(dir, "show", "FETCH_HEAD:"+path)
+	if err != nil {
+		return nil, fmt.Errorf("%s at %s: %w", path, ref, err)
+	}
+	return body, nil
+}
+
+func runGit(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(environ(), "GIT_TERMINAL_PROMPT=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return nil, fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return out, nil
+}
@@ -0,0 +1,58 @@
+package ctrldsync
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Most rules one sync may add to a profile before asking for confirmation; 0 disables the check
+var maxNewRules int
+
+// Skip the --max-new-rules confirmation
+var forceNewRules bool
+
+// Only one confirmation prompt at a time while profiles sync concurrently
+var confirmMutex sync.Mutex
+
+// Net rules a sync would add: planned rules minus what the folders it replaces hold now
+func plannedNewRules(folders []FolderData, groups []APIGroup) int {
+	current := make(map[string]int)
+	for _, g := range groups {
+		current[strings.TrimSpace(g.Group)] = g.Count
+	}
+	added := 0
+	for _, folder := range folders {
+		added += len(folder.Rules) - current[strings.TrimSpace(folder.Group.Group)]
+	}
+	return added
+}
+
+// Report whether a profile may grow by n rules, asking on the terminal when it is over the limit
+func newRulesAllowed(profileID string, n int) bool {
+	if maxNewRules <= 0 || n <= maxNewRules || forceNewRules {
+		return true
+	}
+	warnf("profile %s: sync would add %s rules, more than --max-new-rules %s", maskID(profileID), formatNumber(n), formatNumber(maxNewRules))
+	return confirm(fmt.Sprintf("Add %s rules to profile %s anyway? [y/N] ", formatNumber(n), maskID(profileID)))
+}
+
+// Ask a yes/no question; always no when stdin isn't a terminal
+func confirm(prompt string) bool {
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	confirmMutex.Lock()
+	defer confirmMutex.Unlock()
+	fmt.Fprint(os.Stderr, prompt)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		logger.Printf("No answer, not continuing")
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,85 @@
+package ctrldsync
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default interval of the keep-alive log line on non-interactive runs
+const DefaultHeartbeat = 60 * time.Second
+
+// What each profile in progress is doing, for the heartbeat line
+var (
+	activityMutex sync.Mutex
+	activity      = make(map[string]string)
+)
+
+// Record what a profile is working on
+func setActivity(profileID, what string) {
+	activityMutex.Lock()
+	defer activityMutex.Unlock()
+	activity[profileID] = what
+}
+
+// Forget a profile once it's done
+func clearActivity(profileID string) {
+	activityMutex.Lock()
+	defer activityMutex.Unlock()
+	delete(activity, profileID)
+}
+
+// One line describing every profile in progress
+func activitySummary() string {
+	activityMutex.Lock()
+	defer activityMutex.Unlock()
+
+	if len(activity) == 0 {
+		return "waiting"
+	}
+	ids := make([]string, 0, len(activity))
+	for id := range activity {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = "profile " + maskID(id) + ": " + activity[id]
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Log a still-running line every interval so CI jobs with inactivity timeouts aren't killed
+// during long pushes; only when stderr isn't a terminal. The returned func stops it.
+func startHeartbeat(interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	if info, err := os.Stderr.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return func() {}
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				logger.Printf("Still running after %v: %s", time.Since(start).Round(time.Second), activitySummary())
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package ctrldsync
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Number of runs kept in the state file, and of the most recent ones that keep per-folder metrics
+const (
+	HistoryLimit       = 500
+	HistoryFolderLimit = 50
+)
+
+// Metrics of one folder in one run
+type FolderMetrics struct {
+	Profile    string `json:"profile"`
+	Folder     string `json:"folder"`
+	Rules      int    `json:"rules"`
+	Duplicates int    `json:"duplicates"`
+	Success    bool   `json:"success"`
+}
+
+// Metrics of one run
+type RunRecord struct {
+	Time      time.Time       `json:"time"`
+	Duration  time.Duration   `json:"duration_ns"`
+	Profiles  int             `json:"profiles"`
+	Succeeded int             `json:"succeeded"`
+	Failed    int             `json:"failed"`
+	Rules     int             `json:"rules"`
+	Folders   []FolderMetrics `json:"folders,omitempty"`
+}
+
+// Append a run to the history, dropping the oldest runs past HistoryLimit and the
+// per-folder metrics of runs past HistoryFolderLimit
+func recordHistory(report RunReport) {
+	rec := RunRecord{
+		Time:      report.Started.UTC(),
+		Duration:  report.Duration,
+		Profiles:  len(report.Profiles),
+		Succeeded: report.Succeeded,
+		Failed:    report.Failed,
+	}
+	for _, p := range report.Profiles {
+		for _, f := range p.Folders {
+			rec.Rules += f.Rules
+			rec.Folders = append(rec.Folders, FolderMetrics{
+				Profile:    p.ProfileID,
+				Folder:     f.Name,
+				Rules:      f.Rules,
+				Duplicates: f.Duplicates,
+				Success:    f.Success,
+			})
+		}
+	}
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	state.History = append(state.History, rec)
+	if len(state.History) > HistoryLimit {
+		state.History = state.History[len(state.History)-HistoryLimit:]
+	}
+	if n := len(state.History) - HistoryFolderLimit; n > 0 {
+		state.History[n-1].Folders = nil
+	}
+}
+
+// history [--csv] [--limit N]
+func runHistoryCommand(args []string) int {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	asCSV := fs.Bool("csv", false, "print one row per folder per run as CSV")
+	limit := fs.Int("limit", 20, "number of most recent runs to show (0 for all)")
+	fs.Parse(args)
+
+	if err := loadState(stateFilePath()); err != nil {
+		logger.Printf("Failed to load state: %v", err)
+		return 1
+	}
+
+	runs := state.History
+	if *limit > 0 && len(runs) > *limit {
+		runs = runs[len(runs)-*limit:]
+	}
+
+	if *asCSV {
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"time", "duration_seconds", "profile", "folder", "rules", "duplicates", "success"})
+		for _, run := range runs {
+			for _, f := range run.Folders {
+				w.Write([]string{
+					run.Time.Format(time.RFC3339),
+					strconv.FormatFloat(run.Duration.Seconds(), 'f', 0, 64),
+					f.Profile,
+					f.Folder,
+					strconv.Itoa(f.Rules),
+					strconv.Itoa(f.Duplicates),
+					strconv.FormatBool(f.Success),
+				})
+			}
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			logger.Printf("Failed to write CSV: %v", err)
+			return 1
+		}
+		return 0
+	}
+
+	if len(runs) == 0 {
+		fmt.Println("No runs recorded yet")
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tDURATION\tPROFILES\tFAILED\tRULES PUSHED")
+	for _, run := range runs {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n", run.Time.Local().Format("2006-01-02 15:04"), run.Duration, run.Profiles, run.Failed, formatNumber(run.Rules))
+	}
+	w.Flush()
+	return 0
+}
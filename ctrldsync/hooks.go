@@ -0,0 +1,53 @@
+package ctrldsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Shell commands run around each run and each profile
+type Hooks struct {
+	PreSync     string
+	PostSync    string
+	PreProfile  string
+	PostProfile string
+}
+
+var hooks Hooks
+
+// Read hook commands from the environment
+func loadHooks() Hooks {
+	return Hooks{
+		PreSync:     getenv("PRE_SYNC_HOOK"),
+		PostSync:    getenv("POST_SYNC_HOOK"),
+		PreProfile:  getenv("PRE_PROFILE_HOOK"),
+		PostProfile: getenv("POST_PROFILE_HOOK"),
+	}
+}
+
+// Run a hook with a JSON payload on stdin; an empty command is a no-op
+func runHook(name, command string, payload interface{}, env ...string) error {
+	if command == "" {
+		return nil
+	}
+
+	input, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("%s hook: failed to encode payload: %w", name, err)
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = append(environ(), append([]string{"CTRLD_SYNC_HOOK=" + name}, env...)...)
+	output, err := cmd.CombinedOutput()
+	if out := strings.TrimSpace(string(output)); out != "" {
+		logger.Printf("%s hook: %s", name, out)
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook failed: %w", name, err)
+	}
+	return nil
+}
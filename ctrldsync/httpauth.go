@@ -0,0 +1,124 @@
+package ctrldsync
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Source options that add credentials to the request
+var sourceAuthOptions = []string{"basic", "bearer", "header"}
+
+// Credential headers of authenticated sources by URL, added by sourceAuthTransport
+var sourceAuth sync.Map
+
+// Key of a request URL in sourceAuth: the URL without fragment
+func sourceAuthKey(u *url.URL) string {
+	k := *u
+	k.Fragment = ""
+	return k.String()
+}
+
+// Check the basic, bearer and header options of a source
+func checkAuthOptions(src string, opts url.Values) error {
+	if !hasAuthOptions(opts) {
+		return nil
+	}
+	if !strings.HasPrefix(src, "https://") && !strings.HasPrefix(src, "http://") {
+		return fmt.Errorf("basic, bearer and header are only for http(s) sources")
+	}
+	if opts.Has("basic") && opts.Has("bearer") {
+		return fmt.Errorf("basic and bearer can't be used together")
+	}
+	if b := opts.Get("basic"); opts.Has("basic") && !strings.Contains(b, ":") && !strings.HasPrefix(b, "$") {
+		return fmt.Errorf("basic expects user:password, e.g. basic=$LISTS_USER:$LISTS_PASSWORD")
+	}
+	for _, h := range opts["header"] {
+		name, _, ok := strings.Cut(h, ":")
+		if !ok || strings.TrimSpace(name) == "" || strings.ContainsAny(strings.TrimSpace(name), " \t") {
+			return fmt.Errorf("invalid header %q, expected \"Name: value\"", h)
+		}
+	}
+	return nil
+}
+
+func hasAuthOptions(opts url.Values) bool {
+	for _, key := range sourceAuthOptions {
+		if opts.Has(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Build the credential headers of a source, expanding $VAR references from the environment
+func sourceAuthHeaders(opts url.Values) (http.Header, error) {
+	h := make(http.Header)
+	var missing []string
+	expand := func(s string) string {
+		return os.Expand(s, func(name string) string {
+			v, ok := lookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return v
+		})
+	}
+
+	if opts.Has("basic") {
+		user, pass, _ := strings.Cut(expand(opts.Get("basic")), ":")
+		h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+	}
+	if opts.Has("bearer") {
+		h.Set("Authorization", "Bearer "+expand(opts.Get("bearer")))
+	}
+	for _, header := range opts["header"] {
+		name, value, _ := strings.Cut(header, ":")
+		h.Add(textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)), strings.TrimSpace(expand(value)))
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("credentials need %s set in the environment", strings.Join(missing, ", "))
+	}
+	return h, nil
+}
+
+// Register the credentials of a source for requests to target
+func registerSourceAuth(target string, opts url.Values) error {
+	if !hasAuthOptions(opts) {
+		return nil
+	}
+	h, err := sourceAuthHeaders(opts)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	sourceAuth.Store(sourceAuthKey(u), h)
+	return nil
+}
+
+// Adds the registered credentials to requests for authenticated sources. Redirects to
+// other URLs go out without them, so a list moved to a CDN doesn't get the secrets.
+type sourceAuthTransport struct {
+	next http.RoundTripper
+}
+
+func (t *sourceAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h, ok := sourceAuth.Load(sourceAuthKey(req.URL))
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	for name, values := range h.(http.Header) {
+		req.Header[name] = values
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,231 @@
+package ctrldsync
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Columns of an exported query log that hold the queried name, in order of preference
+var queryLogDomainColumns = []string{"domain", "question", "qname", "query", "hostname", "name"}
+
+// Queries of a log a candidate folder would have matched
+type FolderImpact struct {
+	Folder  string        `json:"folder"`
+	Source  string        `json:"source"`
+	Action  string        `json:"action"`
+	Queries int           `json:"queries"`
+	Domains int           `json:"domains"` // distinct names among them
+	Top     []DomainCount `json:"top,omitempty"`
+}
+
+type DomainCount struct {
+	Domain  string `json:"domain"`
+	Queries int    `json:"queries"`
+}
+
+// Count the queries of a log by name; the log is a CSV export with a domain column, or one query per line
+func readQueryLog(r io.Reader) (map[string]int, int, error) {
+	counts := make(map[string]int)
+	total := 0
+	add := func(name string) {
+		if h := cleanHostname(name); h != "" {
+			counts[h]++
+			total++
+		}
+	}
+
+	br := bufio.NewReader(r)
+	first, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+
+	column := -1
+	if header, herr := csv.NewReader(strings.NewReader(first)).Read(); herr == nil && len(header) > 1 {
+		for _, want := range queryLogDomainColumns {
+			for i, h := range header {
+				if strings.EqualFold(strings.TrimSpace(h), want) {
+					column = i
+					break
+				}
+			}
+			if column >= 0 {
+				break
+			}
+		}
+	}
+
+	if column >= 0 {
+		cr := csv.NewReader(br)
+		cr.FieldsPerRecord = -1
+		for {
+			record, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			if column < len(record) {
+				add(record[column])
+			}
+		}
+		return counts, total, nil
+	}
+
+	// One query per line: the first field is the name
+	for line := first; ; {
+		if fields := strings.Fields(line); len(fields) > 0 && !strings.HasPrefix(fields[0], "#") {
+			add(fields[0])
+		}
+		if err == io.EOF {
+			break
+		}
+		line, err = br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+	}
+	return counts, total, nil
+}
+
+// Match a folder's rules against the logged names, exact names and *. wildcards alike
+func folderImpact(data FolderData, counts map[string]int, top int) FolderImpact {
+	exact := make(map[string]bool, len(data.Rules))
+	wildcards := make(map[string]bool)
+	for _, r := range data.Rules {
+		rule := strings.ToLower(r.PK)
+		if isWildcard(rule) {
+			wildcards[strings.TrimPrefix(rule, "*.")] = true
+		} else if rule != "" {
+			exact[rule] = true
+		}
+	}
+
+	impact := FolderImpact{
+		Folder: strings.TrimSpace(data.Group.Group),
+		Source: data.Source,
+		Action: actionLabel(data.Group.Action.Do),
+	}
+	var matched []DomainCount
+	for name, n := range counts {
+		if exact[name] || (len(wildcards) > 0 && coveredByWildcard(name, wildcards)) {
+			matched = append(matched, DomainCount{Domain: name, Queries: n})
+			impact.Queries += n
+		}
+	}
+	impact.Domains = len(matched)
+
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].Queries != matched[j].Queries {
+			return matched[i].Queries > matched[j].Queries
+		}
+		return matched[i].Domain < matched[j].Domain
+	})
+	if len(matched) > top {
+		matched = matched[:top]
+	}
+	impact.Top = matched
+	return impact
+}
+
+// Report how many logged queries candidate lists would have matched
+func runImpactCommand(args []string) int {
+	fs := flag.NewFlagSet("impact", flag.ExitOnError)
+	logFile := fs.String("log", "", "query log to replay: a CSV export with a domain column, or one name per line (- for stdin)")
+	top := fs.Int("top", 10, "show this many of the most queried matching names per folder")
+	asJSON := fs.Bool("json", false, "print the impact as JSON")
+	fs.Parse(args)
+
+	if *logFile == "" || fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: ctrld-hagezi-sync impact --log queries.csv [--top n] [--json] <list...> (short names like gambling, URLs, local files or preset:<name>)")
+		return 2
+	}
+	if err := initClients(); err != nil {
+		logger.Printf("Failed to set up HTTP clients: %v", err)
+		return 1
+	}
+
+	// Configured lists help resolve short names; candidates don't have to be among them
+	if urls, err := loadLists(); err == nil {
+		FolderURLs = urls
+	}
+	candidates, err := resolveOnlyLists(fs.Args())
+	if err != nil {
+		logger.Printf("Invalid list: %v", err)
+		return 1
+	}
+
+	in := os.Stdin
+	if *logFile != "-" {
+		f, err := os.Open(*logFile)
+		if err != nil {
+			logger.Printf("Failed to open query log: %v", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	counts, total, err := readQueryLog(in)
+	if err != nil {
+		logger.Printf("Failed to read query log: %v", err)
+		return 1
+	}
+	if total == 0 {
+		logger.Printf("No queries found in %s", *logFile)
+		return 1
+	}
+	logger.Printf("Read %s queries for %s distinct names", formatNumber(total), formatNumber(len(counts)))
+
+	var impacts []FolderImpact
+	failed := 0
+	for _, src := range candidates {
+		data, err := ghGet(src)
+		if err != nil {
+			logger.Printf("Failed to fetch %s: %v", src, err)
+			failed++
+			continue
+		}
+		impacts = append(impacts, folderImpact(data, counts, *top))
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(map[string]interface{}{"queries": total, "domains": len(counts), "folders": impacts})
+	} else {
+		writeImpact(os.Stdout, impacts, total)
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func writeImpact(out io.Writer, impacts []FolderImpact, total int) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FOLDER\tACTION\tQUERIES\tSHARE\tNAMES")
+	for _, im := range impacts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.1f%%\t%s\n", im.Folder, im.Action, formatNumber(im.Queries), 100*float64(im.Queries)/float64(total), formatNumber(im.Domains))
+	}
+	w.Flush()
+
+	for _, im := range impacts {
+		if len(im.Top) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "\n%s, most queried:\n", im.Folder)
+		for _, d := range im.Top {
+			fmt.Fprintf(out, "  %8s  %s\n", formatNumber(d.Queries), d.Domain)
+		}
+	}
+}
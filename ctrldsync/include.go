@@ -0,0 +1,106 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Line prefix that pulls in every source listed by a remote manifest, a list of lists in lists.txt syntax
+const IncludePrefix = "include:"
+
+// Manifest bodies by source, fetched once per run
+var (
+	includeMutex sync.Mutex
+	includeCache = make(map[string][]byte)
+)
+
+// Sources listed by the manifest on an include: line; parents are the manifests including it, to catch loops
+func loadInclude(line string, base string, parents []string) ([]string, error) {
+	src, err := sourceEntry(line)
+	if err != nil {
+		return nil, err
+	}
+	if base != "" {
+		if src, err = resolveIncluded(src, base); err != nil {
+			return nil, err
+		}
+	}
+	u, opts := splitSource(src)
+	for key := range opts {
+		switch key {
+		case "ref", "path", "basic", "bearer", "header", "file", "sha256", "minisign", "gpg", "sig":
+		default:
+			return nil, fmt.Errorf("%s%s: option %q only applies to lists, not to an include", IncludePrefix, u, key)
+		}
+	}
+	for _, p := range parents {
+		if p == src {
+			return nil, fmt.Errorf("%s%s: include loop", IncludePrefix, u)
+		}
+	}
+
+	includeMutex.Lock()
+	body, cached := includeCache[src]
+	includeMutex.Unlock()
+	if !cached {
+		// Lists are loaded before most commands set up their clients
+		if ghClient == nil {
+			if err := initClients(); err != nil {
+				return nil, err
+			}
+		}
+		if body, err = fetchSourceBody(src); err != nil {
+			return nil, fmt.Errorf("%s%s: %w", IncludePrefix, u, err)
+		}
+		includeMutex.Lock()
+		includeCache[src] = body
+		includeMutex.Unlock()
+	}
+
+	// Entries of a local manifest are taken as written; those of a remote one are relative to it
+	entryBase := ""
+	if _, local := localSourcePath(u); !local {
+		entryBase = u
+	}
+	urls, err := parseListLinesFrom(strings.Split(string(body), "\n"), entryBase, append(parents, src))
+	if err != nil {
+		return nil, fmt.Errorf("%s%s: %w", IncludePrefix, u, err)
+	}
+	if !cached {
+		logger.Printf("Included %d lists from %s", len(urls), u)
+	}
+	return urls, nil
+}
+
+// Resolve a source listed by a remote manifest against the manifest's URL. Such a source
+// can't read local files or send credentials from the environment, as the manifest's
+// publisher would choose where they go.
+func resolveIncluded(src, base string) (string, error) {
+	u, opts := splitSource(src)
+	if hasAuthOptions(opts) {
+		return "", fmt.Errorf("%s: credentials can't be set by an included list", u)
+	}
+	if strings.HasPrefix(u, "file://") || strings.HasPrefix(u, "/") {
+		return "", fmt.Errorf("%s: an included list can't name a local file", u)
+	}
+	if _, local := localSourcePath(u); local {
+		if isGitSource(base) {
+			return "", fmt.Errorf("%s: entries of a git manifest need full URLs", u)
+		}
+		b, err := url.Parse(base)
+		if err != nil {
+			return "", err
+		}
+		ref, err := url.Parse(u)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", u, err)
+		}
+		u = b.ResolveReference(ref).String()
+	}
+	if len(opts) == 0 {
+		return u, nil
+	}
+	return u + "#" + opts.Encode(), nil
+}
@@ -0,0 +1,107 @@
+package ctrldsync
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Parse a choice like "1,3-4", "all" or profile names against a numbered list of profiles
+func parseProfileChoice(input string, profiles []APIProfile) ([]string, error) {
+	input = strings.TrimSpace(input)
+	if strings.EqualFold(input, "all") || input == "*" {
+		ids := make([]string, 0, len(profiles))
+		for _, p := range profiles {
+			ids = append(ids, interfaceToString(p.PK))
+		}
+		return ids, nil
+	}
+
+	var ids []string
+	seen := make(map[string]bool)
+	add := func(i int) error {
+		if i < 1 || i > len(profiles) {
+			return fmt.Errorf("%d is not between 1 and %d", i, len(profiles))
+		}
+		if pk := interfaceToString(profiles[i-1].PK); !seen[pk] {
+			seen[pk] = true
+			ids = append(ids, pk)
+		}
+		return nil
+	}
+
+	for _, part := range strings.FieldsFunc(input, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if from, to, isRange := strings.Cut(part, "-"); isRange {
+			a, errA := strconv.Atoi(from)
+			b, errB := strconv.Atoi(to)
+			if errA == nil && errB == nil {
+				if a > b {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+				for i := a; i <= b; i++ {
+					if err := add(i); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+		}
+		if i, err := strconv.Atoi(part); err == nil {
+			if err := add(i); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Anything else must be a profile ID or name
+		found := false
+		for i, p := range profiles {
+			if interfaceToString(p.PK) == part || strings.EqualFold(strings.TrimSpace(p.Name), part) {
+				found = true
+				add(i + 1)
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no profile %q", part)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no profiles chosen")
+	}
+	return ids, nil
+}
+
+// List the account's profiles and ask which to sync until the answer is valid
+func pickProfiles(in io.Reader, out io.Writer) ([]string, error) {
+	profiles, err := accountProfiles()
+	if err != nil {
+		return nil, err
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("the account has no profiles")
+	}
+
+	fmt.Fprintf(out, "Profiles on this account:\n")
+	for i, p := range profiles {
+		fmt.Fprintf(out, "  %2d) %-30s %s\n", i+1, strings.TrimSpace(p.Name), interfaceToString(p.PK))
+	}
+
+	reader := bufio.NewReader(in)
+	for {
+		fmt.Fprintf(out, "Profiles to sync (e.g. 1,3-4, names, or all): ")
+		line, readErr := reader.ReadString('\n')
+		if strings.TrimSpace(line) != "" {
+			ids, err := parseProfileChoice(line, profiles)
+			if err == nil {
+				return ids, nil
+			}
+			fmt.Fprintf(out, "%v\n", err)
+		}
+		if readErr != nil {
+			return nil, fmt.Errorf("no selection made: %w", readErr)
+		}
+	}
+}
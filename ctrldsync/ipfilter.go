@@ -0,0 +1,60 @@
+package ctrldsync
+
+import (
+	"encoding/csv"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Report whether a source entry is an IP address or CIDR range rather than a hostname
+func isIPEntry(entry string) bool {
+	entry = strings.Trim(entry, "[]")
+	if net.ParseIP(entry) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(entry)
+	return err == nil
+}
+
+// Separate IP and CIDR entries, which Control D custom rules can't hold, from hostname rules
+func splitIPRules(rules []Rule) (hostnames []Rule, ips []string) {
+	for _, rule := range rules {
+		if isIPEntry(rule.PK) {
+			ips = append(ips, rule.PK)
+			continue
+		}
+		hostnames = append(hostnames, rule)
+	}
+	return hostnames, ips
+}
+
+// Write every IP and CIDR entry left out of the fetched sources as CSV: folder, source, entry
+func writeIPReport(path string) error {
+	cacheMutex.RLock()
+	var folders []FolderData
+	for _, data := range cache {
+		if len(data.IPEntries) > 0 {
+			folders = append(folders, data)
+		}
+	}
+	cacheMutex.RUnlock()
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Source < folders[j].Source })
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"folder", "source", "entry"})
+	for _, data := range folders {
+		for _, entry := range data.IPEntries {
+			w.Write([]string{strings.TrimSpace(data.Group.Group), data.Source, entry})
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
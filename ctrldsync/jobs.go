@@ -0,0 +1,171 @@
+package ctrldsync
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// One named sync job from the config file, usually one Control D account
+type Job struct {
+	Name      string   `yaml:"name"`
+	Token     string   `yaml:"token"`
+	Profiles  []string `yaml:"profiles"`
+	Lists     []string `yaml:"lists"`
+	StateFile string   `yaml:"state_file"` // defaults to .sync-state-<name>.json
+	Args      []string `yaml:"args"`       // extra sync flags, e.g. [--dry-run]
+}
+
+// Jobs from the config file, in the order they are defined
+var configJobs []Job
+
+// Environment for a job's child process; anything the job doesn't set is inherited
+func (j Job) env() []string {
+	env := os.Environ()
+	if j.Token != "" {
+		env = append(env, "TOKEN="+j.Token)
+	}
+	if len(j.Profiles) > 0 {
+		env = append(env, "PROFILE="+strings.Join(j.Profiles, ","))
+	}
+	if len(j.Lists) > 0 {
+		env = append(env, "SOURCES="+strings.Join(j.Lists, ","))
+	}
+	stateFile := j.StateFile
+	if stateFile == "" {
+		stateFile = fmt.Sprintf(".sync-state-%s.json", j.Name)
+	}
+	return append(env, "STATE_FILE="+stateFile)
+}
+
+// Copy a child's output line by line, prefixed with the job name
+func prefixLines(name string, r io.Reader, mu *sync.Mutex) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		mu.Lock()
+		fmt.Printf("[%s] %s\n", name, scanner.Text())
+		mu.Unlock()
+	}
+}
+
+// Run one job as a separate sync process so jobs never share tokens or state
+func runJob(self string, job Job, extra []string, mu *sync.Mutex) error {
+	args := append([]string{"sync"}, job.Args...)
+	args = append(args, extra...)
+	cmd := exec.Command(self, args...)
+	cmd.Env = job.env()
+
+	r, w := io.Pipe()
+	cmd.Stdout = w
+	cmd.Stderr = w
+	done := make(chan struct{})
+	go func() {
+		prefixLines(job.Name, r, mu)
+		close(done)
+	}()
+
+	err := cmd.Run()
+	w.Close()
+	<-done
+	return err
+}
+
+// jobs [--parallel] [--list] [name...] [-- sync flags]
+func runJobsCommand(args []string) int {
+	fs := flag.NewFlagSet("jobs", flag.ExitOnError)
+	parallel := fs.Bool("parallel", getenv("JOBS_PARALLEL") == "true", "run the jobs at the same time instead of one after another")
+	list := fs.Bool("list", false, "print the configured jobs and exit")
+	fs.Parse(args)
+
+	if len(configJobs) == 0 {
+		fmt.Fprintf(os.Stderr, "no jobs defined in %s\n", configFilePath())
+		return 2
+	}
+	if *list {
+		for _, job := range configJobs {
+			fmt.Printf("%-16s %d profiles, %d lists\n", job.Name, len(job.Profiles), len(job.Lists))
+		}
+		return 0
+	}
+
+	// Names before "--" pick jobs; everything after it is passed to each sync
+	var names, extra []string
+	for i, arg := range fs.Args() {
+		if arg == "--" {
+			extra = fs.Args()[i+1:]
+			break
+		}
+		names = append(names, arg)
+	}
+
+	selected := configJobs
+	if len(names) > 0 {
+		byName := make(map[string]Job)
+		for _, job := range configJobs {
+			byName[job.Name] = job
+		}
+		selected = nil
+		for _, name := range names {
+			job, ok := byName[name]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "unknown job %q\n", name)
+				return 2
+			}
+			selected = append(selected, job)
+		}
+	}
+	for _, job := range selected {
+		if _, err := parseListLines(job.Lists); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: jobs: %s: %v\n", configFilePath(), job.Name, err)
+			return 2
+		}
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		logger.Printf("Failed to locate executable: %v", err)
+		return 1
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		failed []string
+	)
+	run := func(job Job) {
+		logger.Printf("Job '%s' started", job.Name)
+		if err := runJob(self, job, extra, &mu); err != nil {
+			mu.Lock()
+			failed = append(failed, job.Name)
+			mu.Unlock()
+			logger.Printf("Job '%s' failed: %v", job.Name, err)
+			return
+		}
+		logger.Printf("Job '%s' finished", job.Name)
+	}
+	for _, job := range selected {
+		if !*parallel {
+			run(job)
+			continue
+		}
+		wg.Add(1)
+		go func(job Job) {
+			defer wg.Done()
+			run(job)
+		}(job)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		logger.Printf("%d/%d jobs failed: %s", len(failed), len(selected), strings.Join(failed, ", "))
+		return 1
+	}
+	logger.Printf("All %d jobs finished", len(selected))
+	return 0
+}
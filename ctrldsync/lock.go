@@ -0,0 +1,259 @@
+package ctrldsync
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LockFolderName starts the name of each disabled folder holding a profile's sync lock;
+// every instance creates its own, "ctrld-sync lock <owner> <created>"
+const (
+	LockFolderName  = "ctrld-sync lock"
+	DefaultLockTTL  = 2 * time.Hour
+	LockGracePeriod = 5 * time.Minute // an empty lock folder this young may still be getting its marker
+	lockSuffix      = ".lock.ctrld-sync"
+)
+
+var (
+	lockBackend string
+	lockTTL     = DefaultLockTTL
+	lockOwner   = newLockOwner()
+)
+
+// Lock marker stored as a rule in the lock folder
+type profileLock struct {
+	Owner    string
+	Acquired time.Time
+	Expires  time.Time
+	FolderID string
+}
+
+// Identify this process across machines
+func newLockOwner() string {
+	host, _ := os.Hostname()
+	host = strings.ToLower(regexp.MustCompile(`[^a-zA-Z0-9-]+`).ReplaceAllString(host, "-"))
+	if host == "" {
+		host = "host"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// Encode a lock as a rule hostname: <owner>.<acquired>.<expires>.lock.ctrld-sync
+func (l profileLock) encode() string {
+	return fmt.Sprintf("%s.%d.%d%s", l.Owner, l.Acquired.Unix(), l.Expires.Unix(), lockSuffix)
+}
+
+// Decode a lock rule hostname
+func decodeLock(hostname string) (profileLock, bool) {
+	if !strings.HasSuffix(hostname, lockSuffix) {
+		return profileLock{}, false
+	}
+	parts := strings.Split(strings.TrimSuffix(hostname, lockSuffix), ".")
+	if len(parts) != 3 {
+		return profileLock{}, false
+	}
+	acquired, err1 := strconv.ParseInt(parts[1], 10, 64)
+	expires, err2 := strconv.ParseInt(parts[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return profileLock{}, false
+	}
+	return profileLock{Owner: parts[0], Acquired: time.Unix(acquired, 0), Expires: time.Unix(expires, 0)}, true
+}
+
+// Whether a folder holds a sync lock
+func isLockFolder(name string) bool {
+	return name == LockFolderName || strings.HasPrefix(name, LockFolderName+" ")
+}
+
+// Name of this instance's lock folder
+func lockFolderName(created time.Time) string {
+	return fmt.Sprintf("%s %s %d", LockFolderName, lockOwner, created.Unix())
+}
+
+// When a lock folder was created, from its name; zero for folders of older versions
+func lockFolderCreated(name string) time.Time {
+	fields := strings.Fields(strings.TrimPrefix(name, LockFolderName))
+	if len(fields) != 2 {
+		return time.Time{}
+	}
+	created, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(created, 0)
+}
+
+// Read every lock marker in the profile, deleting lock folders that hold no live lock
+// and are past the grace period, so a folder another instance is still filling stays
+func readLocks(profileID string) ([]profileLock, error) {
+	groups, err := listFolderDetails(profileID)
+	if err != nil {
+		return nil, err
+	}
+
+	var locks []profileLock
+	for _, g := range groups {
+		name := strings.TrimSpace(g.Group)
+		if !isLockFolder(name) {
+			continue
+		}
+		folderID := interfaceToString(g.PK)
+
+		endpoint := fmt.Sprintf("%s/%s/rules/%s", APIBase, profileID, folderID)
+		resp, err := apiGet(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read lock folder: %w", err)
+		}
+		var apiResp APIRulesResponse
+		err = json.NewDecoder(resp.Body).Decode(&apiResp)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode lock folder: %w", err)
+		}
+
+		live := false
+		for _, rule := range apiResp.Body.Rules {
+			if l, ok := decodeLock(rule.PK); ok && time.Now().Before(l.Expires) {
+				l.FolderID = folderID
+				locks = append(locks, l)
+				live = true
+			}
+		}
+		if !live && time.Since(lockFolderCreated(name)) > LockGracePeriod {
+			deleteFolder(profileID, name+" (stale)", folderID)
+		}
+	}
+
+	// Earliest acquisition wins; owner breaks ties
+	sort.Slice(locks, func(i, j int) bool {
+		if !locks[i].Acquired.Equal(locks[j].Acquired) {
+			return locks[i].Acquired.Before(locks[j].Acquired)
+		}
+		return locks[i].Owner < locks[j].Owner
+	})
+	return locks, nil
+}
+
+// Returned when another instance holds a profile's lock
+var errLocked = errors.New("profile is locked")
+
+// Take the in-profile lock, returning a release function. The lock is renewed while it
+// is held, so a sync that runs longer than LOCK_TTL keeps it.
+func acquireProfileLock(profileID string) (func(), error) {
+	locks, err := readLocks(profileID)
+	if err != nil {
+		return nil, err
+	}
+	if len(locks) > 0 {
+		return nil, fmt.Errorf("%w by %s until %s", errLocked, locks[0].Owner, locks[0].Expires.UTC().Format(time.RFC3339))
+	}
+
+	now := time.Now()
+	name := lockFolderName(now)
+	folderID, err := createFolder(profileID, name, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	remove := func() {
+		deleteFolder(profileID, name, folderID)
+	}
+
+	l := profileLock{Owner: lockOwner, Acquired: now, Expires: now.Add(lockTTL)}
+	if err := writeLockMarker(profileID, folderID, l); err != nil {
+		remove()
+		return nil, err
+	}
+
+	// Another instance may have raced us. Whoever sees another's marker after writing its own
+	// backs off: the later writer always sees the earlier one, so two can't both go ahead,
+	// whatever their clocks say.
+	locks, err = readLocks(profileID)
+	if err != nil {
+		remove()
+		return nil, err
+	}
+	mine := false
+	for _, other := range locks {
+		if other.Owner != lockOwner {
+			remove()
+			return nil, fmt.Errorf("%w by %s until %s", errLocked, other.Owner, other.Expires.UTC().Format(time.RFC3339))
+		}
+		mine = true
+	}
+	if !mine {
+		remove()
+		return nil, fmt.Errorf("lock was not found after writing it")
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go renewLock(profileID, folderID, l, stop, done)
+
+	logger.Printf("Profile %s: acquired lock as %s (expires %s)", maskID(profileID), lockOwner, l.Expires.UTC().Format(time.RFC3339))
+	return func() {
+		close(stop)
+		<-done
+		remove()
+	}, nil
+}
+
+// Add a lock marker to a lock folder
+func writeLockMarker(profileID, folderID string, l profileLock) error {
+	data := map[string]string{
+		"do":           "0",
+		"status":       "0",
+		"group":        folderID,
+		"hostnames[0]": l.encode(),
+	}
+	endpoint := fmt.Sprintf("%s/%s/rules", APIBase, profileID)
+	resp, err := apiPostForm(endpoint, data)
+	if err != nil {
+		return fmt.Errorf("failed to write lock: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Push the lock's expiry forward every third of LOCK_TTL until stop is closed;
+// the older markers expire on their own and go with the folder
+func renewLock(profileID, folderID string, l profileLock, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(lockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			l.Expires = time.Now().Add(lockTTL)
+			if err := writeLockMarker(profileID, folderID, l); err != nil {
+				warnf("profile %s: could not renew lock: %v", maskID(profileID), err)
+				continue
+			}
+			logger.Printf("Profile %s: renewed lock (expires %s)", maskID(profileID), l.Expires.UTC().Format(time.RFC3339))
+		}
+	}
+}
+
+// Take the configured lock for a profile; a no-op when locking is disabled
+func acquireLock(profileID string) (func(), error) {
+	switch lockBackend {
+	case "", "none":
+		return func() {}, nil
+	case "profile":
+		return acquireProfileLock(profileID)
+	default:
+		return nil, fmt.Errorf("unknown lock backend %q", lockBackend)
+	}
+}
@@ -0,0 +1,1941 @@
+package ctrldsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Constants
+const (
+	DefaultAPIBase           = "https://api.controld.com/profiles"
+	DefaultBatchSize         = 500
+	DefaultMaxRetries        = 3
+	DefaultConcurrency       = 3
+	DefaultRetryDelay        = 1 * time.Second
+	DefaultHTTPTimeout       = 30 * time.Second
+	FolderCreationDelay      = 2 * time.Second
+	MaxConcurrentFolderScans = 5 // Maximum number of folders read concurrently during the existing-rules scan
+)
+
+// Tunables that ctrld-sync.yaml or the environment can change
+var (
+	BatchSize             = DefaultBatchSize
+	MaxRetries            = DefaultMaxRetries
+	MaxConcurrentProfiles = DefaultConcurrency // Maximum number of profiles to sync concurrently
+	MaxConcurrentBatches  = 0                  // Rule batches pushed at once, shared round-robin across profiles; 0 for one per concurrent profile
+	RetryDelay            = DefaultRetryDelay  // Backoff before the first retry, doubled on each attempt
+	HTTPTimeout           = DefaultHTTPTimeout
+)
+
+// Control D profiles endpoint; API_BASE points it elsewhere, e.g. at a mock server
+var APIBase = DefaultAPIBase
+
+var FolderURLs []string
+
+func loadFolderURLs(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return parseListLines(lines)
+}
+
+// Turn list entries into URLs, skipping blanks and comments
+func parseListLines(lines []string) ([]string, error) {
+	return parseListLinesFrom(lines, "", nil)
+}
+
+// Turn list entries into URLs; base is the URL of the remote manifest they come from, if any
+func parseListLinesFrom(lines []string, base string, parents []string) ([]string, error) {
+	var urls []string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry := line
+		line, err := expandListVars(line)
+		if err != nil {
+			return nil, err
+		}
+		// "preset:<name>" expands to the preset's folder URLs
+		if name, ok := strings.CutPrefix(line, "preset:"); ok {
+			preset, found := findPreset(strings.TrimSpace(name))
+			if !found {
+				return nil, fmt.Errorf("unknown preset %q", name)
+			}
+			urls = append(urls, preset.URLs()...)
+			continue
+		}
+		// "include:<url>" expands to the sources listed by a remote manifest
+		if rest, ok := strings.CutPrefix(line, IncludePrefix); ok {
+			included, err := loadInclude(rest, base, parents)
+			if err != nil {
+				return nil, err
+			}
+			urls = append(urls, included...)
+			continue
+		}
+		src, err := sourceEntry(line)
+		if err != nil {
+			return nil, err
+		}
+		if base != "" {
+			if src, err = resolveIncluded(src, base); err != nil {
+				return nil, err
+			}
+		}
+		if line != entry {
+			recordSourceTemplate(src, entry)
+		}
+		urls = append(urls, src)
+	}
+	return urls, nil
+}
+
+// Structs for JSON data
+type Action struct {
+	Do     int `json:"do"`
+	Status int `json:"status"`
+}
+
+type Group struct {
+	Group  string `json:"group"`
+	Action Action `json:"action"`
+}
+
+type Rule struct {
+	PK     string  `json:"PK"`
+	Action *Action `json:"action,omitempty"` // as reported by the rules API
+
+	// Where the rule came from: its line in a list, or its position among a folder JSON's rules
+	Line int `json:"-"`
+}
+
+type FolderData struct {
+	Group Group  `json:"group"`
+	Rules []Rule `json:"rules"`
+
+	// Where the folder came from and a content version, filled in on fetch
+	Source  string `json:"-"`
+	Version string `json:"-"`
+	Release string `json:"-"` // tag of a GitHub release asset source
+
+	// Set from overrides.txt; higher is deleted later and recreated sooner
+	Priority int `json:"-"`
+
+	// IP and CIDR entries taken out of Rules on fetch
+	IPEntries []string `json:"-"`
+
+	// Failed completely last run; planned ahead of the other folders
+	CarriedOver bool `json:"-"`
+
+	// Further sources of the same folder name merged into this one
+	Merged []string `json:"-"`
+}
+
+type APIGroup struct {
+	Group  string      `json:"group"`
+	PK     interface{} `json:"PK"`
+	Action Action      `json:"action"`
+	Count  int         `json:"count"`
+}
+
+type APIGroupsResponse struct {
+	Body struct {
+		Groups []APIGroup `json:"groups"`
+	} `json:"body"`
+}
+
+type APIRulesResponse struct {
+	Body struct {
+		Rules []Rule `json:"rules"`
+	} `json:"body"`
+}
+
+type FolderResult struct {
+	Name       string `json:"name"`
+	Source     string `json:"source"`
+	Version    string `json:"version"`
+	Release    string `json:"release,omitempty"` // tag of a GitHub release asset source
+	Do         int    `json:"do"`
+	Status     int    `json:"status"`
+	Rules      int    `json:"rules"`
+	Duplicates int    `json:"duplicates"`
+	Success    bool   `json:"success"`
+
+	FailedBatches int  `json:"failed_batches,omitempty"`
+	SourceRules   int  `json:"source_rules,omitempty"` // distinct rules in the source list
+	Deferred      bool `json:"deferred,omitempty"`     // left untouched to stay within --max-duration
+	Rejected      int  `json:"rejected,omitempty"`     // hostnames the API refused, now or in earlier runs
+	IPEntries     int  `json:"ip_entries,omitempty"`   // IP/CIDR source entries left out
+}
+
+type ProfileResult struct {
+	ProfileID string         `json:"profile"`
+	Folders   []FolderResult `json:"folders"`
+	Success   bool           `json:"success"`
+	Duration  time.Duration  `json:"duration_ns"`
+	Errors    []string       `json:"errors,omitempty"`
+
+	// Rules added, removed or changed by hand since the last sync
+	DriftRules int `json:"drift_rules,omitempty"`
+
+	// Why the profile wasn't synced at all, e.g. "locked"; such profiles count as neither succeeded nor failed
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// Log a failure and record it for the run summary
+func (r *ProfileResult) fail(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	logger.Print(msg)
+	r.Errors = append(r.Errors, msg)
+}
+
+// Global variables
+var (
+	noDedup          bool
+	alertThresholds  AlertThresholds
+	canaryCount      int
+	verifySampleSize int
+	summaryTemplate  *template.Template
+	selection        ProfileSelection
+	token            string
+	apiClient        *http.Client
+	ghClient         *http.Client
+	webhookClient    *http.Client // proxy and CA settings of the API client, without its rate-limit accounting
+	cache            = make(map[string]FolderData)
+	cacheMutex       sync.RWMutex
+)
+
+// Where the run logs to; a Syncer swaps in the logger it was given
+var logger = log.Default()
+
+// Logger setup
+func setupLogger() {
+	log.SetFlags(log.LstdFlags)
+	log.SetPrefix("")
+}
+
+// Network settings for one HTTP client
+type ClientConfig struct {
+	Timeout            time.Duration
+	Proxy              string
+	CAFile             string
+	InsecureSkipVerify bool
+}
+
+// Read client settings from <prefix>_TIMEOUT, <prefix>_PROXY, <prefix>_CA_FILE and <prefix>_INSECURE_SKIP_VERIFY
+func loadClientConfig(prefix string) (ClientConfig, error) {
+	cfg := ClientConfig{
+		Timeout:            HTTPTimeout,
+		Proxy:              getenv(prefix + "_PROXY"),
+		CAFile:             getenv(prefix + "_CA_FILE"),
+		InsecureSkipVerify: getenv(prefix+"_INSECURE_SKIP_VERIFY") == "true",
+	}
+	if v := getenv(prefix + "_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid %s_TIMEOUT %q: %w", prefix, v, err)
+		}
+		cfg.Timeout = d
+	}
+	return cfg, nil
+}
+
+// Build an HTTP client from its settings
+func newHTTPClient(cfg ClientConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	proxy, err := proxyFunc(cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	transport.Proxy = proxy
+
+	if cfg.CAFile != "" || cfg.InsecureSkipVerify {
+		tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+		if cfg.CAFile != "" {
+			pem, err := os.ReadFile(cfg.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA file: %w", err)
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &http.Client{
+		Timeout:   cfg.Timeout,
+		Transport: transport,
+	}, nil
+}
+
+// Initialize HTTP clients
+func initClients() error {
+	apiConfig, err := loadClientConfig("API")
+	if err != nil {
+		return err
+	}
+	ghConfig, err := loadClientConfig("GH")
+	if err != nil {
+		return err
+	}
+
+	if base := getenv("API_BASE"); base != "" {
+		APIBase = strings.TrimSuffix(base, "/")
+	}
+
+	if apiClient, err = newHTTPClient(apiConfig); err != nil {
+		return fmt.Errorf("API client: %w", err)
+	}
+	if ghClient, err = newHTTPClient(ghConfig); err != nil {
+		return fmt.Errorf("GitHub client: %w", err)
+	}
+	if webhookClient, err = newHTTPClient(apiConfig); err != nil {
+		return fmt.Errorf("webhook client: %w", err)
+	}
+	apiClient.Transport = &rateLimitTransport{next: apiClient.Transport}
+	ghClient.Transport = &objectStoreTransport{next: &sourceAuthTransport{next: ghClient.Transport}}
+	return nil
+}
+
+// Retry request with exponential backoff
+func retryRequest(requestFunc func() (*http.Response, error)) (*http.Response, error) {
+	var lastErr error
+
+	for attempt := 0; attempt < MaxRetries; attempt++ {
+		resp, err := requestFunc()
+		if err == nil && resp.StatusCode < 400 {
+			return resp, nil
+		}
+
+		lastErr = err
+		if resp != nil && resp.StatusCode >= 400 {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			lastErr = &HTTPStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+		}
+
+		// Client errors other than rate limiting won't go away on retry
+		if resp != nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout {
+			break
+		}
+		if attempt == MaxRetries-1 {
+			break
+		}
+
+		waitTime := RetryDelay * time.Duration(1<<attempt)
+		logger.Printf("Request failed (attempt %d/%d): %v. Retrying in %v...", attempt+1, MaxRetries, lastErr, waitTime)
+		time.Sleep(waitTime)
+	}
+
+	return nil, lastErr
+}
+
+// API GET request
+func apiGet(endpoint string) (*http.Response, error) {
+	return retryRequest(func() (*http.Response, error) {
+		req, err := http.NewRequest("GET", endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		return apiClient.Do(req)
+	})
+}
+
+// API DELETE request
+func apiDelete(endpoint string) (*http.Response, error) {
+	return retryRequest(func() (*http.Response, error) {
+		req, err := http.NewRequest("DELETE", endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		return apiClient.Do(req)
+	})
+}
+
+// API POST request
+func apiPost(endpoint string, data map[string]string) (*http.Response, error) {
+	return retryRequest(func() (*http.Response, error) {
+		jsonData, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(jsonData))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+
+		return apiClient.Do(req)
+	})
+}
+
+// API POST form request
+func apiPostForm(endpoint string, data map[string]string) (*http.Response, error) {
+	return retryRequest(func() (*http.Response, error) {
+		formData := url.Values{}
+		for k, v := range data {
+			formData.Set(k, v)
+		}
+
+		req, err := http.NewRequest("POST", endpoint, strings.NewReader(formData.Encode()))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		return apiClient.Do(req)
+	})
+}
+
+// GitHub GET request (cached)
+func ghGet(url string) (FolderData, error) {
+	// Check cache with read lock
+	cacheMutex.RLock()
+	if data, exists := cache[url]; exists {
+		cacheMutex.RUnlock()
+		return data, nil
+	}
+	cacheMutex.RUnlock()
+
+	if bundleMode {
+		return FolderData{}, fmt.Errorf("source is not in the bundle")
+	}
+
+	body, err := fetchSourceBody(url)
+	if err != nil {
+		return FolderData{}, err
+	}
+
+	data, err := folderFromBody(url, body)
+	if err != nil {
+		return FolderData{}, err
+	}
+
+	// Write to cache with write lock
+	cacheMutex.Lock()
+	cache[url] = data
+	cacheMutex.Unlock()
+
+	return data, nil
+}
+
+// Parse a fetched source into folder data, tagged with its source and content version
+func folderFromBody(url string, body []byte) (FolderData, error) {
+	data, err := parseSource(url, body)
+	if err != nil {
+		return FolderData{}, err
+	}
+	data.Rules, data.IPEntries = splitIPRules(data.Rules)
+	if len(data.IPEntries) > 0 {
+		warnf("folder '%s': left out %d IP/CIDR entries that can't be pushed as hostname rules (set IP_REPORT_FILE to list them)", strings.TrimSpace(data.Group.Group), len(data.IPEntries))
+	}
+	sum := sha256.Sum256(body)
+	data.Source = url
+	data.Version = "sha256:" + hex.EncodeToString(sum[:])[:12]
+	data.Release = releaseTag(url)
+	return data, nil
+}
+
+// Convert interface{} to string
+func interfaceToString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	switch val := v.(type) {
+	case string:
+		return val
+	case int:
+		return strconv.Itoa(val)
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case float64:
+		return strconv.FormatFloat(val, 'f', 0, 64)
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
+
+// List existing folders with their action and rule count
+func listFolderDetails(profileID string) ([]APIGroup, error) {
+	endpoint := fmt.Sprintf("%s/%s/groups", APIBase, profileID)
+	resp, err := apiGet(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list existing folders: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var apiResp APIGroupsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		return nil, fmt.Errorf("failed to decode groups response: %w", err)
+	}
+
+	return apiResp.Body.Groups, nil
+}
+
+// List existing folders
+func listExistingFolders(profileID string) (map[string]string, error) {
+	groups, err := listFolderDetails(profileID)
+	if err != nil {
+		return nil, err
+	}
+	return folderIDs(groups), nil
+}
+
+// Map folder names to their IDs
+func folderIDs(groups []APIGroup) map[string]string {
+	folders := make(map[string]string)
+	for _, folder := range groups {
+		pkStr := interfaceToString(folder.PK)
+		if folder.Group != "" && pkStr != "" {
+			folders[strings.TrimSpace(folder.Group)] = pkStr
+		}
+	}
+	return folders
+}
+
+// Get all existing rules, skipping the folders named in exclude
+func getAllExistingRules(profileID string, exclude map[string]bool) (map[string]bool, error) {
+	folders, err := scanExistingRules(profileID, exclude)
+	allRules := dedupSet(folders)
+	if err == nil {
+		logger.Printf("Total existing rules across all folders: %d", len(allRules))
+	}
+	return allRules, err
+}
+
+// Dedup keys of every rule in a listing by folder
+func dedupSet(folders map[string][]string) map[string]bool {
+	rules := make(map[string]bool)
+	for _, list := range folders {
+		for _, rule := range list {
+			rules[dedupKey(rule)] = true
+		}
+	}
+	return rules
+}
+
+// Get the rules of every folder by name, "" for the root folder, skipping the folders named in exclude
+func scanExistingRules(profileID string, exclude map[string]bool) (map[string][]string, error) {
+	folders := make(map[string][]string)
+
+	// Get rules from root folder
+	endpoint := fmt.Sprintf("%s/%s/rules", APIBase, profileID)
+	resp, err := apiGet(endpoint)
+	if err != nil {
+		warnf("Failed to get root folder rules: %v", err)
+	} else {
+		defer resp.Body.Close()
+		var apiResp APIRulesResponse
+		if err := json.NewDecoder(resp.Body).Decode(&apiResp); err == nil {
+			for _, rule := range apiResp.Body.Rules {
+				if rule.PK != "" {
+					folders[""] = append(folders[""], rule.PK)
+				}
+			}
+			logger.Printf("Found %d rules in root folder", len(apiResp.Body.Rules))
+		}
+	}
+
+	// Get all folders
+	groups, err := listFolderDetails(profileID)
+	if err != nil {
+		return folders, err
+	}
+	// Get rules from each folder, reusing cached listings for folders whose rule count is unchanged
+	fresh := make(map[string]FolderRulesCache)
+	reused := 0
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, MaxConcurrentFolderScans)
+	)
+	for _, g := range groups {
+		folderName := strings.TrimSpace(g.Group)
+		folderID := interfaceToString(g.PK)
+		if folderID == "" || exclude[folderName] || isLockFolder(folderName) {
+			continue
+		}
+
+		if rules, ok := cachedFolderRules(profileID, folderID, g.Count); ok {
+			mu.Lock()
+			folders[folderName] = append(folders[folderName], rules...)
+			fresh[folderID] = FolderRulesCache{Count: g.Count}
+			mu.Unlock()
+			reused++
+			continue
+		}
+
+		wg.Add(1)
+		go func(folderName, folderID string, count int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			rules, err := listFolderRules(profileID, folderID)
+			if err != nil {
+				warnf("Failed to get rules from folder '%s': %v", folderName, err)
+				return
+			}
+
+			storeFolderRules(profileID, folderID, rules)
+
+			mu.Lock()
+			defer mu.Unlock()
+			folders[folderName] = append(folders[folderName], rules...)
+			fresh[folderID] = FolderRulesCache{Count: count}
+			logger.Printf("Found %d rules in folder '%s'", len(rules), folderName)
+		}(folderName, folderID, g.Count)
+	}
+	wg.Wait()
+	setFolderRulesCache(profileID, fresh)
+
+	if reused > 0 {
+		logger.Printf("Reused cached rules for %d unchanged folders", reused)
+	}
+	return folders, nil
+}
+
+// Fetch folder data from GitHub
+func fetchFolderData(url string) (FolderData, error) {
+	data, err := ghGet(url)
+	if err == nil {
+		recordSourceChange(data)
+	}
+	return data, err
+}
+
+// Delete folder
+func deleteFolder(profileID, name, folderID string) bool {
+	endpoint := fmt.Sprintf("%s/%s/groups/%s", APIBase, profileID, folderID)
+	_, err := apiDelete(endpoint)
+	if err != nil {
+		logger.Printf("Failed to delete folder '%s' (ID %s): %v", name, folderID, err)
+		return false
+	}
+
+	logger.Printf("Deleted folder '%s' (ID %s)", name, folderID)
+	return true
+}
+
+// Create folder
+func createFolder(profileID, name string, do, status int) (string, error) {
+	endpoint := fmt.Sprintf("%s/%s/groups", APIBase, profileID)
+	data := map[string]string{
+		"name":   name,
+		"do":     strconv.Itoa(do),
+		"status": strconv.Itoa(status),
+	}
+
+	_, err := apiPost(endpoint, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to create folder '%s': %w", name, err)
+	}
+
+	// Re-fetch the list and find the folder we just created
+	folders, err := listExistingFolders(profileID)
+	if err != nil {
+		return "", fmt.Errorf("failed to list folders after creation: %w", err)
+	}
+
+	folderID, exists := folders[strings.TrimSpace(name)]
+	if !exists {
+		return "", fmt.Errorf("folder '%s' was not found after creation", name)
+	}
+
+	logger.Printf("Created folder '%s' (ID %s)", name, folderID)
+	time.Sleep(FolderCreationDelay)
+	return folderID, nil
+}
+
+// Outcome of pushing one folder's rules
+type PushStats struct {
+	Added         int
+	Duplicates    int
+	FailedBatches int
+	Rejected      int // newly rejected by the API this run
+	Skipped       int // rejected in earlier runs and not sent again
+
+	Pushed []string // hostnames the API accepted
+}
+
+// Push rules in batches
+func pushRules(profileID, folderName, folderID string, do, status int, hostnames []string, existingRules map[string]bool) PushStats {
+	var stats PushStats
+	if len(hostnames) == 0 {
+		logger.Printf("Folder '%s' - no rules to push", folderName)
+		return stats
+	}
+
+	// Filter out duplicates and hostnames the API keeps rejecting
+	var filteredHostnames []string
+	for _, hostname := range hostnames {
+		switch {
+		case existingRules[dedupKey(hostname)]:
+			stats.Duplicates++
+		case isRejectedHostname(hostname):
+			stats.Skipped++
+		default:
+			filteredHostnames = append(filteredHostnames, hostname)
+		}
+	}
+
+	if stats.Duplicates > 0 {
+		logger.Printf("Folder '%s': skipping %d duplicate rules", folderName, stats.Duplicates)
+	}
+	if stats.Skipped > 0 {
+		warnf("folder '%s': skipping %d hostnames the API rejected in earlier runs", folderName, stats.Skipped)
+	}
+
+	if len(filteredHostnames) == 0 {
+		logger.Printf("Folder '%s' - no new rules to push after filtering duplicates", folderName)
+		return stats
+	}
+
+	successfulBatches := 0
+	base := map[string]string{
+		"do":     strconv.Itoa(do),
+		"status": strconv.Itoa(status),
+		"group":  folderID,
+	}
+	batches := splitBatches(filteredHostnames, batchBaseBytes(base))
+	totalBatches := len(batches)
+	endpoint := fmt.Sprintf("%s/%s/rules", APIBase, profileID)
+
+	for i, batch := range batches {
+		batchNum := i + 1
+		setActivity(profileID, fmt.Sprintf("folder '%s' batch %d/%d", folderName, batchNum, totalBatches))
+
+		pushed, rejected, err := pushBatch(profileID, endpoint, base, batch)
+		if len(rejected) > 0 {
+			recordRejectedHostnames(rejected)
+			stats.Rejected += len(rejected)
+			warnf("folder '%s': the API rejected %d hostnames (e.g. %s)", folderName, len(rejected), rejected[0])
+		}
+		stats.Added += len(pushed)
+		stats.Pushed = append(stats.Pushed, pushed...)
+
+		// Update existing rules set
+		for _, hostname := range pushed {
+			existingRules[dedupKey(hostname)] = true
+		}
+
+		if err != nil {
+			logger.Printf("Failed to push batch %d for folder '%s': %v", batchNum, folderName, err)
+			emitEvent("batch_failed", map[string]interface{}{
+				"profile": profileID,
+				"folder":  folderName,
+				"batch":   batchNum,
+				"batches": totalBatches,
+				"error":   err.Error(),
+			})
+			continue
+		}
+
+		logger.Printf("Folder '%s' – batch %d: added %d rules", folderName, batchNum, len(pushed))
+		successfulBatches++
+	}
+
+	if successfulBatches == totalBatches {
+		logger.Printf("Folder '%s' – finished (%d new rules added)", folderName, stats.Added)
+	} else {
+		warnf("folder '%s': only %d/%d batches succeeded", folderName, successfulBatches, totalBatches)
+	}
+	stats.FailedBatches = totalBatches - successfulBatches
+	return stats
+}
+
+// Delete all managed folders from a profile
+func deleteProfile(profileID string) ProfileResult {
+	result := ProfileResult{ProfileID: profileID}
+	logger.Printf("Starting delete for profile %s", maskID(profileID))
+	setActivity(profileID, "deleting folders")
+
+	var namesToDelete []string
+	sources := make(map[string]string)
+	for _, url := range listsForProfile(profileID) {
+		folderData, err := fetchFolderData(url)
+		if err != nil {
+			result.fail("Failed to fetch folder data from %s: %v", url, err)
+			continue
+		}
+		if name := strings.TrimSpace(folderData.Group.Group); folderFilter.selects(name) {
+			namesToDelete = append(namesToDelete, name)
+			sources[name] = url
+		}
+	}
+	if !folderFilter.active() {
+		namesToDelete = append(namesToDelete, ManifestFolderName)
+	}
+
+	existingFolders, err := listExistingFolders(profileID)
+	if err != nil {
+		result.fail("Failed to list existing folders: %v", err)
+		return result
+	}
+
+	deletedCount := 0
+	for _, name := range namesToDelete {
+		if folderID, exists := existingFolders[name]; exists {
+			ok := deleteFolder(profileID, name, folderID)
+			if ok {
+				deletedCount++
+			}
+			result.Folders = append(result.Folders, FolderResult{Name: name, Source: sources[name], Success: ok})
+			// Merged sources name the same folder more than once
+			delete(existingFolders, name)
+		}
+	}
+
+	if folderFilter.active() {
+		forgetFolders(profileID, namesToDelete)
+	} else {
+		clearProfileState(profileID)
+	}
+
+	logger.Printf("Delete complete: %d/%d folders removed from profile %s", deletedCount, len(namesToDelete), maskID(profileID))
+	result.Success = true
+	return result
+}
+
+// Sync profile
+func syncProfile(profileID string) ProfileResult {
+	result := ProfileResult{ProfileID: profileID}
+	logger.Printf("Starting sync for profile %s", maskID(profileID))
+	setActivity(profileID, "fetching lists")
+
+	// Fetch all folder data first, folders that failed last run leading
+	urls := listsForProfile(profileID)
+	carry := newCarryoverRun(profileID)
+	defer carry.save(urls)
+
+	var folderDataList []FolderData
+	unfetched := make(map[string]bool)
+	for _, url := range carry.prioritize(urls) {
+		folderData, err := fetchFolderData(url)
+		if err != nil {
+			result.fail("Failed to fetch folder data from %s: %v", url, err)
+			carry.fail(url, "", err.Error())
+			if name := unfetchedFolderName(profileID, url); name != "" {
+				unfetched[strings.ToLower(name)] = true
+			}
+			continue
+		}
+		if q := quarantined(url); q != nil {
+			warnQuarantined(url, q)
+			unfetched[strings.ToLower(strings.TrimSpace(folderData.Group.Group))] = true
+			continue
+		}
+		folderData.CarriedOver = carry.carried(url)
+		if name := strings.TrimSpace(folderData.Group.Group); !folderFilter.selects(name) {
+			logger.Printf("Folder '%s': filtered out, leaving it as is", name)
+			continue
+		}
+		applyOverrides(profileID, &folderData)
+		remapAction(&folderData)
+		checkAllowlist(folderData)
+		folderDataList = append(folderDataList, folderData)
+	}
+	folderDataList, incomplete := dropIncomplete(mergeFolders(folderDataList), unfetched)
+	for _, name := range incomplete {
+		result.fail("Folder '%s': left as it is, one of its merged sources couldn't be fetched", name)
+	}
+
+	// Promoted from staging, a folder only gets the content that was verified there
+	kept := folderDataList[:0]
+	for _, folderData := range folderDataList {
+		name := strings.TrimSpace(folderData.Group.Group)
+		if why := stagingPinProblem(profileID, folderData); why != "" {
+			result.fail("Folder '%s': left as it is, %s", name, why)
+			unfetched[strings.ToLower(name)] = true
+			continue
+		}
+		kept = append(kept, folderData)
+	}
+	folderDataList = kept
+
+	if len(folderDataList) == 0 {
+		result.fail("No valid folder data found")
+		return result
+	}
+
+	sortByPriority(folderDataList)
+	folderDataList, deferred, releasePlan := planFolders(folderDataList)
+	defer releasePlan()
+	for _, folderData := range deferred {
+		name := strings.TrimSpace(folderData.Group.Group)
+		result.Folders = append(result.Folders, FolderResult{Name: name, Source: folderData.Source, Version: folderData.Version, Release: folderData.Release, Do: folderData.Group.Action.Do, Status: folderData.Group.Action.Status, Deferred: true})
+		result.Errors = append(result.Errors, fmt.Sprintf("Folder '%s': deferred to stay within --max-duration", name))
+	}
+
+	// Get existing folders, report drift and delete target folders
+	groups, err := listFolderDetails(profileID)
+	if err != nil {
+		result.fail("Failed to list existing folders: %v", err)
+		return result
+	}
+	result.DriftRules = logDrift(profileID, groups)
+	existingFolders := folderIDs(groups)
+	logManifest(profileID, existingFolders)
+
+	if n := plannedNewRules(folderDataList, groups); !newRulesAllowed(profileID, n) {
+		result.fail("Not synced: would add %s rules, more than --max-new-rules %s (use --force if intended)", formatNumber(n), formatNumber(maxNewRules))
+		return result
+	}
+
+	// Highest-priority folders are deleted last and recreated first. Once the deadline
+	// passes nothing more is deleted, and whatever was deleted is always recreated.
+	deleted := make(map[string]bool)
+	for i := len(folderDataList) - 1; i >= 0; i-- {
+		name := strings.TrimSpace(folderDataList[i].Group.Group)
+		if folderID, exists := existingFolders[name]; exists && !deadlinePassed() {
+			deleteFolder(profileID, name, folderID)
+			deleted[name] = true
+		}
+	}
+
+	// Folders of lists no longer configured go too, before their rules could count as duplicates
+	if deleteOrphans && !folderFilter.active() && !stdinMode {
+		keep := make(map[string]bool)
+		for name := range unfetched {
+			keep[name] = true
+		}
+		for _, folderData := range folderDataList {
+			keep[strings.ToLower(strings.TrimSpace(folderData.Group.Group))] = true
+		}
+		for _, folderData := range deferred {
+			keep[strings.ToLower(strings.TrimSpace(folderData.Group.Group))] = true
+		}
+		for _, o := range profileOrphans(profileID, urls, keep) {
+			setActivity(profileID, fmt.Sprintf("deleting orphaned folder '%s'", o.Name))
+			deleted, err := removeOrphan(o)
+			if err != nil {
+				result.fail("Failed to delete orphaned folder '%s': %v", o.Name, err)
+				continue
+			}
+			if deleted {
+				logger.Printf("Profile %s: deleted folder '%s', its list %s is no longer configured", maskID(profileID), o.Name, listShortName(o.Folder.Source))
+			}
+		}
+	}
+
+	// Get all existing rules AFTER deleting target folders, trusting a recent dedup index if there is one
+	recreated := make(map[string]bool, len(folderDataList))
+	for _, folderData := range folderDataList {
+		recreated[strings.TrimSpace(folderData.Group.Group)] = true
+	}
+	existingRules, fromIndex := getDedupIndex(profileID, recreated)
+	if noDedup {
+		logger.Printf("Skipping existing-rules scan (--no-dedup)")
+		existingRules = make(map[string]bool)
+	} else if fromIndex {
+		logger.Printf("Using stored dedup index (%d rules) instead of scanning the profile", len(existingRules))
+	} else {
+		setActivity(profileID, "scanning existing rules")
+		folders, err := scanExistingRules(profileID, nil)
+		if err != nil {
+			result.fail("Failed to get existing rules: %v", err)
+			return result
+		}
+		setDedupIndex(profileID, folders)
+		existingRules = dedupSet(folders)
+		logger.Printf("Total existing rules across all folders: %d", len(existingRules))
+	}
+
+	// Create new folders and push rules
+	successCount := 0
+	for _, folderData := range folderDataList {
+		name := strings.TrimSpace(folderData.Group.Group)
+		do := folderData.Group.Action.Do
+		status := folderData.Group.Action.Status
+
+		// A list naming a hostname twice still makes one rule
+		var hostnames []string
+		listed := make(map[string]bool, len(folderData.Rules))
+		for _, rule := range folderData.Rules {
+			if key := dedupKey(rule.PK); rule.PK != "" && !listed[key] {
+				listed[key] = true
+				hostnames = append(hostnames, rule.PK)
+			}
+		}
+
+		folderResult := FolderResult{Name: name, Source: folderData.Source, Version: folderData.Version, Release: folderData.Release, Do: do, Status: status, SourceRules: len(hostnames), IPEntries: len(folderData.IPEntries)}
+
+		if !deleted[name] && deadlinePassed() {
+			if _, exists := existingFolders[name]; exists {
+				result.fail("Folder '%s': left as it is, --max-duration reached", name)
+			} else {
+				result.fail("Folder '%s': not created, --max-duration reached", name)
+			}
+			result.Folders = append(result.Folders, folderResult)
+			continue
+		}
+
+		setActivity(profileID, fmt.Sprintf("creating folder '%s'", name))
+		folderID, err := createFolder(profileID, name, do, status)
+		if err != nil {
+			result.fail("Failed to create folder '%s': %v", name, err)
+			for _, src := range folderData.sources() {
+				carry.fail(src, name, err.Error())
+			}
+			result.Folders = append(result.Folders, folderResult)
+			continue
+		}
+
+		stats := pushRules(profileID, name, folderID, do, status, hostnames, existingRules)
+		rulesAdded, duplicates, failedBatches := stats.Added, stats.Duplicates, stats.FailedBatches
+		ok := failedBatches == 0
+		if ok && verifySampleSize > 0 && len(stats.Pushed) > 0 {
+			if err := verifySample(profileID, name, folderID, do, stats.Pushed, verifySampleSize); err != nil {
+				result.fail("Folder '%s': sample verification failed: %v", name, err)
+				ok = false
+			}
+		}
+		folderResult.Rules = rulesAdded
+		folderResult.Duplicates = duplicates
+		folderResult.FailedBatches = failedBatches
+		folderResult.Rejected = stats.Rejected + stats.Skipped
+		folderResult.Success = ok
+		result.Folders = append(result.Folders, folderResult)
+		emitEvent("folder_synced", map[string]interface{}{
+			"profile":    profileID,
+			"folder":     name,
+			"rules":      rulesAdded,
+			"duplicates": duplicates,
+			"success":    ok,
+		})
+
+		if ok {
+			successCount++
+			for _, src := range folderData.sources() {
+				carry.succeed(src)
+			}
+		} else if failedBatches > 0 {
+			result.Errors = append(result.Errors, fmt.Sprintf("Folder '%s': some batches failed to push", name))
+		}
+		if failedBatches > 0 && rulesAdded == 0 && len(hostnames) > 0 {
+			for _, src := range folderData.sources() {
+				carry.fail(src, name, "no batch could be pushed")
+			}
+		}
+	}
+
+	// The manifest describes the full set of lists, so a filtered or --stdin run leaves it alone
+	if successCount == len(folderDataList) && len(deferred) == 0 && !folderFilter.active() && !stdinMode {
+		if err := writeManifest(profileID, folderDataList); err != nil {
+			warnf("%v", err)
+		}
+	}
+
+	recordAppliedState(profileID, result.Folders)
+
+	logger.Printf("Sync complete: %d/%d folders processed successfully", successCount, len(folderDataList))
+	result.Success = successCount == len(folderDataList) && len(deferred) == 0
+	return result
+}
+
+// Sync one profile under its lock, with hooks and progress events
+func runProfileSync(profileID string) ProfileResult {
+	release, err := acquireLock(profileID)
+	if errors.Is(err, errLocked) {
+		// Another instance is working on it; leave it to that run
+		logger.Printf("Profile %s: skipped (locked): %v", maskID(profileID), err)
+		return ProfileResult{ProfileID: profileID, Skipped: "locked"}
+	}
+	if err != nil {
+		result := ProfileResult{ProfileID: profileID}
+		result.fail("Profile %s: could not acquire lock: %v", maskID(profileID), err)
+		return result
+	}
+	defer release()
+
+	profileEnv := "CTRLD_SYNC_PROFILE=" + profileID
+	if err := runHook("pre-profile", hooks.PreProfile, map[string]string{"profile": profileID, "mode": "sync"}, profileEnv); err != nil {
+		result := ProfileResult{ProfileID: profileID}
+		result.fail("Profile %s: skipping: %v", maskID(profileID), err)
+		return result
+	}
+
+	start := time.Now()
+	result := syncProfile(profileID)
+	clearActivity(profileID)
+	result.Duration = time.Since(start).Round(time.Second)
+	emitProfileResult("profile_finished", result)
+	if err := runHook("post-profile", hooks.PostProfile, result, profileEnv); err != nil {
+		warnf("%v", err)
+	}
+	return result
+}
+
+// Remove managed folders from one profile under its lock, with hooks and progress events
+func runProfileDelete(profileID string) ProfileResult {
+	release, err := acquireLock(profileID)
+	if errors.Is(err, errLocked) {
+		logger.Printf("Profile %s: skipped (locked): %v", maskID(profileID), err)
+		return ProfileResult{ProfileID: profileID, Skipped: "locked"}
+	}
+	if err != nil {
+		result := ProfileResult{ProfileID: profileID}
+		result.fail("Profile %s: could not acquire lock: %v", maskID(profileID), err)
+		return result
+	}
+	defer release()
+
+	profileEnv := "CTRLD_SYNC_PROFILE=" + profileID
+	if err := runHook("pre-profile", hooks.PreProfile, map[string]string{"profile": profileID, "mode": "delete"}, profileEnv); err != nil {
+		result := ProfileResult{ProfileID: profileID}
+		result.fail("Profile %s: skipping: %v", maskID(profileID), err)
+		return result
+	}
+
+	start := time.Now()
+	result := deleteProfile(profileID)
+	clearActivity(profileID)
+	result.Duration = time.Since(start).Round(time.Second)
+	emitProfileResult("profile_finished", result)
+	if err := runHook("post-profile", hooks.PostProfile, map[string]interface{}{"profile": profileID, "mode": "delete", "success": result.Success}, profileEnv); err != nil {
+		warnf("%v", err)
+	}
+	return result
+}
+
+// Mask profile ID for public display
+func maskID(id string) string {
+	if len(id) <= 3 {
+		return "***"
+	}
+	return id[:3] + "***"
+}
+
+// Format integer with thousands separators
+func formatNumber(n int) string {
+	s := strconv.Itoa(n)
+	if n < 1000 {
+		return s
+	}
+	var result []byte
+	for i, c := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			result = append(result, ',')
+		}
+		result = append(result, byte(c))
+	}
+	return string(result)
+}
+
+// Folder name linked to its source for the job summary
+func summaryFolderName(folder FolderResult) string {
+	name := folder.Name
+	// Only web sources have something to link to
+	if strings.HasPrefix(folder.Source, "http://") || strings.HasPrefix(folder.Source, "https://") {
+		name = fmt.Sprintf("[%s](%s)", folder.Name, folder.Source)
+	}
+	if folder.Release != "" {
+		name += fmt.Sprintf(" (release %s)", folder.Release)
+	}
+	return name
+}
+
+// Write GitHub Actions job summary
+func writeSummary(report RunReport) {
+	summaryPath := getenv("GITHUB_STEP_SUMMARY")
+	if summaryPath == "" {
+		return
+	}
+
+	f, err := os.OpenFile(summaryPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		warnf("could not write GitHub summary: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if summaryTemplate != nil {
+		if err := renderSummaryTemplate(f, summaryTemplate, report); err != nil {
+			warnf("could not render summary template: %v", err)
+		}
+		return
+	}
+
+	results := report.Profiles
+
+	fmt.Fprintf(f, "## Control D \xc3\x97 Hagezi Sync\n\n")
+
+	switch {
+	case report.Failed > 0:
+		fmt.Fprintf(f, "> \xe2\x9d\x8c %d/%d profile(s) failed\n\n", report.Failed, len(results))
+	case report.Skipped > 0:
+		fmt.Fprintf(f, "> \xe2\x9c\x85 %d profile(s) synced successfully, %d skipped (locked by another instance)\n\n", report.Succeeded, report.Skipped)
+	default:
+		fmt.Fprintf(f, "> \xe2\x9c\x85 All %d profile(s) synced successfully\n\n", len(results))
+	}
+
+	for _, r := range results {
+		if r.Skipped != "" {
+			fmt.Fprintf(f, "### \xe2\x8f\xad\xef\xb8\x8f Profile `%s`: skipped (%s)\n\n", maskID(r.ProfileID), r.Skipped)
+			continue
+		}
+		statusIcon := "\xe2\x9c\x85"
+		if !r.Success {
+			statusIcon = "\xe2\x9d\x8c"
+		}
+		fmt.Fprintf(f, "### %s Profile `%s`\n\n", statusIcon, maskID(r.ProfileID))
+		fmt.Fprintf(f, "| Folder | Action | Rules Pushed | Duplicates Skipped | Status |\n")
+		fmt.Fprintf(f, "|--------|--------|--------------|--------------------|--------|\n")
+
+		totalRules := 0
+		totalDuplicates := 0
+		for _, folder := range r.Folders {
+			icon := "\xe2\x9c\x85"
+			if !folder.Success {
+				icon = "\xe2\x9d\x8c"
+			}
+			fmt.Fprintf(f, "| %s | %s | %s | %s | %s |\n",
+				summaryFolderName(folder),
+				actionStatusLabel(Action{Do: folder.Do, Status: folder.Status}),
+				formatNumber(folder.Rules),
+				formatNumber(folder.Duplicates),
+				icon)
+			totalRules += folder.Rules
+			totalDuplicates += folder.Duplicates
+		}
+		fmt.Fprintf(f, "| **Total** | | **%s** | **%s** | |\n\n",
+			formatNumber(totalRules),
+			formatNumber(totalDuplicates))
+	}
+
+	if len(report.Persistent) > 0 {
+		fmt.Fprintf(f, "**Persistent failures** (retried first each run):\n\n")
+		fmt.Fprintf(f, "| Profile | Folder | Failed Runs | Since | Last Error |\n")
+		fmt.Fprintf(f, "|---------|--------|-------------|-------|------------|\n")
+		for _, p := range report.Persistent {
+			folder := p.Folder
+			if folder == "" {
+				folder = listShortName(p.Source)
+			}
+			fmt.Fprintf(f, "| `%s` | %s | %d | %s | %s |\n", maskID(p.Profile), folder, p.Runs, p.Since.Format("2006-01-02 15:04"), p.Error)
+		}
+		fmt.Fprintf(f, "\n")
+	}
+
+	fmt.Fprintf(f, "**API budget:** %s\n\n", report.API)
+
+	if len(report.Warnings) > 0 {
+		fmt.Fprintf(f, "<details><summary>%d warning(s)</summary>\n\n", len(report.Warnings))
+		for _, w := range report.Warnings {
+			if w.Count > 1 {
+				fmt.Fprintf(f, "- %s (\xc3\x97%d)\n", w.Message, w.Count)
+			} else {
+				fmt.Fprintf(f, "- %s\n", w.Message)
+			}
+		}
+		fmt.Fprintf(f, "\n</details>\n\n")
+	}
+}
+
+// Main function
+// Run the command line: a subcommand from os.Args, or a sync
+func Main() {
+	setupLogger()
+
+	// Commands that need no settings
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "version":
+			fmt.Println(Version)
+			return
+		case "help":
+			printCommands()
+			return
+		}
+	}
+
+	// Load environment variables from .env file if it exists
+	if _, err := os.Stat(".env"); err == nil {
+		if err := godotenv.Load(); err != nil {
+			warnf("Error loading .env file: %v", err)
+		}
+	}
+
+	if err := loadSettings(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "cache-proxy":
+			os.Exit(runCacheProxyCommand(os.Args[2:]))
+		case "presets":
+			os.Exit(runPresetsCommand(os.Args[2:]))
+		case "promote":
+			os.Exit(runPromoteCommand(os.Args[2:]))
+		case "digest":
+			os.Exit(runDigestCommand(os.Args[2:]))
+		case "history":
+			os.Exit(runHistoryCommand(os.Args[2:]))
+		case "sweep":
+			os.Exit(runSweepCommand(os.Args[2:]))
+		case "state":
+			os.Exit(runStateCommand(os.Args[2:]))
+		case "audit":
+			os.Exit(runAuditCommand(os.Args[2:]))
+		case "snapshot":
+			os.Exit(runSnapshotCommand(os.Args[2:]))
+		case "restore":
+			os.Exit(runRestoreCommand(os.Args[2:]))
+		case "bundle":
+			os.Exit(runBundleCommand(os.Args[2:]))
+		case "pause":
+			os.Exit(runPauseCommand(os.Args[2:]))
+		case "resume":
+			os.Exit(runResumeCommand(os.Args[2:]))
+		case "stress":
+			os.Exit(runStressCommand(os.Args[2:]))
+		case "quarantine":
+			os.Exit(runQuarantineCommand(os.Args[2:]))
+		case "impact":
+			os.Exit(runImpactCommand(os.Args[2:]))
+		case "upstream-diff":
+			os.Exit(runUpstreamDiffCommand(os.Args[2:]))
+		case "jobs":
+			os.Exit(runJobsCommand(os.Args[2:]))
+		case "sync":
+			runSync(os.Args[2:], false)
+			return
+		case "delete":
+			runSync(os.Args[2:], true)
+			return
+		case "list-folders":
+			os.Exit(runListFoldersCommand(os.Args[2:]))
+		}
+	}
+
+	// No subcommand: sync (or delete with DELETE_ONLY), as before subcommands existed
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") && !looksLikeProfileIDs(os.Args[1]) {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+		printCommands()
+		os.Exit(2)
+	}
+	runSync(os.Args[1:], getenv("DELETE_ONLY") == "true")
+}
+
+// Apply the config file and the environment settings every command shares
+func loadSettings() error {
+	if err := applyConfig(configFilePath()); err != nil {
+		return err
+	}
+	sourceCacheURL = getenv("SOURCE_CACHE")
+	defaultProxy = firstEnv("ALL_PROXY", "all_proxy")
+	return nil
+}
+
+// Sync or delete the selected profiles
+func runSync(args []string, deleteOnly bool) {
+	run, err := prepareSync(args, deleteOnly, flag.ExitOnError)
+	if errors.Is(err, ErrPaused) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := run.execute(context.Background()); err != nil {
+		if errors.Is(err, ErrProfilesFailed) {
+			os.Exit(1)
+		}
+		log.Fatal(err)
+	}
+}
+
+// A sync or delete run set up by prepareSync, with the settings only needed to carry it out
+type syncRun struct {
+	deleteOnly  bool
+	heartbeat   time.Duration
+	maxDuration time.Duration
+	eventsFile  string
+	eventsFD    int
+}
+
+// Parse the sync flags, falling back on the environment, and load everything the run needs
+func prepareSync(args []string, deleteOnly bool, errorHandling flag.ErrorHandling) (*syncRun, error) {
+	fs := flag.NewFlagSet(os.Args[0], errorHandling)
+	if errorHandling == flag.ContinueOnError {
+		// A Syncer gets the error back rather than a usage message on stderr
+		fs.SetOutput(io.Discard)
+	}
+	fs.StringVar(&listSources, "sources", "", "comma-separated list URLs or preset:<name> entries to sync instead of lists.txt (default $SOURCES)")
+	fs.StringVar(&listsFile, "lists-file", "", "file with one list URL per line to use instead of lists.txt (default $LISTS_FILE)")
+	includeFolders := fs.String("include", getenv("INCLUDE_FOLDERS"), "comma-separated folder name globs or /regexps/; only matching folders are synced")
+	excludeFolders := fs.String("exclude", getenv("EXCLUDE_FOLDERS"), "comma-separated folder name globs or /regexps/ to leave untouched")
+	fs.BoolVar(&dryRun, "dry-run", getenv("DRY_RUN") == "true", "print the folders and rules a run would change without changing anything")
+	fromBundle := fs.String("from-bundle", getenv("FROM_BUNDLE"), "apply a file written by the bundle command instead of fetching lists and reading lists.txt, overrides and tags")
+	fromStdin := fs.Bool("stdin", false, "sync domains read from standard input into the folder named by --folder instead of the configured lists")
+	stdinFolder := fs.String("folder", "", "with --stdin, the folder to push the domains to")
+	only := fs.String("only", "", "with --dry-run, plan only these lists (short names like spam-tlds, URLs or preset:<name>), configured or not")
+	fs.BoolVar(&deleteOrphans, "delete-orphans", getenv("DELETE_ORPHANS") == "true", "delete folders this tool created for lists that are no longer configured")
+	fs.BoolVar(&noDedup, "no-dedup", getenv("NO_DEDUP") == "true", "skip the existing-rules scan (for fresh or just-cleaned profiles)")
+	dedupNormalize := fs.String("dedup-normalize", getenv("DEDUP_NORMALIZE"), "ignore these differences when checking for duplicates: case, dot, punycode, all")
+	fs.StringVar(&selection.File, "profiles-file", getenv("PROFILES_FILE"), "file with one profile ID or name per line")
+	fs.BoolVar(&selection.All, "all-profiles", getenv("ALL_PROFILES") == "true", "sync every profile on the account")
+	profileNames := fs.String("profile-names", getenv("PROFILE_NAMES"), "comma-separated name globs or /regexps/; discover account profiles and sync only those whose names match")
+	excludeProfiles := fs.String("exclude-profiles", getenv("EXCLUDE_PROFILES"), "comma-separated profile IDs, names or glob patterns never to sync")
+	remap := fs.String("remap", getenv("REMAP"), "remap actions on every synced folder, e.g. block=bypass")
+
+	// Numeric defaults from the environment; a value that doesn't parse stops the run like a bad config
+	envInts := make(map[string]int)
+	for _, name := range []string{"CANARY", "VERIFY_SAMPLE", "EVENTS_FD", "MAX_NEW_RULES", "CHECK_ALLOWLIST"} {
+		n, err := envInt(name)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid config: %v", err)
+		}
+		envInts[name] = n
+	}
+	envDurations := make(map[string]time.Duration)
+	for name, def := range map[string]time.Duration{"MAX_DURATION": 0, "HEARTBEAT": DefaultHeartbeat} {
+		d, err := envDuration(name, def)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid config: %v", err)
+		}
+		envDurations[name] = d
+	}
+
+	run := &syncRun{deleteOnly: deleteOnly}
+	fs.IntVar(&canaryCount, "canary", envInts["CANARY"], "fully sync and verify this many profiles first; stop if any fails")
+	fs.IntVar(&verifySampleSize, "verify-sample", envInts["VERIFY_SAMPLE"], "after pushing a folder, check this many random rules made it with the right action")
+	tags := fs.String("tags", getenv("TAGS"), "comma-separated tags; sync account profiles carrying any of them")
+	fs.StringVar(&run.eventsFile, "events-file", getenv("EVENTS_FILE"), "append NDJSON progress events to this file")
+	fs.IntVar(&run.eventsFD, "events-fd", envInts["EVENTS_FD"], "write NDJSON progress events to this inherited file descriptor")
+	onlyBetween := fs.String("only-between", getenv("ONLY_BETWEEN"), "only change profiles inside this daily window, e.g. \"02:00-06:00 Europe/Berlin\"")
+	waitForWindow := fs.Bool("wait-for-window", getenv("WAIT_FOR_WINDOW") == "true", "outside --only-between, wait for the window to open instead of refusing")
+	fs.IntVar(&maxNewRules, "max-new-rules", envInts["MAX_NEW_RULES"], "ask before a sync adds more than this many rules to a profile, and refuse when not on a terminal (0 disables)")
+	fs.BoolVar(&quarantineAnomalies, "quarantine-anomalies", getenv("ANOMALY_QUARANTINE") == "true", "leave the folders of lists whose size changes unusually as they are until approved with the quarantine command")
+	fs.StringVar(&defaultProxy, "proxy", defaultProxy, "proxy for the Control D API and list downloads, http://, https:// or socks5:// (default $ALL_PROXY; API_PROXY and GH_PROXY take precedence)")
+	fs.StringVar(&sourceCacheURL, "source-cache", sourceCacheURL, "fetch lists through this cache-proxy instance, falling back to fetching them directly")
+	fs.BoolVar(&forceNewRules, "force", getenv("FORCE") == "true", "sync even when --max-new-rules is exceeded")
+	fs.IntVar(&allowlistCheckSample, "check-allowlist", envInts["CHECK_ALLOWLIST"], "resolve this many random domains of each allow folder and warn about ones that no longer exist")
+	interactive := fs.Bool("interactive", false, "list the account's profiles and choose which to sync")
+	fs.DurationVar(&run.heartbeat, "heartbeat", envDurations["HEARTBEAT"], "when not on a terminal, log what is in progress this often so CI inactivity timeouts don't kill long pushes (0 disables)")
+	fs.DurationVar(&run.maxDuration, "max-duration", envDurations["MAX_DURATION"], "finish within this long, syncing block folders and small lists first and deferring what won't fit")
+	fs.IntVar(&MaxConcurrentProfiles, "concurrency", MaxConcurrentProfiles, "profiles synced at once (default $CONCURRENCY)")
+	fs.IntVar(&MaxConcurrentBatches, "batch-concurrency", MaxConcurrentBatches, "rule batches pushed at once across all profiles, 0 for one per concurrent profile (default $BATCH_CONCURRENCY)")
+	fs.IntVar(&BatchSize, "batch-size", BatchSize, "rules per request (default $BATCH_SIZE)")
+	fs.IntVar(&MaxRetries, "max-retries", MaxRetries, "attempts per request (default $MAX_RETRIES)")
+	fs.DurationVar(&RetryDelay, "retry-delay", RetryDelay, "backoff before the first retry, doubled on each attempt (default $RETRY_DELAY)")
+	fs.DurationVar(&HTTPTimeout, "http-timeout", HTTPTimeout, "timeout of a single HTTP request (default $HTTP_TIMEOUT)")
+	chaos := fs.Float64("chaos", envChaosRate(), "")
+	hideFlag(fs, "chaos")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	token = getenv("TOKEN")
+	selection.List = getenv("PROFILE")
+	if fs.NArg() > 0 {
+		selection.List = strings.Join(fs.Args(), ",")
+	}
+	selection.Exclude = splitList(*excludeProfiles)
+	selection.Tags = splitList(*tags)
+
+	var err error
+	if selection.Names, err = parseFolderPatterns(*profileNames); err != nil {
+		return nil, fmt.Errorf("Invalid --profile-names: %v", err)
+	}
+	if actionRemap, err = parseRemap(*remap); err != nil {
+		return nil, fmt.Errorf("Invalid --remap: %v", err)
+	}
+	if dedupNormalization, err = parseDedupNormalization(*dedupNormalize); err != nil {
+		return nil, fmt.Errorf("Invalid --dedup-normalize: %v", err)
+	}
+	if folderFilter, err = parseFolderFilter(*includeFolders, *excludeFolders); err != nil {
+		return nil, fmt.Errorf("Invalid folder filter: %v", err)
+	}
+	if MaxConcurrentProfiles < 1 || BatchSize < 1 || MaxRetries < 1 || RetryDelay < 0 || HTTPTimeout <= 0 {
+		return nil, errors.New("--concurrency, --batch-size, --max-retries and --http-timeout must be positive")
+	}
+	if MaxConcurrentBatches < 0 {
+		return nil, errors.New("--batch-concurrency must not be negative")
+	}
+	setBatchConcurrency()
+
+	// Dry runs change nothing, so only real syncs and deletes are held to the window
+	window, err := parseTimeWindow(*onlyBetween)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid --only-between: %v", err)
+	}
+	if window != nil && !dryRun {
+		if wait := window.untilOpen(time.Now()); wait > 0 {
+			if !*waitForWindow {
+				return nil, fmt.Errorf("Outside the maintenance window %s; refusing to change profiles (use --wait-for-window to wait, or --dry-run)", window)
+			}
+			logger.Printf("Outside the maintenance window %s; waiting %v for it to open", window, wait.Round(time.Minute))
+			time.Sleep(wait)
+		}
+	}
+
+	if token == "" || (selection.List == "" && selection.File == "" && !selection.All && len(selection.Tags) == 0 && len(selection.Names) == 0 && !*interactive) {
+		return nil, errors.New("TOKEN and PROFILE (or --profiles-file / --all-profiles / --profile-names / --tags / --interactive) are required")
+	}
+
+	if *fromStdin {
+		if *fromBundle != "" || *interactive {
+			return nil, errors.New("--stdin can't be used with --from-bundle or --interactive")
+		}
+		if strings.TrimSpace(*stdinFolder) == "" {
+			return nil, errors.New("--stdin needs --folder with the folder name")
+		}
+		n, err := loadStdinSource(*stdinFolder)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read standard input: %v", err)
+		}
+		logger.Printf("Read %d domains from standard input for folder '%s'", n, *stdinFolder)
+
+		overridesFile := overridesFilePath()
+		if folderOverrides, err = loadOverrides(overridesFile); err != nil {
+			return nil, fmt.Errorf("Failed to load %s: %v", overridesFile, err)
+		}
+	} else if *fromBundle != "" {
+		b, err := loadBundle(*fromBundle)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load bundle: %v", err)
+		}
+		applyBundle(b)
+		logger.Printf("Applying bundle %s from %s: %d lists, %d sources, nothing is fetched", *fromBundle, b.Created.Format("2006-01-02 15:04"), len(b.Lists), len(b.Sources))
+	} else {
+		FolderURLs, err = loadLists()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load %s: %v", listsOrigin(), err)
+		}
+		if len(FolderURLs) == 0 {
+			return nil, fmt.Errorf("%s has no valid list URLs", listsOrigin())
+		}
+		logger.Printf("Loaded %d lists from %s", len(FolderURLs), listsOrigin())
+
+		overridesFile := overridesFilePath()
+		if folderOverrides, err = loadOverrides(overridesFile); err != nil {
+			return nil, fmt.Errorf("Failed to load %s: %v", overridesFile, err)
+		}
+
+		tagsFile := getenv("TAGS_FILE")
+		if tagsFile == "" {
+			tagsFile = DefaultTagsFile
+		}
+		if profileTagMap, err = loadProfileTags(tagsFile); err != nil {
+			return nil, fmt.Errorf("Failed to load %s: %v", tagsFile, err)
+		}
+	}
+
+	if *only != "" {
+		if !dryRun {
+			return nil, errors.New("--only previews lists and needs --dry-run; use --include to sync a subset of folders")
+		}
+		if onlyLists, err = resolveOnlyLists(splitList(*only)); err != nil {
+			return nil, fmt.Errorf("Invalid --only: %v", err)
+		}
+	}
+
+	if err := loadState(stateFilePath()); err != nil {
+		warnf("could not load state, starting fresh: %v", err)
+	}
+	if p := currentPause(); p != nil && !dryRun {
+		logger.Printf("Syncs are %s; nothing to do (run \"ctrld-hagezi-sync resume\" to lift it)", p)
+		return nil, ErrPaused
+	}
+
+	if v := getenv("DEDUP_INDEX_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid DEDUP_INDEX_MAX_AGE %q: %v", v, err)
+		}
+		dedupIndexMaxAge = d
+	}
+
+	lockBackend = getenv("LOCK")
+	if ttl := getenv("LOCK_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err == nil && d <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid LOCK_TTL %q: %v", ttl, err)
+		}
+		lockTTL = d
+	}
+
+	if v := getenv("ANOMALY_SIGMA"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			return nil, fmt.Errorf("Invalid ANOMALY_SIGMA %q", v)
+		}
+		anomalySigma = f
+	}
+
+	if v := getenv("REJECT_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid REJECT_THRESHOLD %q", v)
+		}
+		rejectThreshold = n
+	}
+
+	if v := getenv("GH_DOWNLOAD_CONNECTIONS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid GH_DOWNLOAD_CONNECTIONS %q", v)
+		}
+		downloadConnections = n
+	}
+
+	if err := initClients(); err != nil {
+		return nil, fmt.Errorf("Failed to set up HTTP clients: %v", err)
+	}
+	if proxies := describeProxies(); proxies != "" {
+		logger.Printf("Using proxy %s", proxies)
+	}
+
+	if *chaos > 0 {
+		if err := enableChaos(*chaos); err != nil {
+			return nil, fmt.Errorf("Chaos mode: %v", err)
+		}
+	}
+
+	// The picked profiles replace PROFILE and the other selectors; exclusions still apply
+	if *interactive {
+		ids, err := pickProfiles(os.Stdin, os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("Profile selection: %v", err)
+		}
+		selection = ProfileSelection{List: strings.Join(ids, ","), Exclude: selection.Exclude}
+	}
+
+	if allowlistCheckSample > 0 {
+		resolver := getenv("CHECK_RESOLVER")
+		if resolver == "" {
+			resolver = DefaultCheckResolver
+		}
+		setCheckResolver(resolver)
+	}
+
+	if err := loadStaging(); err != nil {
+		return nil, fmt.Errorf("Invalid STAGING: %v", err)
+	}
+
+	if alertThresholds, err = loadAlertThresholds(); err != nil {
+		return nil, fmt.Errorf("Invalid alert threshold: %v", err)
+	}
+
+	if path := getenv("SUMMARY_TEMPLATE"); path != "" {
+		if summaryTemplate, err = loadSummaryTemplate(path); err != nil {
+			return nil, fmt.Errorf("Failed to load summary template: %v", err)
+		}
+	}
+	return run, nil
+}
+
+// Sync, delete or plan every selected profile and finish the run: report, hooks, webhook, metrics and state.
+// Once ctx is done no more profiles are started. A run in which some profiles failed returns its
+// result along with ErrProfilesFailed.
+func (run *syncRun) execute(ctx context.Context) (*Result, error) {
+	deleteOnly := run.deleteOnly
+	if err := openEvents(run.eventsFile, run.eventsFD); err != nil {
+		return nil, fmt.Errorf("Failed to open event stream: %v", err)
+	}
+	defer closeEvents()
+
+	// Use goroutines for concurrent profile syncing with semaphore to limit concurrency
+	runStarted := time.Now()
+	if run.maxDuration > 0 {
+		runDeadline = runStarted.Add(run.maxDuration)
+	}
+	semaphore := make(chan struct{}, MaxConcurrentProfiles)
+	var wg sync.WaitGroup
+	var successCount, lockedCount int32
+	var resultsMu sync.Mutex
+	var allResults []ProfileResult
+
+	if deleteOnly {
+		logger.Printf("Delete mode: removing synced folders (max %d concurrent)", MaxConcurrentProfiles)
+	} else {
+		logger.Printf("Starting concurrent sync (max %d concurrent)", MaxConcurrentProfiles)
+	}
+
+	mode := "sync"
+	if deleteOnly {
+		mode = "delete"
+	}
+	if dryRun {
+		mode += "-dry-run"
+	}
+	logger.Printf("Run %s starting", runID)
+	emitEvent("run_started", map[string]interface{}{
+		"run_id":         runID,
+		"mode":           mode,
+		"max_concurrent": MaxConcurrentProfiles,
+		"lists":          len(FolderURLs),
+	})
+	stopHeartbeat := startHeartbeat(run.heartbeat)
+	defer stopHeartbeat()
+
+	hooks = loadHooks()
+	if dryRun {
+		hooks = Hooks{}
+	}
+	if err := runHook("pre-sync", hooks.PreSync, map[string]string{"mode": mode}); err != nil {
+		return nil, fmt.Errorf("Aborting run: %v", err)
+	}
+	deferWarnings.Store(true)
+
+	// Process one profile, returning whether it succeeded
+	process := func(id string, canary bool) bool {
+		if dryRun {
+			result := planProfile(id, deleteOnly)
+			emitProfileResult("profile_planned", result)
+			resultsMu.Lock()
+			allResults = append(allResults, result)
+			resultsMu.Unlock()
+			return result.Success
+		}
+		if deleteOnly {
+			result := runProfileDelete(id)
+			resultsMu.Lock()
+			allResults = append(allResults, result)
+			resultsMu.Unlock()
+			if result.Skipped != "" {
+				atomic.AddInt32(&lockedCount, 1)
+			}
+			return result.Success
+		}
+
+		if isStagingProfile(id) {
+			logger.Printf("Profile %s: synced as a staging profile, skipping direct sync", maskID(id))
+			return true
+		}
+
+		results := syncWithStaging(id)
+		resultsMu.Lock()
+		allResults = append(allResults, results...)
+		resultsMu.Unlock()
+
+		// The last result is the profile itself; staging results come first
+		last := results[len(results)-1]
+		if last.Skipped != "" {
+			atomic.AddInt32(&lockedCount, 1)
+			if canary {
+				logger.Printf("Profile %s: canary is locked by another instance and can't be verified", maskID(id))
+			}
+			return false
+		}
+		if !last.Success || !canary {
+			return last.Success
+		}
+
+		// Canary profiles are also verified before the rollout continues
+		if err := verifyProfile(id, last); err != nil {
+			logger.Printf("Profile %s: canary verification failed: %v", maskID(id), err)
+			return false
+		}
+		return true
+	}
+
+	// Acquire the semaphore before starting each goroutine so large profile lists stay bounded
+	total := 0
+	profiles := streamProfiles(selection)
+	for profileID := range profiles {
+		total++
+
+		// Profiles not started when the run is cancelled count as failed
+		if ctx.Err() != nil {
+			logger.Printf("Run cancelled, not starting profile %s or the remaining profiles", maskID(profileID))
+			for range profiles {
+				total++
+			}
+			break
+		}
+
+		// Canary profiles run one at a time; any failure stops the rollout
+		if !deleteOnly && total <= canaryCount {
+			logger.Printf("Canary %d/%d: profile %s", total, canaryCount, maskID(profileID))
+			if !process(profileID, true) {
+				logger.Printf("Canary profile %s failed, not continuing to the remaining profiles", maskID(profileID))
+				for range profiles {
+					total++
+				}
+				break
+			}
+			atomic.AddInt32(&successCount, 1)
+			continue
+		}
+
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			defer func() { <-semaphore }() // Release semaphore
+
+			if process(id, false) {
+				atomic.AddInt32(&successCount, 1)
+			}
+		}(profileID)
+	}
+
+	// Wait for all goroutines to complete
+	wg.Wait()
+
+	res := &Result{
+		RunID:     runID,
+		DryRun:    dryRun,
+		Profiles:  allResults,
+		Succeeded: int(atomic.LoadInt32(&successCount)),
+		Skipped:   int(atomic.LoadInt32(&lockedCount)),
+	}
+
+	if dryRun {
+		if path := getenv("RULES_REPORT_FILE"); path != "" {
+			if err := writeRulesReport(path); err != nil {
+				warnf("could not write rules report: %v", err)
+			}
+		}
+		logWarnings()
+		logger.Printf("Dry run complete: %d profiles planned, nothing was changed", total)
+		res.Duration = time.Since(runStarted)
+		emitEvent("run_finished", map[string]interface{}{
+			"profiles":  total,
+			"succeeded": res.Succeeded,
+			"skipped":   0,
+			"duration":  res.Duration.Round(time.Second).Seconds(),
+		})
+		return res, runError(ctx, res, total)
+	}
+
+	report := buildReport(runStarted, allResults)
+	logger.Printf("API budget: %s", report.API)
+	if !deleteOnly {
+		checkAlerts(&report, alertThresholds)
+	}
+	report.Warnings = collectedWarnings()
+	if !deleteOnly {
+		writeSummary(report)
+		recordHistory(report)
+	}
+	if err := runHook("post-sync", hooks.PostSync, report); err != nil {
+		warnf("%v", err)
+	}
+	if err := sendReportWebhook(report); err != nil {
+		warnf("%v", err)
+	}
+	if !deleteOnly {
+		if err := sendMetrics(report); err != nil {
+			warnf("%v", err)
+		}
+	}
+
+	if err := saveState(); err != nil {
+		warnf("could not save state: %v", err)
+	}
+
+	if path := getenv("UPSTREAM_DIFF_FILE"); path != "" {
+		if err := writeUpstreamDiffFile(path); err != nil {
+			warnf("could not write upstream diff: %v", err)
+		}
+	}
+
+	if path := getenv("RULES_REPORT_FILE"); path != "" {
+		if err := writeRulesReport(path); err != nil {
+			warnf("could not write rules report: %v", err)
+		}
+	}
+
+	if path := getenv("IP_REPORT_FILE"); path != "" {
+		if err := writeIPReport(path); err != nil {
+			warnf("could not write IP report: %v", err)
+		}
+	}
+
+	stopHeartbeat()
+	logWarnings()
+
+	if total == 0 {
+		return nil, errors.New("No valid profile IDs found")
+	}
+
+	if res.Skipped > 0 {
+		logger.Printf("All profiles processed: %d/%d successful, %d skipped (locked by another instance)", res.Succeeded, total, res.Skipped)
+	} else {
+		logger.Printf("All profiles processed: %d/%d successful", res.Succeeded, total)
+	}
+
+	res.Duration = time.Since(runStarted)
+	res.Report = &report
+	emitEvent("run_finished", map[string]interface{}{
+		"profiles":  total,
+		"succeeded": res.Succeeded,
+		"skipped":   res.Skipped,
+		"duration":  res.Duration.Round(time.Second).Seconds(),
+	})
+	return res, runError(ctx, res, total)
+}
+
+// Error for a finished run: the context's when it was cancelled, ErrProfilesFailed when a profile
+// failed; profiles another instance is syncing don't fail the run
+func runError(ctx context.Context, res *Result, total int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if res.Succeeded+res.Skipped != total {
+		return ErrProfilesFailed
+	}
+	return nil
+}
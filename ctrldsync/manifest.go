@@ -0,0 +1,145 @@
+package ctrldsync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ManifestFolderName is the disabled folder holding the sync manifest
+const (
+	ManifestFolderName = "ctrld-sync manifest"
+	manifestSuffix     = ".manifest.ctrld-sync"
+)
+
+// Version is set at build time with -ldflags "-X ctrld-hagezi-sync/ctrldsync.Version=..."
+var Version = "dev"
+
+// Sync manifest stored in each profile
+type Manifest struct {
+	Hash    string
+	Time    time.Time
+	Version string
+}
+
+// Hash the folders and rules applied in a run
+func manifestHash(folders []FolderData) string {
+	var names []string
+	rulesByName := make(map[string][]string)
+	for _, folder := range folders {
+		name := strings.TrimSpace(folder.Group.Group)
+		names = append(names, name)
+		for _, rule := range folder.Rules {
+			rulesByName[name] = append(rulesByName[name], rule.PK)
+		}
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		rules := rulesByName[name]
+		sort.Strings(rules)
+		fmt.Fprintf(h, "%s\n%s\n", name, strings.Join(rules, "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// Encode a manifest as a rule hostname: <hash>.<unix time>.<version>.manifest.ctrld-sync
+func (m Manifest) encode() string {
+	version := strings.NewReplacer(".", "-", "+", "-", "/", "-").Replace(m.Version)
+	return fmt.Sprintf("%s.%d.%s%s", m.Hash, m.Time.Unix(), version, manifestSuffix)
+}
+
+// Decode a manifest rule hostname
+func decodeManifest(hostname string) (Manifest, bool) {
+	if !strings.HasSuffix(hostname, manifestSuffix) {
+		return Manifest{}, false
+	}
+	parts := strings.SplitN(strings.TrimSuffix(hostname, manifestSuffix), ".", 3)
+	if len(parts) != 3 {
+		return Manifest{}, false
+	}
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Manifest{}, false
+	}
+	return Manifest{Hash: parts[0], Time: time.Unix(ts, 0).UTC(), Version: parts[2]}, true
+}
+
+// Read the manifest from a profile, if one has been written
+func readManifest(profileID string, existingFolders map[string]string) (Manifest, bool) {
+	folderID, exists := existingFolders[ManifestFolderName]
+	if !exists {
+		return Manifest{}, false
+	}
+
+	endpoint := fmt.Sprintf("%s/%s/rules/%s", APIBase, profileID, folderID)
+	resp, err := apiGet(endpoint)
+	if err != nil {
+		warnf("Failed to read sync manifest: %v", err)
+		return Manifest{}, false
+	}
+	defer resp.Body.Close()
+
+	var apiResp APIRulesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		warnf("Failed to decode sync manifest: %v", err)
+		return Manifest{}, false
+	}
+
+	for _, rule := range apiResp.Body.Rules {
+		if m, ok := decodeManifest(rule.PK); ok {
+			return m, true
+		}
+	}
+	return Manifest{}, false
+}
+
+// Log when and by what version a profile was last synced
+func logManifest(profileID string, existingFolders map[string]string) {
+	m, ok := readManifest(profileID, existingFolders)
+	if !ok {
+		logger.Printf("Profile %s: no sync manifest found", maskID(profileID))
+		return
+	}
+	logger.Printf("Profile %s: last synced %s by version %s (manifest %s)", maskID(profileID), m.Time.Format(time.RFC3339), m.Version, m.Hash)
+}
+
+// Replace the manifest folder in a profile with one describing this run
+func writeManifest(profileID string, folders []FolderData) error {
+	existingFolders, err := listExistingFolders(profileID)
+	if err != nil {
+		return err
+	}
+	if folderID, exists := existingFolders[ManifestFolderName]; exists {
+		deleteFolder(profileID, ManifestFolderName, folderID)
+	}
+
+	// Disabled so the marker rule never affects resolution
+	folderID, err := createFolder(profileID, ManifestFolderName, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	m := Manifest{Hash: manifestHash(folders), Time: time.Now().UTC(), Version: Version}
+	data := map[string]string{
+		"do":           "0",
+		"status":       "0",
+		"group":        folderID,
+		"hostnames[0]": m.encode(),
+	}
+	endpoint := fmt.Sprintf("%s/%s/rules", APIBase, profileID)
+	resp, err := apiPostForm(endpoint, data)
+	if err != nil {
+		return fmt.Errorf("failed to write sync manifest: %w", err)
+	}
+	resp.Body.Close()
+
+	logger.Printf("Profile %s: wrote sync manifest %s", maskID(profileID), m.Hash)
+	return nil
+}
@@ -0,0 +1,99 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Combine folders of the same name into one, so several lists can share a folder, e.g.
+// every native tracker list in "Native Trackers". The first source sets the action;
+// rules are deduplicated in source order.
+func mergeFolders(folders []FolderData) []FolderData {
+	index := make(map[string]int)
+	var merged []FolderData
+	for _, data := range folders {
+		key := strings.ToLower(strings.TrimSpace(data.Group.Group))
+		i, exists := index[key]
+		if !exists {
+			index[key] = len(merged)
+			merged = append(merged, data)
+			continue
+		}
+
+		into := &merged[i]
+		name := strings.TrimSpace(into.Group.Group)
+		if into.Group.Action != data.Group.Action {
+			warnf("folder '%s': %s (%s) merged into a %s folder; the first source sets the action",
+				name, listShortName(data.Source), actionStatusLabel(data.Group.Action), actionStatusLabel(into.Group.Action))
+		}
+
+		if len(into.Merged) == 0 {
+			// Copy before appending, as the first folder's rules are shared with the fetch cache
+			into.Rules = append([]Rule(nil), into.Rules...)
+			into.IPEntries = append([]string(nil), into.IPEntries...)
+		}
+		seen := make(map[string]bool, len(into.Rules))
+		for _, r := range into.Rules {
+			seen[strings.ToLower(r.PK)] = true
+		}
+		added := 0
+		for _, r := range data.Rules {
+			if key := strings.ToLower(r.PK); r.PK != "" && !seen[key] {
+				seen[key] = true
+				into.Rules = append(into.Rules, r)
+				added++
+			}
+		}
+		into.IPEntries = append(into.IPEntries, data.IPEntries...)
+		into.Merged = append(into.Merged, data.sources()...)
+		into.Version = fmt.Sprintf("%s+%s", into.Version, data.Version)
+		into.CarriedOver = into.CarriedOver || data.CarriedOver
+		if into.Release == "" {
+			into.Release = data.Release
+		}
+		if data.Priority > into.Priority {
+			into.Priority = data.Priority
+		}
+		logger.Printf("Folder '%s': merged in %s (%d new rules, %d already in the folder)", name, listShortName(data.Source), added, len(data.Rules)-added)
+	}
+
+	for i := range merged {
+		if len(merged[i].Merged) > 0 {
+			checkWildcards(&merged[i])
+		}
+	}
+	return merged
+}
+
+// Every source a folder was built from
+func (d FolderData) sources() []string {
+	return append([]string{d.Source}, d.Merged...)
+}
+
+// Folder a source that couldn't be fetched fills: its name option, or the folder it made last run
+func unfetchedFolderName(profileID, src string) string {
+	_, opts := splitSource(src)
+	if name := strings.TrimSpace(opts.Get("name")); name != "" {
+		return name
+	}
+	ps, _ := getProfileState(profileID)
+	for name, f := range ps.Folders {
+		if f.Source == src {
+			return name
+		}
+	}
+	return ""
+}
+
+// Leave out folders that are missing one of their sources, so a merged folder isn't recreated with part of its rules
+func dropIncomplete(folders []FolderData, unfetched map[string]bool) (kept []FolderData, incomplete []string) {
+	for _, data := range folders {
+		name := strings.TrimSpace(data.Group.Group)
+		if unfetched[strings.ToLower(name)] {
+			incomplete = append(incomplete, name)
+			continue
+		}
+		kept = append(kept, data)
+	}
+	return kept, incomplete
+}
@@ -0,0 +1,107 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Default prefix of emitted metric names
+const DefaultMetricsPrefix = "ctrld_sync"
+
+// One measurement with optional tags
+type metric struct {
+	name  string
+	value float64
+	kind  string // "g" gauge or "ms" timing, StatsD style
+	tags  map[string]string
+}
+
+var metricNameUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// Measurements describing a finished run
+func runMetrics(report RunReport) []metric {
+	var rules, duplicates int
+	var metrics []metric
+	for _, p := range report.Profiles {
+		for _, f := range p.Folders {
+			rules += f.Rules
+			duplicates += f.Duplicates
+			tags := map[string]string{"profile": maskID(p.ProfileID), "folder": f.Name}
+			metrics = append(metrics, metric{name: "folder_rules", value: float64(f.Rules), kind: "g", tags: tags})
+		}
+	}
+	return append(metrics,
+		metric{name: "run_duration", value: float64(report.Duration / time.Millisecond), kind: "ms"},
+		metric{name: "profiles_succeeded", value: float64(report.Succeeded), kind: "g"},
+		metric{name: "profiles_failed", value: float64(report.Failed), kind: "g"},
+		metric{name: "rules_pushed", value: float64(rules), kind: "g"},
+		metric{name: "duplicates_skipped", value: float64(duplicates), kind: "g"},
+	)
+}
+
+// StatsD lines; tags are folded into the metric name since plain StatsD has none
+func formatStatsD(prefix string, m metric) string {
+	name := prefix + "." + m.name
+	if folder, ok := m.tags["folder"]; ok {
+		name += "." + strings.ToLower(metricNameUnsafe.ReplaceAllString(m.tags["profile"]+"_"+folder, "_"))
+	}
+	return fmt.Sprintf("%s:%g|%s", name, m.value, m.kind)
+}
+
+// InfluxDB line protocol
+func formatInflux(prefix string, m metric, ts time.Time) string {
+	var b strings.Builder
+	b.WriteString(prefix + "_" + m.name)
+	for _, k := range []string{"profile", "folder"} {
+		if v, ok := m.tags[k]; ok {
+			escaped := strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(v)
+			fmt.Fprintf(&b, ",%s=%s", k, escaped)
+		}
+	}
+	fmt.Fprintf(&b, " value=%g %d", m.value, ts.UnixNano())
+	return b.String()
+}
+
+// Send run metrics to METRICS_ADDR: statsd://host:port or influx://host:port (UDP line protocol)
+func sendMetrics(report RunReport) error {
+	addr := getenv("METRICS_ADDR")
+	if addr == "" {
+		return nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid METRICS_ADDR %q", addr)
+	}
+	prefix := getenv("METRICS_PREFIX")
+	if prefix == "" {
+		prefix = DefaultMetricsPrefix
+	}
+
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return fmt.Errorf("failed to reach metrics endpoint: %w", err)
+	}
+	defer conn.Close()
+
+	now := time.Now()
+	for _, m := range runMetrics(report) {
+		var line string
+		switch u.Scheme {
+		case "statsd":
+			line = formatStatsD(prefix, m)
+		case "influx":
+			line = formatInflux(prefix, m, now)
+		default:
+			return fmt.Errorf("unsupported metrics scheme %q (want statsd or influx)", u.Scheme)
+		}
+		// One datagram per line keeps each packet well under the MTU
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			return fmt.Errorf("failed to send metrics: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package ctrldsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// In-memory stand-in for the Control D profiles API, plus generated lists to sync from
+type mockAPI struct {
+	mu       sync.Mutex
+	profiles map[string]*mockProfile
+	order    []string
+	nextPK   int
+
+	// Lists served under /lists/<n>.txt: lists[n] domains each
+	lists   int
+	rules   int
+	latency time.Duration
+
+	requests atomic.Int64
+	pushed   atomic.Int64
+}
+
+type mockProfile struct {
+	name   string
+	groups map[string]*mockGroup // by PK
+	rules  map[string]string     // hostname -> group PK, "" for the root folder
+}
+
+type mockGroup struct {
+	name   string
+	do     int
+	status int
+}
+
+func newMockAPI(profiles, lists, rules int, latency time.Duration) *mockAPI {
+	m := &mockAPI{profiles: make(map[string]*mockProfile), lists: lists, rules: rules, latency: latency}
+	for i := 1; i <= profiles; i++ {
+		pk := fmt.Sprintf("stress%03d", i)
+		m.profiles[pk] = &mockProfile{name: fmt.Sprintf("Stress %d", i), groups: make(map[string]*mockGroup), rules: make(map[string]string)}
+		m.order = append(m.order, pk)
+	}
+	return m
+}
+
+// Serve on a free local port; returns the base URL
+func (m *mockAPI) start() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go http.Serve(ln, m)
+	return "http://" + ln.Addr().String(), nil
+}
+
+// URL of each generated list
+func (m *mockAPI) listURLs(base string) []string {
+	urls := make([]string, m.lists)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("%s/lists/stress-%d.txt", base, i+1)
+	}
+	return urls
+}
+
+func (m *mockAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.requests.Add(1)
+	if m.latency > 0 {
+		time.Sleep(m.latency)
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] == "lists" && len(parts) == 2 {
+		m.serveList(w, parts[1])
+		return
+	}
+	if parts[0] != "profiles" {
+		http.NotFound(w, r)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(parts) == 1 && r.Method == "GET" {
+		var profiles []APIProfile
+		for _, pk := range m.order {
+			profiles = append(profiles, APIProfile{PK: pk, Name: m.profiles[pk].name})
+		}
+		mockReply(w, map[string]interface{}{"profiles": profiles})
+		return
+	}
+
+	p, ok := m.profiles[parts[1]]
+	if !ok || len(parts) < 3 {
+		mockError(w, http.StatusNotFound, "profile not found")
+		return
+	}
+
+	switch {
+	case parts[2] == "groups" && len(parts) == 3 && r.Method == "GET":
+		mockReply(w, map[string]interface{}{"groups": p.apiGroups()})
+
+	case parts[2] == "groups" && len(parts) == 3 && r.Method == "POST":
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req["name"]) == "" {
+			mockError(w, http.StatusBadRequest, "invalid folder")
+			return
+		}
+		do, _ := strconv.Atoi(req["do"])
+		status, _ := strconv.Atoi(req["status"])
+		m.nextPK++
+		p.groups[strconv.Itoa(m.nextPK)] = &mockGroup{name: req["name"], do: do, status: status}
+		mockReply(w, map[string]interface{}{"groups": p.apiGroups()})
+
+	case parts[2] == "groups" && len(parts) == 4 && r.Method == "DELETE":
+		if _, ok := p.groups[parts[3]]; !ok {
+			mockError(w, http.StatusNotFound, "folder not found")
+			return
+		}
+		delete(p.groups, parts[3])
+		for h, g := range p.rules {
+			if g == parts[3] {
+				delete(p.rules, h)
+			}
+		}
+		mockReply(w, map[string]interface{}{})
+
+	case parts[2] == "rules" && r.Method == "GET":
+		group := ""
+		if len(parts) == 4 {
+			group = parts[3]
+		}
+		mockReply(w, map[string]interface{}{"rules": p.apiRules(group)})
+
+	case parts[2] == "rules" && len(parts) == 3 && r.Method == "POST":
+		if err := r.ParseForm(); err != nil {
+			mockError(w, http.StatusBadRequest, "invalid form")
+			return
+		}
+		group := r.PostForm.Get("group")
+		if _, ok := p.groups[group]; group != "" && !ok {
+			mockError(w, http.StatusBadRequest, "folder not found")
+			return
+		}
+		n := 0
+		for i := 0; ; i++ {
+			h := r.PostForm.Get(fmt.Sprintf("hostnames[%d]", i))
+			if h == "" {
+				break
+			}
+			p.rules[h] = group
+			n++
+		}
+		m.pushed.Add(int64(n))
+		mockReply(w, map[string]interface{}{})
+
+	default:
+		mockError(w, http.StatusNotFound, "unknown endpoint")
+	}
+}
+
+// A generated list: n unique domains, one per line
+func (m *mockAPI) serveList(w http.ResponseWriter, file string) {
+	var n int
+	if _, err := fmt.Sscanf(file, "stress-%d.txt", &n); err != nil || n < 1 || n > m.lists {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	for i := 0; i < m.rules; i++ {
+		fmt.Fprintf(w, "host%d.list%d.stress.test\n", i, n)
+	}
+}
+
+func (p *mockProfile) apiGroups() []APIGroup {
+	counts := make(map[string]int)
+	for _, g := range p.rules {
+		counts[g]++
+	}
+	groups := make([]APIGroup, 0, len(p.groups))
+	for pk, g := range p.groups {
+		groups = append(groups, APIGroup{Group: g.name, PK: pk, Action: Action{Do: g.do, Status: g.status}, Count: counts[pk]})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Group < groups[j].Group })
+	return groups
+}
+
+func (p *mockProfile) apiRules(group string) []Rule {
+	var rules []Rule
+	for h, g := range p.rules {
+		if g == group {
+			rules = append(rules, Rule{PK: h})
+		}
+	}
+	return rules
+}
+
+// Folders of a profile by name with their rule counts, as the mock holds them now
+func (m *mockAPI) folderCounts(profileID string) map[string][]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	folders := make(map[string][]int)
+	for _, g := range m.profiles[profileID].apiGroups() {
+		folders[g.Group] = append(folders[g.Group], g.Count)
+	}
+	return folders
+}
+
+func mockReply(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "body": body})
+}
+
+func mockError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": map[string]string{"message": msg}})
+}
@@ -0,0 +1,81 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// Which differences the duplicate check ignores
+type DedupNormalization struct {
+	Case     bool // Example.com == example.com
+	Dot      bool // example.com. == example.com
+	Punycode bool // bücher.de == xn--bcher-kva.de
+}
+
+var dedupNormalization DedupNormalization
+
+// Parse DEDUP_NORMALIZE: a comma-separated list of case, dot and punycode, or all / none
+func parseDedupNormalization(s string) (DedupNormalization, error) {
+	var n DedupNormalization
+	for _, opt := range splitList(s) {
+		switch strings.ToLower(opt) {
+		case "case":
+			n.Case = true
+		case "dot":
+			n.Dot = true
+		case "punycode":
+			n.Punycode = true
+		case "all":
+			n = DedupNormalization{Case: true, Dot: true, Punycode: true}
+		case "none":
+			n = DedupNormalization{}
+		default:
+			return n, fmt.Errorf("unknown option %q (want case, dot, punycode, all or none)", opt)
+		}
+	}
+	return n, nil
+}
+
+// Key a hostname is compared by when checking for duplicates
+func dedupKey(hostname string) string {
+	n := dedupNormalization
+	if n.Dot {
+		hostname = strings.TrimSuffix(hostname, ".")
+	}
+	if n.Case {
+		hostname = strings.ToLower(hostname)
+	}
+	if n.Punycode && !isASCII(hostname) {
+		hostname = idnaKey(hostname)
+	}
+	return hostname
+}
+
+// IDNA mapping and validation for lookups (UTS #46), allowing the underscores blocklists often have
+var idnaProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+// ASCII form of an internationalized hostname; a name that isn't a valid IDN is kept as it is.
+// A leading "*." is left out of the conversion.
+func idnaKey(hostname string) string {
+	rest, wildcard := strings.CutPrefix(hostname, "*.")
+	ascii, err := idnaProfile.ToASCII(rest)
+	if err != nil {
+		return hostname
+	}
+	if wildcard {
+		return "*." + ascii
+	}
+	return ascii
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,390 @@
+package ctrldsync
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Object storage providers a source URL can point at
+const (
+	storeS3    = "s3"
+	storeGCS   = "gs"
+	storeAzure = "az"
+)
+
+// Provider of every object storage URL handed to the downloader, keyed by scheme, host and path
+var objectURLs sync.Map
+
+func objectKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+// Translate s3://bucket/key, gs://bucket/object or az://account/container/blob into the HTTPS URL to download;
+// false for any other source
+func objectStoreURL(src string) (string, bool, error) {
+	scheme, rest, ok := strings.Cut(src, "://")
+	if !ok || (scheme != storeS3 && scheme != storeGCS && scheme != storeAzure) {
+		return "", false, nil
+	}
+	bucket, object, _ := strings.Cut(rest, "/")
+	if bucket == "" || object == "" {
+		return "", true, fmt.Errorf("expected %s://<bucket>/<object>", scheme)
+	}
+
+	var target string
+	switch scheme {
+	case storeS3:
+		if endpoint := getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+			// S3-compatible stores (MinIO, R2, ...) are addressed by path
+			target = strings.TrimSuffix(endpoint, "/") + "/" + bucket + "/" + object
+		} else if strings.Contains(bucket, ".") {
+			// A dotted bucket name as a subdomain doesn't match the *.s3 wildcard certificate
+			target = fmt.Sprintf("https://s3.%s.amazonaws.com/%s/%s", awsRegion(), bucket, object)
+		} else {
+			target = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, awsRegion(), object)
+		}
+	case storeGCS:
+		target = "https://storage.googleapis.com/" + bucket + "/" + object
+	case storeAzure:
+		container, blob, _ := strings.Cut(object, "/")
+		if blob == "" {
+			return "", true, fmt.Errorf("expected az://<account>/<container>/<blob>")
+		}
+		target = fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", bucket, container, blob)
+		if sas := strings.TrimPrefix(getenv("AZURE_STORAGE_SAS_TOKEN"), "?"); sas != "" {
+			target += "?" + sas
+		}
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", true, err
+	}
+	objectURLs.Store(objectKey(u), scheme)
+	return target, true, nil
+}
+
+func awsRegion() string {
+	for _, env := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if r := getenv(env); r != "" {
+			return r
+		}
+	}
+	return "us-east-1"
+}
+
+// Signs requests for object storage sources with the credentials in the environment; other requests pass through
+type objectStoreTransport struct {
+	next http.RoundTripper
+
+	mu          sync.Mutex
+	gcsToken    string
+	gcsTokenExp time.Time
+	gcsNoServer bool // metadata server unreachable: not on Google Cloud, don't wait for it again
+}
+
+func (t *objectStoreTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	store, ok := objectURLs.Load(objectKey(req.URL))
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	var err error
+	switch store {
+	case storeS3:
+		signS3(req, time.Now().UTC())
+	case storeGCS:
+		err = t.authorizeGCS(req)
+	case storeAzure:
+		err = signAzure(req, time.Now().UTC())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// AWS Signature Version 4 with AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN; unsigned without keys
+func signS3(req *http.Request, now time.Time) {
+	accessKey, secretKey := getenv("AWS_ACCESS_KEY_ID"), getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return
+	}
+
+	emptyHash := hex.EncodeToString(sha256.New().Sum(nil))
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyHash)
+	if token := getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		awsEscapePath(req.URL.Path),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyHash,
+	}, "\n")
+
+	scope := date + "/" + awsRegion() + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	for _, part := range []string{awsRegion(), "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Percent-encode everything but unreserved characters and "/", as SigV4 expects
+func awsEscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func awsCanonicalQuery(q url.Values) string {
+	var pairs []string
+	for k, vs := range q {
+		for _, v := range vs {
+			pairs = append(pairs, strings.ReplaceAll(url.QueryEscape(k), "+", "%20")+"="+strings.ReplaceAll(url.QueryEscape(v), "+", "%20"))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// Bearer token from GOOGLE_OAUTH_ACCESS_TOKEN, the service account key in GOOGLE_APPLICATION_CREDENTIALS,
+// or the metadata server when running on Google Cloud
+func (t *objectStoreTransport) authorizeGCS(req *http.Request) error {
+	token := getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	if token == "" {
+		var err error
+		if token, err = t.gcsAccessToken(); err != nil {
+			return fmt.Errorf("Google Cloud Storage credentials: %w", err)
+		}
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+func (t *objectStoreTransport) gcsAccessToken() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.gcsToken != "" && time.Now().Before(t.gcsTokenExp) {
+		return t.gcsToken, nil
+	}
+	if t.gcsNoServer {
+		return "", nil
+	}
+
+	client := &http.Client{Transport: t.next, Timeout: 30 * time.Second}
+	var req *http.Request
+	if path := getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		var err error
+		if req, err = gcsServiceAccountRequest(path); err != nil {
+			return "", err
+		}
+	} else {
+		req, _ = http.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		client.Timeout = 3 * time.Second
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if req.URL.Host == "metadata.google.internal" {
+			// Not on Google Cloud and no key given: read public objects without a token
+			t.gcsNoServer = true
+			return "", nil
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request: HTTP %d", resp.StatusCode)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", fmt.Errorf("token response: %w", err)
+	}
+	t.gcsToken = tok.AccessToken
+	t.gcsTokenExp = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+	return t.gcsToken, nil
+}
+
+// Token request for a service account key file: a signed JWT exchanged for an access token
+func gcsServiceAccountRequest(path string) (*http.Request, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var key struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s: no private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: private key is not RSA", path)
+	}
+
+	now := time.Now().Unix()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/devstorage.read_only",
+		"aud":   key.TokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + enc.EncodeToString(sig)},
+	}
+	req, err := http.NewRequest("POST", key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// Azure Storage Shared Key authorization with AZURE_STORAGE_KEY; SAS tokens are already in the URL
+func signAzure(req *http.Request, now time.Time) error {
+	accountKey := getenv("AZURE_STORAGE_KEY")
+	if accountKey == "" || req.URL.Query().Get("sig") != "" {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(accountKey)
+	if err != nil {
+		return fmt.Errorf("AZURE_STORAGE_KEY: %w", err)
+	}
+	req.Header.Set("x-ms-date", now.Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", "2021-08-06")
+	account, _, _ := strings.Cut(req.URL.Host, ".")
+	req.Header.Set("Authorization", "SharedKey "+account+":"+azureSignature(req, account, key))
+	return nil
+}
+
+// Shared Key signature over the request's method, standard headers, x-ms-* headers and resource
+func azureSignature(req *http.Request, account string, key []byte) string {
+	var msHeaders []string
+	for name, values := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower+":"+strings.TrimSpace(strings.Join(values, ",")))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + account + req.URL.Path
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for k := range query {
+		params = append(params, k)
+	}
+	sort.Strings(params)
+	for _, k := range params {
+		resource += "\n" + strings.ToLower(k) + ":" + strings.Join(query[k], ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		"", // Content-Length, empty for a GET
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, replaced by x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(msHeaders, "\n"),
+		resource,
+	}, "\n")
+	return base64.StdEncoding.EncodeToString(hmacSHA256(key, stringToSign))
+}
@@ -0,0 +1,136 @@
+package ctrldsync
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultOverridesFile holds per-folder settings, one "<folder>[ @ <profile>]: key=value, ..." per line
+const DefaultOverridesFile = "overrides.txt"
+
+// Settings forced onto a folder regardless of its source
+type FolderOverride struct {
+	Folder   string `json:"folder"`
+	Profile  string `json:"profile,omitempty"` // ID or name; empty applies to every profile
+	Do       *int   `json:"do,omitempty"`
+	Status   *int   `json:"status,omitempty"`
+	Priority *int   `json:"priority,omitempty"`
+}
+
+var folderOverrides []FolderOverride
+
+// Overrides file path from OVERRIDES_FILE
+func overridesFilePath() string {
+	if path := getenv("OVERRIDES_FILE"); path != "" {
+		return path
+	}
+	return DefaultOverridesFile
+}
+
+// Load the overrides file; a missing file means no overrides
+func loadOverrides(filename string) ([]FolderOverride, error) {
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var overrides []FolderOverride
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		target, settings, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected \"<folder>: key=value\"", filename, lineNum)
+		}
+
+		o := FolderOverride{Folder: strings.TrimSpace(target)}
+		if folder, profile, ok := strings.Cut(target, "@"); ok {
+			o.Folder = strings.TrimSpace(folder)
+			o.Profile = strings.TrimSpace(profile)
+		}
+
+		for _, setting := range splitList(settings) {
+			key, value, _ := strings.Cut(setting, "=")
+			key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+			var n int
+			var err error
+			switch key {
+			case "do", "action":
+				n, err = parseAction(value)
+				o.Do = &n
+			case "status":
+				n, err = parseStatus(value)
+				o.Status = &n
+			case "priority":
+				if n, err = strconv.Atoi(value); err != nil {
+					err = fmt.Errorf("priority must be a number, got %q", value)
+				}
+				o.Priority = &n
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown setting %q", filename, lineNum, key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", filename, lineNum, err)
+			}
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, scanner.Err()
+}
+
+// Report whether an override applies to a folder in a profile
+func (o FolderOverride) matches(folder, profileID string) bool {
+	if !strings.EqualFold(o.Folder, folder) {
+		return false
+	}
+	if o.Profile == "" || o.Profile == profileID {
+		return true
+	}
+	return strings.EqualFold(o.Profile, profileName(profileID))
+}
+
+// Apply matching overrides to a folder's action; profile-specific ones win over global ones
+func applyOverrides(profileID string, folder *FolderData) {
+	name := strings.TrimSpace(folder.Group.Group)
+	before := folder.Group.Action
+
+	for _, global := range []bool{true, false} {
+		for _, o := range folderOverrides {
+			if (o.Profile == "") != global || !o.matches(name, profileID) {
+				continue
+			}
+			if o.Do != nil {
+				folder.Group.Action.Do = *o.Do
+			}
+			if o.Status != nil {
+				folder.Group.Action.Status = *o.Status
+			}
+			if o.Priority != nil {
+				folder.Priority = *o.Priority
+			}
+		}
+	}
+
+	if after := folder.Group.Action; after != before {
+		logger.Printf("Folder '%s': action overridden (%s→%s)", name, actionStatusLabel(before), actionStatusLabel(after))
+	}
+}
+
+// Order folders by descending priority, keeping list order among equals
+func sortByPriority(folders []FolderData) {
+	sort.SliceStable(folders, func(i, j int) bool {
+		return folders[i].Priority > folders[j].Priority
+	})
+}
@@ -0,0 +1,105 @@
+package ctrldsync
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Automatic syncs are held off while this is set in the state file
+type PauseState struct {
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until,omitempty"` // zero until resumed by hand
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Report whether syncs are paused right now
+func (p *PauseState) active(now time.Time) bool {
+	return p != nil && (p.Until.IsZero() || now.Before(p.Until))
+}
+
+func (p *PauseState) String() string {
+	s := "paused since " + p.Since.Local().Format("2006-01-02 15:04")
+	if p.Until.IsZero() {
+		s += " until resumed"
+	} else {
+		s += " until " + p.Until.Local().Format("2006-01-02 15:04")
+	}
+	if p.Reason != "" {
+		s += " (" + p.Reason + ")"
+	}
+	return s
+}
+
+// Current pause, if any; an expired pause counts as none
+func currentPause() *PauseState {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	if state.Paused.active(time.Now()) {
+		return state.Paused
+	}
+	return nil
+}
+
+// pause [--for 24h] [--reason text] | pause --status
+func runPauseCommand(args []string) int {
+	fs := flag.NewFlagSet("pause", flag.ExitOnError)
+	duration := fs.Duration("for", 0, "resume automatically after this long (default: until resume)")
+	reason := fs.String("reason", "", "why syncs are paused, shown in every skipped run")
+	status := fs.Bool("status", false, "show whether syncs are paused and exit")
+	fs.Parse(args)
+
+	if err := loadState(stateFilePath()); err != nil {
+		logger.Printf("Failed to load state: %v", err)
+		return 1
+	}
+	if *status {
+		if p := currentPause(); p != nil {
+			fmt.Printf("Syncs are %s\n", p)
+		} else {
+			fmt.Println("Syncs are not paused")
+		}
+		return 0
+	}
+	if *duration < 0 {
+		fmt.Fprintln(os.Stderr, "--for must be positive")
+		return 2
+	}
+
+	p := &PauseState{Since: time.Now().UTC(), Reason: *reason}
+	if *duration > 0 {
+		p.Until = p.Since.Add(*duration)
+	}
+	stateMutex.Lock()
+	state.Paused = p
+	stateMutex.Unlock()
+	if err := saveState(); err != nil {
+		logger.Printf("Failed to save state: %v", err)
+		return 1
+	}
+	fmt.Printf("Syncs are %s\n", p)
+	return 0
+}
+
+// resume: lift a pause before it runs out
+func runResumeCommand(args []string) int {
+	if err := loadState(stateFilePath()); err != nil {
+		logger.Printf("Failed to load state: %v", err)
+		return 1
+	}
+	wasPaused := currentPause() != nil
+	stateMutex.Lock()
+	state.Paused = nil
+	stateMutex.Unlock()
+	if err := saveState(); err != nil {
+		logger.Printf("Failed to save state: %v", err)
+		return 1
+	}
+	if wasPaused {
+		fmt.Println("Syncs resumed")
+	} else {
+		fmt.Println("Syncs were not paused")
+	}
+	return 0
+}
@@ -0,0 +1,113 @@
+package ctrldsync
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// Base URL of Hagezi's Control D folder files
+const HageziFolderBase = "https://raw.githubusercontent.com/hagezi/dns-blocklists/main/controld/"
+
+//go:embed presets.json
+var presetsJSON []byte
+
+// Named set of Hagezi folders
+type Preset struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Folders     []string `json:"folders"`
+}
+
+// URLs of the folders in a preset
+func (p Preset) URLs() []string {
+	urls := make([]string, len(p.Folders))
+	for i, folder := range p.Folders {
+		urls[i] = HageziFolderBase + folder + "-folder.json"
+	}
+	return urls
+}
+
+// All embedded presets, in catalog order
+func presets() []Preset {
+	var list []Preset
+	if err := json.Unmarshal(presetsJSON, &list); err != nil {
+		panic(fmt.Sprintf("invalid embedded presets.json: %v", err))
+	}
+	return list
+}
+
+// Look up a preset by name
+func findPreset(name string) (Preset, bool) {
+	for _, p := range presets() {
+		if strings.EqualFold(p.Name, name) {
+			return p, true
+		}
+	}
+	return Preset{}, false
+}
+
+// presets list | show <name> | expand <name>
+func runPresetsCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: ctrld-hagezi-sync presets list | show <name> | expand <name>")
+		return 2
+	}
+
+	switch args[0] {
+	case "list":
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tFOLDERS\tDESCRIPTION")
+		for _, p := range presets() {
+			fmt.Fprintf(w, "%s\t%d\t%s\n", p.Name, len(p.Folders), p.Description)
+		}
+		w.Flush()
+		return 0
+
+	case "show", "expand":
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "usage: ctrld-hagezi-sync presets %s <name>\n", args[0])
+			return 2
+		}
+		p, ok := findPreset(args[1])
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown preset %q\n", args[1])
+			return 1
+		}
+		if args[0] == "expand" {
+			for _, u := range p.URLs() {
+				fmt.Println(u)
+			}
+			return 0
+		}
+
+		// Rule counts are estimated from the current upstream files
+		if err := initClients(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to set up HTTP clients: %v\n", err)
+			return 1
+		}
+		fmt.Printf("%s — %s\n\n", p.Name, p.Description)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "FOLDER\tRULES\t")
+		total := 0
+		for _, u := range p.URLs() {
+			data, err := fetchFolderData(u)
+			if err != nil {
+				fmt.Fprintf(w, "%s\t(unavailable: %v)\t\n", u, err)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t\n", data.Group.Group, formatNumber(len(data.Rules)))
+			total += len(data.Rules)
+		}
+		fmt.Fprintf(w, "Total\t~%s\t\n", formatNumber(total))
+		w.Flush()
+		return 0
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown presets command %q\n", args[0])
+		return 2
+	}
+}
@@ -0,0 +1,247 @@
+package ctrldsync
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Profile as returned by the profiles API
+type APIProfile struct {
+	PK   interface{} `json:"PK"`
+	Name string      `json:"name"`
+}
+
+type APIProfilesResponse struct {
+	Body struct {
+		Profiles []APIProfile `json:"profiles"`
+	} `json:"body"`
+}
+
+// List every profile on the account
+func listProfiles() ([]APIProfile, error) {
+	resp, err := apiGet(APIBase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list profiles: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var apiResp APIProfilesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		return nil, fmt.Errorf("failed to decode profiles response: %w", err)
+	}
+	return apiResp.Body.Profiles, nil
+}
+
+// Account profiles, loaded once on first use
+var (
+	directoryOnce sync.Once
+	directory     []APIProfile
+	directoryErr  error
+)
+
+func accountProfiles() ([]APIProfile, error) {
+	directoryOnce.Do(func() {
+		directory, directoryErr = listProfiles()
+	})
+	return directory, directoryErr
+}
+
+// Forget the loaded profile list so the next lookup fetches it again
+func refreshAccountProfiles() {
+	directoryOnce = sync.Once{}
+}
+
+// Look up a profile's name by ID
+func profileName(profileID string) string {
+	profiles, err := accountProfiles()
+	if err != nil {
+		return ""
+	}
+	for _, p := range profiles {
+		if interfaceToString(p.PK) == profileID {
+			return strings.TrimSpace(p.Name)
+		}
+	}
+	return ""
+}
+
+// Resolve a profile name to its ID; entries that are already IDs pass through
+func resolveProfile(entry string) string {
+	profiles, err := accountProfiles()
+	if err != nil {
+		return entry
+	}
+	for _, p := range profiles {
+		if interfaceToString(p.PK) == entry {
+			return entry
+		}
+	}
+	for _, p := range profiles {
+		if strings.EqualFold(strings.TrimSpace(p.Name), entry) {
+			return interfaceToString(p.PK)
+		}
+	}
+	warnf("profile %q not found by ID or name, using it as an ID", entry)
+	return entry
+}
+
+// Which profiles a run should touch
+type ProfileSelection struct {
+	List    string          // comma-separated IDs, names or glob patterns
+	File    string          // file with one ID, name or glob pattern per line
+	All     bool            // every profile on the account
+	Tags    []string        // account profiles carrying any of these tags
+	Names   []folderPattern // account profiles whose names match any of these
+	Exclude []string        // IDs, names or glob patterns never to touch
+}
+
+// Report whether a glob pattern matches a profile's ID or name, ignoring case
+func profileMatches(pattern, profileID, name string) bool {
+	pattern = strings.ToLower(pattern)
+	for _, candidate := range []string{profileID, name} {
+		if candidate == "" {
+			continue
+		}
+		if ok, _ := path.Match(pattern, strings.ToLower(candidate)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Report whether a profile is on the exclusion list
+func (sel ProfileSelection) excluded(profileID string) bool {
+	if len(sel.Exclude) == 0 {
+		return false
+	}
+	name := profileName(profileID)
+	for _, pattern := range sel.Exclude {
+		if profileMatches(pattern, profileID, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand a selection entry into profile IDs; glob patterns match account profiles
+func expandProfileEntry(entry string) []string {
+	if !strings.ContainsAny(entry, "*?[") {
+		return []string{resolveProfile(entry)}
+	}
+
+	profiles, err := accountProfiles()
+	if err != nil {
+		warnf("can't expand pattern %q without the profile list: %v", entry, err)
+		return nil
+	}
+	var ids []string
+	for _, p := range profiles {
+		pk := interfaceToString(p.PK)
+		if profileMatches(entry, pk, strings.TrimSpace(p.Name)) {
+			ids = append(ids, pk)
+		}
+	}
+	if len(ids) == 0 {
+		warnf("pattern %q matched no profiles", entry)
+	}
+	return ids
+}
+
+// Profile IDs read ahead of the workers; the listing or profiles file is only read further as they catch up
+const ProfileStreamBuffer = 16
+
+// Stream the selected profile IDs
+func streamProfiles(sel ProfileSelection) <-chan string {
+	out := make(chan string, ProfileStreamBuffer)
+
+	go func() {
+		defer close(out)
+
+		seen := make(map[string]bool)
+		emit := func(profileID string) {
+			if seen[profileID] {
+				return
+			}
+			seen[profileID] = true
+			if sel.excluded(profileID) {
+				logger.Printf("Skipping excluded profile %s", maskID(profileID))
+				return
+			}
+			out <- profileID
+		}
+
+		if sel.All || len(sel.Tags) > 0 || len(sel.Names) > 0 {
+			profiles, err := accountProfiles()
+			if err != nil {
+				logger.Printf("Failed to enumerate account profiles: %v", err)
+				return
+			}
+			logger.Printf("Found %d profiles on the account", len(profiles))
+			for _, p := range profiles {
+				pk := interfaceToString(p.PK)
+				if len(sel.Tags) > 0 && !hasAnyTag(tagsFor(pk), sel.Tags) {
+					continue
+				}
+				if len(sel.Names) > 0 && !matchesAny(sel.Names, strings.TrimSpace(p.Name)) {
+					continue
+				}
+				emit(pk)
+			}
+			return
+		}
+
+		if _, err := accountProfiles(); err != nil {
+			warnf("could not resolve profile names, treating entries as IDs: %v", err)
+		}
+		for _, entry := range splitList(sel.List) {
+			for _, pk := range expandProfileEntry(entry) {
+				emit(pk)
+			}
+		}
+
+		if sel.File == "" {
+			return
+		}
+		f, err := os.Open(sel.File)
+		if err != nil {
+			logger.Printf("Failed to open profiles file: %v", err)
+			return
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if i := strings.Index(line, "#"); i >= 0 {
+				line = strings.TrimSpace(line[:i])
+			}
+			if line == "" {
+				continue
+			}
+			for _, pk := range expandProfileEntry(line) {
+				emit(pk)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			logger.Printf("Failed to read profiles file: %v", err)
+		}
+	}()
+
+	return out
+}
+
+// Split a comma-separated list, dropping blanks
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if trimmed := strings.TrimSpace(item); trimmed != "" {
+			items = append(items, trimmed)
+		}
+	}
+	return items
+}
@@ -0,0 +1,201 @@
+package ctrldsync
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Fetch the hostnames in one folder
+func listFolderRules(profileID, folderID string) ([]string, error) {
+	endpoint := fmt.Sprintf("%s/%s/rules/%s", APIBase, profileID, folderID)
+	resp, err := apiGet(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var apiResp APIRulesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		return nil, fmt.Errorf("failed to decode rules: %w", err)
+	}
+
+	var rules []string
+	for _, rule := range apiResp.Body.Rules {
+		if rule.PK != "" {
+			rules = append(rules, rule.PK)
+		}
+	}
+	return rules, nil
+}
+
+// Names of the folders this tool manages in a profile, from the state file or the configured lists
+func managedFolderNames(profileID string) []string {
+	if ps, ok := getProfileState(profileID); ok && len(ps.Folders) > 0 {
+		var names []string
+		for name := range ps.Folders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	var names []string
+	for _, u := range listsForProfile(profileID) {
+		if data, err := fetchFolderData(u); err == nil {
+			names = append(names, strings.TrimSpace(data.Group.Group))
+		}
+	}
+	return names
+}
+
+// Report whether two rule lists hold the same hostnames
+func sameRules(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, r := range a {
+		set[r] = true
+	}
+	for _, r := range b {
+		if !set[r] {
+			return false
+		}
+	}
+	return true
+}
+
+// Make the managed folders of one profile exactly match another's
+func promoteProfile(from, to string) ProfileResult {
+	result := ProfileResult{ProfileID: to}
+	logger.Printf("Promoting managed folders from %s to %s", maskID(from), maskID(to))
+
+	fromGroups, err := listFolderDetails(from)
+	if err != nil {
+		result.fail("Failed to list folders of %s: %v", maskID(from), err)
+		return result
+	}
+	toGroups, err := listFolderDetails(to)
+	if err != nil {
+		result.fail("Failed to list folders of %s: %v", maskID(to), err)
+		return result
+	}
+	fromByName := make(map[string]APIGroup)
+	for _, g := range fromGroups {
+		fromByName[strings.TrimSpace(g.Group)] = g
+	}
+	toByName := make(map[string]APIGroup)
+	for _, g := range toGroups {
+		toByName[strings.TrimSpace(g.Group)] = g
+	}
+
+	names := managedFolderNames(from)
+	promoted := make(map[string]bool)
+	successCount := 0
+	for _, name := range names {
+		src, ok := fromByName[name]
+		if !ok {
+			result.fail("Folder '%s' is managed but missing from %s", name, maskID(from))
+			continue
+		}
+		promoted[name] = true
+		folderResult := FolderResult{Name: name, Do: src.Action.Do, Status: src.Action.Status}
+
+		rules, err := listFolderRules(from, interfaceToString(src.PK))
+		if err != nil {
+			result.fail("Failed to read folder '%s' from %s: %v", name, maskID(from), err)
+			result.Folders = append(result.Folders, folderResult)
+			continue
+		}
+
+		// Leave folders that already match untouched
+		if dst, exists := toByName[name]; exists && dst.Action == src.Action {
+			current, err := listFolderRules(to, interfaceToString(dst.PK))
+			if err == nil && sameRules(current, rules) {
+				logger.Printf("Folder '%s' already matches, skipping", name)
+				folderResult.Success = true
+				result.Folders = append(result.Folders, folderResult)
+				successCount++
+				continue
+			}
+		}
+
+		if dst, exists := toByName[name]; exists {
+			deleteFolder(to, name, interfaceToString(dst.PK))
+		}
+		folderID, err := createFolder(to, name, src.Action.Do, src.Action.Status)
+		if err != nil {
+			result.fail("Failed to create folder '%s': %v", name, err)
+			result.Folders = append(result.Folders, folderResult)
+			continue
+		}
+
+		stats := pushRules(to, name, folderID, src.Action.Do, src.Action.Status, rules, make(map[string]bool))
+		added, failedBatches := stats.Added, stats.FailedBatches
+		ok = failedBatches == 0
+		folderResult.Rules = added
+		folderResult.FailedBatches = failedBatches
+		folderResult.SourceRules = len(rules)
+		folderResult.Success = ok
+		result.Folders = append(result.Folders, folderResult)
+		if ok {
+			successCount++
+		}
+	}
+
+	// Folders managed in the target but not in the source don't belong there
+	for _, name := range managedFolderNames(to) {
+		if dst, exists := toByName[name]; exists && !promoted[name] {
+			deleteFolder(to, name, interfaceToString(dst.PK))
+		}
+	}
+
+	recordAppliedState(to, result.Folders)
+	result.Success = successCount == len(names) && len(result.Errors) == 0
+	logger.Printf("Promotion complete: %d/%d folders match", successCount, len(names))
+	return result
+}
+
+// promote --from <profile> --to <profile>
+func runPromoteCommand(args []string) int {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	from := fs.String("from", "", "profile to copy managed folders from (ID or name)")
+	to := fs.String("to", "", "profile to make match (ID or name)")
+	fs.Parse(args)
+
+	token = getenv("TOKEN")
+	if token == "" || *from == "" || *to == "" {
+		fmt.Fprintln(os.Stderr, "usage: ctrld-hagezi-sync promote --from <staging> --to <prod> (TOKEN required)")
+		return 2
+	}
+	if err := initClients(); err != nil {
+		logger.Printf("Failed to set up HTTP clients: %v", err)
+		return 1
+	}
+	if err := loadState(stateFilePath()); err != nil {
+		warnf("could not load state, starting fresh: %v", err)
+	}
+	// Managed folder names fall back to lists.txt when the state file has none
+	FolderURLs, _ = loadLists()
+
+	fromID, toID := resolveProfile(*from), resolveProfile(*to)
+	release, err := acquireLock(toID)
+	if err != nil {
+		logger.Printf("Profile %s: could not acquire lock: %v", maskID(toID), err)
+		return 1
+	}
+	result := promoteProfile(fromID, toID)
+	release()
+
+	if err := saveState(); err != nil {
+		warnf("could not save state: %v", err)
+	}
+	if !result.Success {
+		return 1
+	}
+	return 0
+}
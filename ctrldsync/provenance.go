@@ -0,0 +1,45 @@
+package ctrldsync
+
+import (
+	"encoding/csv"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Write every rule of the fetched sources as CSV with where it came from: rule, folder, action, source, line
+func writeRulesReport(path string) error {
+	cacheMutex.RLock()
+	folders := make([]FolderData, 0, len(cache))
+	for _, data := range cache {
+		folders = append(folders, data)
+	}
+	cacheMutex.RUnlock()
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Source < folders[j].Source })
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"rule", "folder", "action", "source", "line"})
+	for _, data := range folders {
+		name := strings.TrimSpace(data.Group.Group)
+		action := actionLabel(data.Group.Action.Do)
+		for _, rule := range data.Rules {
+			if rule.PK == "" {
+				continue
+			}
+			line := ""
+			if rule.Line > 0 {
+				line = strconv.Itoa(rule.Line)
+			}
+			w.Write([]string{rule.PK, name, action, data.Source, line})
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
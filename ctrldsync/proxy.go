@@ -0,0 +1,92 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Proxy for both the Control D API and list downloads (--proxy, ALL_PROXY); API_PROXY and GH_PROXY take precedence
+var defaultProxy string
+
+// Parse a proxy address: http, https or socks5 (socks5h too), "host:port" meaning http
+func parseProxyURL(raw string) (*url.URL, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %q: %w", raw, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	case "socks5h":
+		// Go's socks5 already leaves resolving to the proxy
+		u.Scheme = "socks5"
+	default:
+		return nil, fmt.Errorf("invalid proxy %q: scheme must be http, https or socks5", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %q: no host", raw)
+	}
+	return u, nil
+}
+
+// Proxy function for the transport: an explicit per-client proxy is used for every request,
+// the shared one except for NO_PROXY hosts, and otherwise HTTP_PROXY, HTTPS_PROXY and NO_PROXY as usual
+func proxyFunc(clientProxy string) (func(*http.Request) (*url.URL, error), error) {
+	switch {
+	case clientProxy != "":
+		u, err := parseProxyURL(clientProxy)
+		if err != nil {
+			return nil, err
+		}
+		return http.ProxyURL(u), nil
+	case defaultProxy != "":
+		u, err := parseProxyURL(defaultProxy)
+		if err != nil {
+			return nil, err
+		}
+		cfg := &httpproxy.Config{HTTPProxy: u.String(), HTTPSProxy: u.String(), NoProxy: firstEnv("NO_PROXY", "no_proxy")}
+		match := cfg.ProxyFunc()
+		return func(req *http.Request) (*url.URL, error) { return match(req.URL) }, nil
+	}
+	return http.ProxyFromEnvironment, nil
+}
+
+// Describe the proxies in effect, credentials hidden, or "" when requests go out directly
+func describeProxies() string {
+	var proxies [2]string
+	for i, prefix := range []string{"API", "GH"} {
+		raw := getenv(prefix + "_PROXY")
+		if raw == "" {
+			raw = defaultProxy
+		}
+		if u, err := parseProxyURL(raw); raw != "" && err == nil {
+			proxies[i] = u.Redacted()
+		}
+	}
+	switch {
+	case proxies[0] != "" && proxies[0] == proxies[1]:
+		return proxies[0] + " for the Control D API and list downloads"
+	case proxies[0] != "" && proxies[1] != "":
+		return fmt.Sprintf("%s for the Control D API, %s for list downloads", proxies[0], proxies[1])
+	case proxies[0] != "":
+		return proxies[0] + " for the Control D API"
+	case proxies[1] != "":
+		return proxies[1] + " for list downloads"
+	}
+	return ""
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
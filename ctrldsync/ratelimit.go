@@ -0,0 +1,101 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// API requests made during the run and the rate-limit headroom the API reported
+type APIBudget struct {
+	Requests  int `json:"requests"`
+	Throttled int `json:"throttled"` // 429 responses
+
+	// From X-RateLimit-Limit / X-RateLimit-Remaining (or the unprefixed RateLimit-* headers); zero when never sent
+	Limit        int  `json:"limit,omitempty"`
+	Remaining    int  `json:"remaining,omitempty"`
+	MinRemaining int  `json:"min_remaining,omitempty"` // lowest remaining seen during the run
+	Reported     bool `json:"reported"`
+}
+
+var (
+	apiBudget      APIBudget
+	apiBudgetMutex sync.Mutex
+)
+
+// Transport that counts API requests and records the rate-limit headers of each response
+type rateLimitTransport struct {
+	next http.RoundTripper
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+
+	apiBudgetMutex.Lock()
+	defer apiBudgetMutex.Unlock()
+	apiBudget.Requests++
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		apiBudget.Throttled++
+	}
+	limit, okLimit := rateLimitHeader(resp.Header, "Limit")
+	remaining, okRemaining := rateLimitHeader(resp.Header, "Remaining")
+	if okLimit {
+		apiBudget.Limit = limit
+	}
+	if okRemaining {
+		if !apiBudget.Reported || remaining < apiBudget.MinRemaining {
+			apiBudget.MinRemaining = remaining
+		}
+		apiBudget.Remaining = remaining
+		apiBudget.Reported = true
+	}
+	return resp, nil
+}
+
+// Integer value of X-RateLimit-<name> or RateLimit-<name>
+func rateLimitHeader(h http.Header, name string) (int, bool) {
+	for _, key := range []string{"X-RateLimit-" + name, "RateLimit-" + name} {
+		if v := h.Get(key); v != "" {
+			if n, err := strconv.Atoi(v); err == nil {
+				return n, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Copy of the API budget so far
+func currentAPIBudget() APIBudget {
+	apiBudgetMutex.Lock()
+	defer apiBudgetMutex.Unlock()
+	return apiBudget
+}
+
+// Share of the rate limit used, as a percentage; -1 when the API never reported one
+func (b APIBudget) UsedPercent() int {
+	if !b.Reported || b.Limit <= 0 {
+		return -1
+	}
+	return (b.Limit - b.MinRemaining) * 100 / b.Limit
+}
+
+// One-line description for logs and the summary
+func (b APIBudget) String() string {
+	s := fmt.Sprintf("%s requests", formatNumber(b.Requests))
+	if b.Throttled > 0 {
+		s += fmt.Sprintf(" (%s rate limited)", formatNumber(b.Throttled))
+	}
+	switch {
+	case !b.Reported:
+		s += "; the API reported no rate limit"
+	case b.Limit > 0:
+		s += fmt.Sprintf("; %s of %s remaining, lowest %s (%d%% used at peak)", formatNumber(b.Remaining), formatNumber(b.Limit), formatNumber(b.MinRemaining), b.UsedPercent())
+	default:
+		s += fmt.Sprintf("; %s remaining, lowest %s", formatNumber(b.Remaining), formatNumber(b.MinRemaining))
+	}
+	return s
+}
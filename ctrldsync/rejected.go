@@ -0,0 +1,143 @@
+package ctrldsync
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Runs in which the API must reject a hostname before it is no longer sent
+const DefaultRejectThreshold = 2
+
+var rejectThreshold = DefaultRejectThreshold
+
+// Non-2xx response from the API
+type HTTPStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body)
+}
+
+// A hostname the API refused to accept
+type RejectedHostname struct {
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	LastRun   string    `json:"last_run"`
+}
+
+// Report whether the API refused the request's content rather than failing
+func isRejection(err error) bool {
+	var statusErr *HTTPStatusError
+	return errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusBadRequest || statusErr.StatusCode == http.StatusUnprocessableEntity)
+}
+
+// Single hostnames a batch may have rejected before any is accepted; past this the
+// request itself (folder, action) is taken to be what the API refuses
+const MaxUnconfirmedRejections = 8
+
+// Post one batch, bisecting it on rejection to find the hostnames the API refuses. A
+// hostname only counts as refused when others in the batch were accepted: if none is,
+// the batch failed as a whole, e.g. because its folder is gone, and nobody is blamed.
+func pushBatch(profileID, endpoint string, base map[string]string, batch []string) (pushed, rejected []string, err error) {
+	b := &bisection{profileID: profileID, endpoint: endpoint, base: base}
+	err = b.push(batch)
+	if b.abort != nil {
+		err = b.abort
+	}
+	if len(b.pushed) == 0 {
+		if err == nil && len(b.rejected) > 0 {
+			err = fmt.Errorf("every hostname of the batch was rejected: %w", b.rejection)
+		}
+		return nil, nil, err
+	}
+	return b.pushed, b.rejected, err
+}
+
+// State of splitting one rejected batch
+type bisection struct {
+	profileID string
+	endpoint  string
+	base      map[string]string
+
+	pushed    []string
+	rejected  []string
+	rejection error // last rejection, reported if nothing is accepted
+	abort     error
+}
+
+func (b *bisection) push(batch []string) error {
+	data := make(map[string]string, len(b.base)+len(batch))
+	for k, v := range b.base {
+		data[k] = v
+	}
+	for j, hostname := range batch {
+		data[fmt.Sprintf("hostnames[%d]", j)] = hostname
+	}
+
+	batchScheduler.acquire(b.profileID)
+	resp, err := apiPostForm(b.endpoint, data)
+	batchScheduler.release()
+	if err == nil {
+		resp.Body.Close()
+		b.pushed = append(b.pushed, batch...)
+		return nil
+	}
+	if !isRejection(err) {
+		return err
+	}
+	b.rejection = err
+	if len(batch) == 1 {
+		b.rejected = append(b.rejected, batch[0])
+		if len(b.pushed) == 0 && len(b.rejected) >= MaxUnconfirmedRejections {
+			b.abort = fmt.Errorf("the first %d hostnames tried alone were all rejected, giving up on the batch: %w", len(b.rejected), err)
+		}
+		return nil
+	}
+
+	mid := len(batch) / 2
+	err = b.push(batch[:mid])
+	if b.abort != nil {
+		return nil
+	}
+	if err2 := b.push(batch[mid:]); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Count a rejection of each hostname, at most once per run
+func recordRejectedHostnames(hostnames []string) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	if state.Rejected == nil {
+		state.Rejected = make(map[string]*RejectedHostname)
+	}
+	now := time.Now().UTC()
+	for _, hostname := range hostnames {
+		r, exists := state.Rejected[hostname]
+		if !exists {
+			r = &RejectedHostname{FirstSeen: now}
+			state.Rejected[hostname] = r
+		}
+		if r.LastRun != runID {
+			r.Count++
+			r.LastRun = runID
+		}
+		r.LastSeen = now
+	}
+}
+
+// Report whether a hostname has been rejected often enough to stop sending it
+func isRejectedHostname(hostname string) bool {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	r, exists := state.Rejected[hostname]
+	return exists && rejectThreshold > 0 && r.Count >= rejectThreshold
+}
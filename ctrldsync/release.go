@@ -0,0 +1,165 @@
+package ctrldsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Scheme of GitHub release asset sources, e.g. github-release://owner/repo/domains.txt ref=v2.1
+const ReleaseSourcePrefix = "github-release://"
+
+// Report whether a source is a GitHub release asset
+func isReleaseSource(src string) bool {
+	return strings.HasPrefix(src, ReleaseSourcePrefix)
+}
+
+// Split a release source into its repository ("owner/repo") and asset name or glob
+func releaseParts(src string) (repo, asset string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(src, ReleaseSourcePrefix), "/", 3)
+	if len(parts) < 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", fmt.Errorf("expected %s<owner>/<repo>/<asset name>", ReleaseSourcePrefix)
+	}
+	if _, err := path.Match(parts[2], ""); err != nil {
+		return "", "", fmt.Errorf("invalid asset pattern %q", parts[2])
+	}
+	return parts[0] + "/" + parts[1], parts[2], nil
+}
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name               string `json:"name"`
+		URL                string `json:"url"`
+		BrowserDownloadURL string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// Releases looked up this run by repository and tag, and the release each source was fetched from
+var (
+	releaseMutex sync.Mutex
+	releaseCache = make(map[string]*githubRelease)
+	releaseTags  sync.Map
+)
+
+// GitHub API base; GITHUB_API_URL is set by Actions, also on GitHub Enterprise Server
+func githubAPIBase() string {
+	if base := getenv("GITHUB_API_URL"); base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+	return "https://api.github.com"
+}
+
+func githubToken() string {
+	if t := getenv("GITHUB_TOKEN"); t != "" {
+		return t
+	}
+	return getenv("GH_TOKEN")
+}
+
+// Look up a release by tag, or the latest one
+func findRelease(repo, tag string) (*githubRelease, error) {
+	key := repo + "@" + tag
+	releaseMutex.Lock()
+	rel, ok := releaseCache[key]
+	releaseMutex.Unlock()
+	if ok {
+		return rel, nil
+	}
+
+	endpoint := fmt.Sprintf("%s/repos/%s/releases/latest", githubAPIBase(), repo)
+	if tag != "" && tag != "latest" {
+		endpoint = fmt.Sprintf("%s/repos/%s/releases/tags/%s", githubAPIBase(), repo, tag)
+	}
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if token := githubToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := ghClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound && (tag == "" || tag == "latest"):
+		return nil, fmt.Errorf("%s has no published release", repo)
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%s has no release %s", repo, tag)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("looking up release of %s: HTTP %d", repo, resp.StatusCode)
+	}
+	rel = &githubRelease{}
+	if err := json.NewDecoder(resp.Body).Decode(rel); err != nil {
+		return nil, fmt.Errorf("decoding release of %s: %w", repo, err)
+	}
+
+	releaseMutex.Lock()
+	releaseCache[key] = rel
+	releaseMutex.Unlock()
+	return rel, nil
+}
+
+// Download the asset of a release source, recording the release tag it came from
+func fetchReleaseAsset(src, tag string) ([]byte, error) {
+	u, _ := splitSource(src)
+	repo, pattern, err := releaseParts(u)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := findRelease(repo, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []int
+	for i, a := range rel.Assets {
+		if ok, _ := path.Match(pattern, a.Name); ok {
+			matches = append(matches, i)
+		}
+	}
+	switch {
+	case len(matches) == 0:
+		return nil, fmt.Errorf("release %s of %s has no asset matching %q", rel.TagName, repo, pattern)
+	case len(matches) > 1:
+		names := make([]string, len(matches))
+		for i, m := range matches {
+			names[i] = rel.Assets[m].Name
+		}
+		return nil, fmt.Errorf("release %s of %s has several assets matching %q: %s", rel.TagName, repo, pattern, strings.Join(names, ", "))
+	}
+	asset := rel.Assets[matches[0]]
+
+	// Private repositories only serve assets through the API, with the token
+	target := asset.BrowserDownloadURL
+	if token := githubToken(); token != "" && asset.URL != "" {
+		target = asset.URL
+		h := make(http.Header)
+		h.Set("Authorization", "Bearer "+token)
+		h.Set("Accept", "application/octet-stream")
+		if parsed, err := http.NewRequest("GET", target, nil); err == nil {
+			sourceAuth.Store(sourceAuthKey(parsed.URL), h)
+		}
+	}
+	body, err := downloadSource(target)
+	if err != nil {
+		return nil, fmt.Errorf("%s of release %s: %w", asset.Name, rel.TagName, err)
+	}
+	logger.Printf("Fetched %s from release %s of %s", asset.Name, rel.TagName, repo)
+	releaseTags.Store(src, rel.TagName)
+	return body, nil
+}
+
+// Release tag a source was fetched from, if it is a release asset
+func releaseTag(src string) string {
+	if tag, ok := releaseTags.Load(src); ok {
+		return tag.(string)
+	}
+	return ""
+}
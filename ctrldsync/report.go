@@ -0,0 +1,84 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Outcome of a whole run, as exposed to summary templates
+type RunReport struct {
+	RunID     string          `json:"run_id"`
+	Started   time.Time       `json:"started"`
+	Duration  time.Duration   `json:"duration_ns"`
+	Profiles  []ProfileResult `json:"profiles"`
+	Succeeded int             `json:"succeeded"`
+	Failed    int             `json:"failed"`
+	Skipped   int             `json:"skipped"` // locked by another instance
+
+	// "info", or "critical" when an alert threshold was breached
+	Severity string   `json:"severity"`
+	Alerts   []string `json:"alerts,omitempty"`
+
+	// Distinct warnings raised during the run
+	Warnings []Warning `json:"warnings,omitempty"`
+
+	// API requests made and rate-limit headroom left
+	API APIBudget `json:"api"`
+
+	// Folders that failed several runs in a row
+	Persistent []PersistentFailure `json:"persistent_failures,omitempty"`
+}
+
+// Build the run report from per-profile results
+func buildReport(started time.Time, results []ProfileResult) RunReport {
+	report := RunReport{
+		RunID:    runID,
+		Started:  started,
+		Duration: time.Since(started).Round(time.Second),
+		Profiles: results,
+		Severity: "info",
+		API:      currentAPIBudget(),
+	}
+	report.Persistent = persistentFailures(results)
+	for _, r := range results {
+		if r.Skipped != "" {
+			report.Skipped++
+		} else if r.Success {
+			report.Succeeded++
+		} else {
+			report.Failed++
+		}
+	}
+	return report
+}
+
+// Functions available to summary templates
+var templateFuncs = template.FuncMap{
+	"maskID":       maskID,
+	"formatNumber": formatNumber,
+	"join":         strings.Join,
+	"action":       actionLabel,
+	"status":       statusLabel,
+}
+
+// Load a summary template from a file
+func loadSummaryTemplate(filename string) (*template.Template, error) {
+	text, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filename).Funcs(templateFuncs).Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+	return tmpl, nil
+}
+
+// Render a report with a custom template
+func renderSummaryTemplate(w io.Writer, tmpl *template.Template, report RunReport) error {
+	return tmpl.Execute(w, report)
+}
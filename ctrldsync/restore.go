@@ -0,0 +1,109 @@
+package ctrldsync
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Recreate a snapshot's folders and rules in a profile, which may differ from the one it was taken from
+func restoreSnapshot(snap Snapshot, profileID string, replace bool) error {
+	existingFolders, err := listExistingFolders(profileID)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, folder := range snap.Folders {
+		if folder.Name == ManifestFolderName || isLockFolder(folder.Name) {
+			continue
+		}
+		if oldID, exists := existingFolders[folder.Name]; exists {
+			if !replace {
+				logger.Printf("Folder '%s' already exists in profile %s, skipping (use --replace to overwrite)", folder.Name, maskID(profileID))
+				continue
+			}
+			deleteFolder(profileID, folder.Name, oldID)
+		}
+
+		// Folder IDs are per profile, so folders are matched by name and get new IDs
+		folderID, err := createFolder(profileID, folder.Name, folder.Do, folder.Status)
+		if err != nil {
+			logger.Printf("Failed to create folder '%s': %v", folder.Name, err)
+			failed++
+			continue
+		}
+		stats := pushRules(profileID, folder.Name, folderID, folder.Do, folder.Status, folder.Rules, make(map[string]bool))
+		if stats.FailedBatches > 0 {
+			failed++
+		}
+	}
+
+	// Root rules carry their own action; push them grouped by it
+	byAction := make(map[Action][]string)
+	for _, rule := range snap.RootRules {
+		if rule.PK == "" || rule.Action == nil {
+			continue
+		}
+		byAction[*rule.Action] = append(byAction[*rule.Action], rule.PK)
+	}
+	endpoint := fmt.Sprintf("%s/%s/rules", APIBase, profileID)
+	for action, hostnames := range byAction {
+		base := map[string]string{"do": strconv.Itoa(action.Do), "status": strconv.Itoa(action.Status)}
+		for _, batch := range splitBatches(hostnames, batchBaseBytes(base)) {
+			if _, _, err := pushBatch(profileID, endpoint, base, batch); err != nil {
+				logger.Printf("Failed to restore root rules: %v", err)
+				failed++
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d folders or batches failed", failed)
+	}
+	return nil
+}
+
+// restore --snapshot <file> [--to <profile>] [--replace]
+func runRestoreCommand(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	file := fs.String("snapshot", "", "snapshot file to restore")
+	to := fs.String("to", "", "profile to restore into (ID or name); defaults to the snapshot's own profile")
+	replace := fs.Bool("replace", false, "replace folders that already exist in the target")
+	fs.Parse(args)
+
+	token = getenv("TOKEN")
+	if token == "" || *file == "" {
+		fmt.Fprintln(os.Stderr, "usage: ctrld-hagezi-sync restore --snapshot <file> [--to <profile>] [--replace] (TOKEN required)")
+		return 2
+	}
+	snap, err := loadSnapshot(*file)
+	if err != nil {
+		logger.Printf("%v", err)
+		return 1
+	}
+	if err := initClients(); err != nil {
+		logger.Printf("Failed to set up HTTP clients: %v", err)
+		return 1
+	}
+
+	target := snap.Profile
+	if *to != "" {
+		target = resolveProfile(*to)
+	}
+	release, err := acquireLock(target)
+	if err != nil {
+		logger.Printf("Profile %s: could not acquire lock: %v", maskID(target), err)
+		return 1
+	}
+	defer release()
+
+	logger.Printf("Restoring %d folders from %s (profile %s, %s) into profile %s", len(snap.Folders), *file, maskID(snap.Profile), snap.Taken.Format("2006-01-02 15:04"), maskID(target))
+	if err := restoreSnapshot(snap, target, *replace); err != nil {
+		logger.Printf("Restore incomplete: %v", err)
+		return 1
+	}
+	logger.Printf("Restore complete")
+	return 0
+}
@@ -0,0 +1,97 @@
+package ctrldsync
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Rule lists too big for the state file — the last fetched content of each source, folder
+// listings and dedup indexes — are kept gzipped in a directory next to it, one file each,
+// and only rewritten when they change. Losing the directory costs a full scan and one
+// run's upstream diffs, nothing more.
+var rulesCacheDir string
+
+// RULES_CACHE_DIR, or the state file's path with .cache in place of .json
+func rulesCacheDirFor(statePath string) string {
+	if dir := getenv("RULES_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	return strings.TrimSuffix(statePath, ".json") + ".cache"
+}
+
+func rulesCachePath(kind, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(rulesCacheDir, kind, hex.EncodeToString(sum[:16])+".json.gz")
+}
+
+// Read a cached value into v, reporting whether there was one
+func loadCached(kind, key string, v interface{}) bool {
+	if rulesCacheDir == "" {
+		return false
+	}
+	f, err := os.Open(rulesCachePath(kind, key))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return false
+	}
+	defer zr.Close()
+	return json.NewDecoder(zr).Decode(v) == nil
+}
+
+// Report whether a value is cached
+func isCached(kind, key string) bool {
+	if rulesCacheDir == "" {
+		return false
+	}
+	_, err := os.Stat(rulesCachePath(kind, key))
+	return err == nil
+}
+
+// Write a value to the cache, replacing the old one in one step
+func saveCached(kind, key string, v interface{}) error {
+	if rulesCacheDir == "" {
+		return nil
+	}
+	path := rulesCachePath(kind, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	zw := gzip.NewWriter(tmp)
+	err = json.NewEncoder(zw).Encode(v)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Drop a cached value
+func removeCached(kind, key string) {
+	if rulesCacheDir == "" {
+		return
+	}
+	if err := os.Remove(rulesCachePath(kind, key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		warnf("could not remove cached %s: %v", kind, err)
+	}
+}
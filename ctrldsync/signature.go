@@ -0,0 +1,314 @@
+package ctrldsync
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var sha256Hex = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// Check the sha256, minisign, gpg and sig options when the lists are loaded
+func checkVerifyOptions(opts url.Values) error {
+	if opts.Has("sha256") && opts.Get("sha256") == "" {
+		return fmt.Errorf("sha256 needs a checksum or the URL of a checksum file")
+	}
+	if opts.Has("minisign") && opts.Has("gpg") {
+		return fmt.Errorf("use minisign or gpg, not both")
+	}
+	if opts.Has("sig") && !opts.Has("minisign") && !opts.Has("gpg") {
+		return fmt.Errorf("sig is only for minisign or gpg signatures")
+	}
+	if opts.Has("minisign") {
+		if _, err := minisignKey(opts.Get("minisign")); err != nil {
+			return err
+		}
+	}
+	if opts.Has("gpg") {
+		if _, err := os.Stat(opts.Get("gpg")); err != nil {
+			return fmt.Errorf("gpg keyring: %w", err)
+		}
+	}
+	return nil
+}
+
+// Check a fetched source, exactly as published, against its checksum and signature;
+// content that doesn't match is refused, so its folder is left as it is
+func verifySource(src string, body []byte) error {
+	_, opts := splitSource(src)
+	var checked []string
+
+	if want := opts.Get("sha256"); want != "" {
+		if !sha256Hex.MatchString(want) {
+			sums, err := fetchSourceData(companionSource(src, want, ""))
+			if err != nil {
+				return fmt.Errorf("fetching checksum: %w", err)
+			}
+			if want, err = findChecksum(sums, sourceFileName(src)); err != nil {
+				return err
+			}
+		}
+		sum := sha256.Sum256(body)
+		if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, want) {
+			return fmt.Errorf("SHA-256 mismatch: got %s, expected %s", got, strings.ToLower(want))
+		}
+		checked = append(checked, "sha256")
+	}
+
+	if key := opts.Get("minisign"); key != "" {
+		sig, err := fetchSourceData(companionSource(src, opts.Get("sig"), ".minisig"))
+		if err != nil {
+			return fmt.Errorf("fetching minisign signature: %w", err)
+		}
+		pub, err := minisignKey(key)
+		if err != nil {
+			return err
+		}
+		comment, err := verifyMinisign(pub, body, sig)
+		if err != nil {
+			return err
+		}
+		checked = append(checked, fmt.Sprintf("minisign, %s", comment))
+	}
+
+	if keyring := opts.Get("gpg"); keyring != "" {
+		sig, err := fetchSourceData(companionSource(src, opts.Get("sig"), ".asc"))
+		if err != nil {
+			return fmt.Errorf("fetching gpg signature: %w", err)
+		}
+		if err := verifyGPG(keyring, body, sig); err != nil {
+			return err
+		}
+		checked = append(checked, "gpg")
+	}
+
+	if len(checked) > 0 {
+		logger.Printf("Verified %s (%s)", listShortName(src), strings.Join(checked, "; "))
+	}
+	return nil
+}
+
+// Source of a checksum or signature file: value if given, resolved against the source's
+// URL when relative, or else the source itself with ext appended. It is fetched with the
+// source's ref and, on the same host, its credentials.
+func companionSource(src, value, ext string) string {
+	u, opts := splitSource(src)
+	keep := url.Values{}
+	for _, key := range []string{"ref", "path", "basic", "bearer", "header"} {
+		if vs, ok := opts[key]; ok {
+			keep[key] = vs
+		}
+	}
+
+	var target string
+	switch {
+	case value == "" && isGitSource(u):
+		target = u
+		keep.Set("path", opts.Get("path")+ext)
+	case value == "":
+		target = u + ext
+	case strings.Contains(value, "://") || filepath.IsAbs(value):
+		target = value
+		if base, err := url.Parse(u); err != nil || !sameHost(base, value) {
+			keep.Del("basic")
+			keep.Del("bearer")
+			keep.Del("header")
+		}
+		if !isGitSource(target) {
+			keep.Del("path")
+		}
+	default:
+		if base, err := url.Parse(u); err == nil && (base.Scheme == "https" || base.Scheme == "http") {
+			ref, err := url.Parse(value)
+			if err != nil {
+				return value
+			}
+			target = base.ResolveReference(ref).String()
+		} else {
+			target = value
+		}
+		keep.Del("path")
+	}
+	if len(keep) == 0 {
+		return target
+	}
+	return target + "#" + keep.Encode()
+}
+
+func sameHost(base *url.URL, other string) bool {
+	o, err := url.Parse(other)
+	return err == nil && strings.EqualFold(base.Host, o.Host) && base.Scheme == o.Scheme
+}
+
+// File name a checksum file lists a source under, possibly a glob for release assets
+func sourceFileName(src string) string {
+	u, opts := splitSource(src)
+	if p := opts.Get("path"); p != "" {
+		u = p
+	}
+	if parsed, err := url.Parse(u); err == nil && parsed.Path != "" {
+		u = parsed.Path
+	}
+	return path.Base(u)
+}
+
+// Checksum of name in a sha256sum or BSD-style checksum file; a file holding a single checksum applies to any name
+func findChecksum(sums []byte, name string) (string, error) {
+	var only []string
+	for _, line := range strings.Split(string(sums), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// BSD style: SHA256 (file) = checksum
+		if rest, ok := strings.CutPrefix(line, "SHA256 ("); ok {
+			file, sum, ok := strings.Cut(rest, ") = ")
+			if ok && sha256Hex.MatchString(sum) {
+				if m, _ := path.Match(name, path.Base(file)); m {
+					return sum, nil
+				}
+			}
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !sha256Hex.MatchString(fields[0]) {
+			continue
+		}
+		if len(fields) == 1 {
+			only = append(only, fields[0])
+			continue
+		}
+		file := strings.TrimPrefix(strings.Join(fields[1:], " "), "*")
+		if m, _ := path.Match(name, path.Base(file)); m {
+			return fields[0], nil
+		}
+	}
+	if len(only) == 1 {
+		return only[0], nil
+	}
+	return "", fmt.Errorf("checksum file has no SHA-256 checksum for %s", name)
+}
+
+type minisignPublicKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// A minisign public key, given as its base64 form ("RW...") or the path of a .pub file
+func minisignKey(value string) (*minisignPublicKey, error) {
+	encoded := value
+	if !strings.HasPrefix(value, "RW") {
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("minisign public key: %w", err)
+		}
+		encoded = lastLine(data)
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) != 42 || string(raw[:2]) != "Ed" {
+		return nil, fmt.Errorf("minisign public key %q is not valid", value)
+	}
+	k := &minisignPublicKey{key: ed25519.PublicKey(raw[10:])}
+	copy(k.id[:], raw[2:10])
+	return k, nil
+}
+
+// Check a minisign signature file over body, returning its trusted comment
+func verifyMinisign(pub *minisignPublicKey, body, sigFile []byte) (string, error) {
+	lines := strings.Split(strings.ReplaceAll(string(sigFile), "\r\n", "\n"), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return "", fmt.Errorf("minisign signature is malformed")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sig) != 74 {
+		return "", fmt.Errorf("minisign signature is malformed")
+	}
+	if !bytes.Equal(sig[2:10], pub.id[:]) {
+		return "", fmt.Errorf("minisign signature is from key %X, not %X", reverse(sig[2:10]), reverse(pub.id[:]))
+	}
+
+	msg := body
+	switch string(sig[:2]) {
+	case "ED": // prehashed, the default since minisign 0.11
+		sum := blake2b.Sum512(body)
+		msg = sum[:]
+	case "Ed":
+	default:
+		return "", fmt.Errorf("minisign signature algorithm %q is not supported", sig[:2])
+	}
+	if !ed25519.Verify(pub.key, msg, sig[10:]) {
+		return "", fmt.Errorf("minisign signature does not match the content")
+	}
+
+	// The trusted comment is signed too, together with the signature
+	comment := strings.TrimPrefix(lines[2], "trusted comment: ")
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || !ed25519.Verify(pub.key, append(append([]byte(nil), sig[10:]...), comment...), global) {
+		return "", fmt.Errorf("minisign trusted comment signature does not match")
+	}
+	return comment, nil
+}
+
+// Key IDs are shown the way minisign prints them
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+func lastLine(data []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// Check a detached OpenPGP signature with gpgv against a keyring of trusted keys
+func verifyGPG(keyring string, body, sig []byte) error {
+	if _, err := exec.LookPath("gpgv"); err != nil {
+		return fmt.Errorf("gpg signatures need gpgv installed: %w", err)
+	}
+	keyring, err := filepath.Abs(keyring)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "ctrld-sync-gpg-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	bodyFile, sigFile := filepath.Join(dir, "list"), filepath.Join(dir, "list.sig")
+	if err := os.WriteFile(bodyFile, body, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(sigFile, sig, 0600); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("gpgv", "--homedir", dir, "--keyring", keyring, sigFile, bodyFile)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			var lines []string
+			for _, line := range strings.Split(msg, "\n") {
+				lines = append(lines, strings.Join(strings.Fields(strings.TrimPrefix(line, "gpgv:")), " "))
+			}
+			return fmt.Errorf("gpg signature does not verify: %s", strings.Join(lines, "; "))
+		}
+		return fmt.Errorf("gpg signature does not verify: %w", err)
+	}
+	return nil
+}
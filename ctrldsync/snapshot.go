@@ -0,0 +1,160 @@
+package ctrldsync
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultSnapshotDir is where snapshots go when SNAPSHOT_DIR and --dir are not set
+const DefaultSnapshotDir = "snapshots"
+
+// Full copy of a profile's folders and rules
+type Snapshot struct {
+	Profile   string           `json:"profile"`
+	Name      string           `json:"name,omitempty"`
+	Taken     time.Time        `json:"taken"`
+	Version   string           `json:"version"`
+	Folders   []SnapshotFolder `json:"folders"`
+	RootRules []Rule           `json:"root_rules,omitempty"`
+}
+
+type SnapshotFolder struct {
+	Name   string   `json:"name"`
+	Do     int      `json:"do"`
+	Status int      `json:"status"`
+	Rules  []string `json:"rules"`
+}
+
+// Read every folder and rule in a profile, managed or not
+func takeSnapshot(profileID string) (Snapshot, error) {
+	snap := Snapshot{Profile: profileID, Name: profileName(profileID), Taken: time.Now().UTC(), Version: Version}
+
+	resp, err := apiGet(fmt.Sprintf("%s/%s/rules", APIBase, profileID))
+	if err != nil {
+		return snap, fmt.Errorf("failed to read root rules: %w", err)
+	}
+	var apiResp APIRulesResponse
+	err = json.NewDecoder(resp.Body).Decode(&apiResp)
+	resp.Body.Close()
+	if err != nil {
+		return snap, fmt.Errorf("failed to decode root rules: %w", err)
+	}
+	snap.RootRules = apiResp.Body.Rules
+
+	groups, err := listFolderDetails(profileID)
+	if err != nil {
+		return snap, err
+	}
+	for _, g := range groups {
+		name := strings.TrimSpace(g.Group)
+		rules, err := listFolderRules(profileID, interfaceToString(g.PK))
+		if err != nil {
+			return snap, fmt.Errorf("failed to read folder '%s': %w", name, err)
+		}
+		snap.Folders = append(snap.Folders, SnapshotFolder{Name: name, Do: g.Action.Do, Status: g.Action.Status, Rules: rules})
+	}
+	sort.Slice(snap.Folders, func(i, j int) bool { return snap.Folders[i].Name < snap.Folders[j].Name })
+	return snap, nil
+}
+
+// Write a snapshot as <dir>/<profile>-<time>.json and prune all but the newest keep for that profile
+func saveSnapshot(dir string, snap Snapshot, keep int) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	filename := filepath.Join(dir, fmt.Sprintf("%s-%s.json", snap.Profile, snap.Taken.Format("20060102T150405Z")))
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		return "", err
+	}
+
+	if keep > 0 {
+		// Timestamps sort lexically, so the oldest come first
+		existing, _ := filepath.Glob(filepath.Join(dir, snap.Profile+"-*.json"))
+		sort.Strings(existing)
+		for len(existing) > keep {
+			os.Remove(existing[0])
+			existing = existing[1:]
+		}
+	}
+	return filename, nil
+}
+
+// Load a snapshot file
+func loadSnapshot(filename string) (Snapshot, error) {
+	var snap Snapshot
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return snap, err
+	}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return snap, fmt.Errorf("invalid snapshot %s: %w", filename, err)
+	}
+	return snap, nil
+}
+
+// snapshot [--dir dir] [--keep n] [--interval d] [--all-profiles] [profile...]
+func runSnapshotCommand(args []string) int {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	defaultDir := getenv("SNAPSHOT_DIR")
+	if defaultDir == "" {
+		defaultDir = DefaultSnapshotDir
+	}
+	dir := fs.String("dir", defaultDir, "directory to write snapshots to")
+	keep := fs.Int("keep", 30, "snapshots to keep per profile (0 keeps all)")
+	interval := fs.Duration("interval", 0, "keep running and take snapshots this often")
+	all := fs.Bool("all-profiles", false, "snapshot every profile on the account")
+	fs.Parse(args)
+
+	token = getenv("TOKEN")
+	sel := ProfileSelection{List: strings.Join(fs.Args(), ","), All: *all}
+	if sel.List == "" && !sel.All {
+		sel.List = getenv("PROFILE")
+	}
+	if token == "" || (sel.List == "" && !sel.All) {
+		fmt.Fprintln(os.Stderr, "usage: ctrld-hagezi-sync snapshot [--dir dir] [--keep n] [--interval d] [--all-profiles] [profile...] (TOKEN required)")
+		return 2
+	}
+	if err := initClients(); err != nil {
+		logger.Printf("Failed to set up HTTP clients: %v", err)
+		return 1
+	}
+
+	for {
+		failed := 0
+		for profileID := range streamProfiles(sel) {
+			snap, err := takeSnapshot(profileID)
+			if err != nil {
+				logger.Printf("Profile %s: snapshot failed: %v", maskID(profileID), err)
+				failed++
+				continue
+			}
+			filename, err := saveSnapshot(*dir, snap, *keep)
+			if err != nil {
+				logger.Printf("Profile %s: could not save snapshot: %v", maskID(profileID), err)
+				failed++
+				continue
+			}
+			logger.Printf("Profile %s: saved %d folders to %s", maskID(profileID), len(snap.Folders), filename)
+		}
+
+		if *interval <= 0 {
+			if failed > 0 {
+				return 1
+			}
+			return 0
+		}
+		logger.Printf("Next snapshot in %v", *interval)
+		time.Sleep(*interval)
+		refreshAccountProfiles()
+	}
+}
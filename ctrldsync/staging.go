@@ -0,0 +1,133 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Staging profile for each production profile, by ID
+var stagingProfiles map[string]string
+
+// Content versions of the folders a staging profile was verified with, by production profile
+// and folder name; production only gets these versions
+var (
+	stagingPins      = make(map[string]map[string]string)
+	stagingPinsMutex sync.Mutex
+)
+
+// Parse "prod=staging,prod=staging"; either side may be an ID or a name
+func parseStaging(s string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, pair := range splitList(s) {
+		prod, staging, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid staging pair %q, expected prod=staging", pair)
+		}
+		pairs[resolveProfile(strings.TrimSpace(prod))] = resolveProfile(strings.TrimSpace(staging))
+	}
+	return pairs, nil
+}
+
+// Check that every folder synced to a profile is present with the expected action and rule count
+func verifyProfile(profileID string, result ProfileResult) error {
+	if !result.Success {
+		return fmt.Errorf("sync did not complete")
+	}
+
+	groups, err := listFolderDetails(profileID)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]APIGroup)
+	for _, g := range groups {
+		current[strings.TrimSpace(g.Group)] = g
+	}
+
+	var problems []string
+	for _, folder := range result.Folders {
+		g, ok := current[folder.Name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("'%s' is missing", folder.Name))
+		case g.Action != (Action{Do: folder.Do, Status: folder.Status}):
+			problems = append(problems, fmt.Sprintf("'%s' is %s, expected %s", folder.Name, actionStatusLabel(g.Action), actionStatusLabel(Action{Do: folder.Do, Status: folder.Status})))
+		case g.Count < folder.Rules:
+			problems = append(problems, fmt.Sprintf("'%s' has %d rules, expected at least %d", folder.Name, g.Count, folder.Rules))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Sync a profile, going through its staging profile first when one is configured
+func syncWithStaging(profileID string) []ProfileResult {
+	staging, ok := stagingProfiles[profileID]
+	if !ok {
+		return []ProfileResult{runProfileSync(profileID)}
+	}
+
+	logger.Printf("Profile %s: syncing staging profile %s first", maskID(profileID), maskID(staging))
+	stagingResult := runProfileSync(staging)
+
+	if err := verifyProfile(staging, stagingResult); err != nil {
+		result := ProfileResult{ProfileID: profileID}
+		result.fail("Profile %s: not promoted, staging profile %s failed verification: %v", maskID(profileID), maskID(staging), err)
+		return []ProfileResult{stagingResult, result}
+	}
+
+	pins := make(map[string]string)
+	for _, folder := range stagingResult.Folders {
+		pins[folder.Name] = folder.Version
+	}
+	stagingPinsMutex.Lock()
+	stagingPins[profileID] = pins
+	stagingPinsMutex.Unlock()
+	defer func() {
+		stagingPinsMutex.Lock()
+		delete(stagingPins, profileID)
+		stagingPinsMutex.Unlock()
+	}()
+
+	logger.Printf("Profile %s: staging profile %s verified, promoting", maskID(profileID), maskID(staging))
+	return []ProfileResult{stagingResult, runProfileSync(profileID)}
+}
+
+// Why a folder can't be promoted with the content it has now; empty when it is what staging was
+// verified with, or the profile isn't being promoted from staging
+func stagingPinProblem(profileID string, data FolderData) string {
+	stagingPinsMutex.Lock()
+	pins, promoting := stagingPins[profileID]
+	stagingPinsMutex.Unlock()
+	if !promoting {
+		return ""
+	}
+
+	version, ok := pins[strings.TrimSpace(data.Group.Group)]
+	switch {
+	case !ok:
+		return "it was not synced to the staging profile"
+	case version != data.Version:
+		return fmt.Sprintf("its content is now %s, the staging profile was verified with %s", data.Version, version)
+	}
+	return ""
+}
+
+// Report whether a profile is the staging profile of another one
+func isStagingProfile(profileID string) bool {
+	for _, staging := range stagingProfiles {
+		if staging == profileID {
+			return true
+		}
+	}
+	return false
+}
+
+// Load STAGING pairs from the environment
+func loadStaging() error {
+	var err error
+	stagingProfiles, err = parseStaging(getenv("STAGING"))
+	return err
+}
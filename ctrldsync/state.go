@@ -0,0 +1,420 @@
+package ctrldsync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults used when STATE_FILE and DEDUP_INDEX_MAX_AGE are not set
+const (
+	DefaultStateFile        = ".sync-state.json"
+	DefaultDedupIndexMaxAge = 24 * time.Hour
+)
+
+// How long a stored dedup index is trusted before a full re-scan
+var dedupIndexMaxAge = DefaultDedupIndexMaxAge
+
+// Last-applied state of a single managed folder
+type FolderState struct {
+	PK      string `json:"pk"`
+	Do      int    `json:"do"`
+	Status  int    `json:"status"`
+	Rules   int    `json:"rules"`
+	Source  string `json:"source,omitempty"`
+	Version string `json:"version,omitempty"`
+	RunID   string `json:"run_id,omitempty"` // run that created or last synced the folder
+
+	// List entry the source was expanded from, when it has placeholders like {date}
+	Template string `json:"template,omitempty"`
+
+	// Source rules the API is missing (negative when it reports extra), and for how many runs in a row it exceeded the alert threshold
+	RuleDelta       int `json:"rule_delta,omitempty"`
+	RuleDeltaStreak int `json:"rule_delta_streak,omitempty"`
+}
+
+// Last-applied state of a profile
+type ProfileState struct {
+	LastSync time.Time              `json:"last_sync"`
+	Folders  map[string]FolderState `json:"folders"`
+
+	// When the dedup index, the rules of the folders a sync left in place, was last scanned;
+	// the index itself is in the rules cache
+	DedupIndexScanned time.Time `json:"dedup_index_scanned,omitempty"`
+
+	// Rule counts of every folder keyed by folder PK; the listings are in the rules cache
+	// and reused while the folder's count is unchanged
+	FolderRules map[string]FolderRulesCache `json:"folder_rules,omitempty"`
+
+	// Folders that failed completely, by source, retried first on the next run
+	Carryover map[string]*CarryoverFolder `json:"carryover,omitempty"`
+}
+
+// Cached rule listing of one folder
+type FolderRulesCache struct {
+	Count int      `json:"count"`
+	Rules []string `json:"rules,omitempty"` // only in state files of older versions
+}
+
+// Persistent state shared across runs
+type State struct {
+	Profiles map[string]*ProfileState `json:"profiles"`
+
+	// Last fetched content of each source and the upstream changes seen since the last digest
+	Sources map[string]*SourceState `json:"sources,omitempty"`
+	Digest  []DigestEntry           `json:"digest,omitempty"`
+
+	// Per-run metrics, oldest first
+	History []RunRecord `json:"history,omitempty"`
+
+	// Hostnames the API refused, by hostname
+	Rejected map[string]*RejectedHostname `json:"rejected,omitempty"`
+
+	// Set by the pause command; syncs and deletes do nothing while it lasts
+	Paused *PauseState `json:"paused,omitempty"`
+
+	// Sources held back after an unusual size change, by source, until approved
+	Quarantine map[string]*QuarantinedSource `json:"quarantine,omitempty"`
+}
+
+var (
+	state      = &State{Profiles: make(map[string]*ProfileState)}
+	stateMutex sync.Mutex
+	statePath  string
+)
+
+// State file path from STATE_FILE
+func stateFilePath() string {
+	if path := getenv("STATE_FILE"); path != "" {
+		return path
+	}
+	return DefaultStateFile
+}
+
+// Load state from disk, starting fresh if the file does not exist
+func loadState(path string) error {
+	statePath = path
+	rulesCacheDir = rulesCacheDirFor(path)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var s State
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	if s.Profiles == nil {
+		s.Profiles = make(map[string]*ProfileState)
+	}
+
+	moveRulesToCache(&s)
+
+	stateMutex.Lock()
+	state = &s
+	stateMutex.Unlock()
+	return nil
+}
+
+// Write state back to disk
+func saveState() error {
+	if statePath == "" {
+		return nil
+	}
+
+	stateMutex.Lock()
+	data, err := json.MarshalIndent(state, "", "  ")
+	stateMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, statePath)
+}
+
+// Get a copy of the stored snapshot for a profile
+func getProfileState(profileID string) (ProfileState, bool) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	ps, exists := state.Profiles[profileID]
+	if !exists {
+		return ProfileState{}, false
+	}
+	return *ps, true
+}
+
+// Get the stored profile state for modification; callers must hold stateMutex
+func profileStateLocked(profileID string) *ProfileState {
+	ps, exists := state.Profiles[profileID]
+	if !exists {
+		ps = &ProfileState{}
+		state.Profiles[profileID] = ps
+	}
+	return ps
+}
+
+// Record the folders applied to a profile in this run
+func setProfileState(profileID string, folders map[string]FolderState) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	ps := profileStateLocked(profileID)
+	ps.LastSync = time.Now().UTC()
+	ps.Folders = folders
+}
+
+// Older versions kept every rule list in the state file; move source contents to the rules
+// cache and drop folder listings, which the next scan fetches again
+func moveRulesToCache(s *State) {
+	for src, ss := range s.Sources {
+		if ss.Rules != nil {
+			ss.Count = len(ss.Rules)
+			if err := saveCached("sources", src, ss.Rules); err != nil {
+				warnf("could not move the rules of %s to %s: %v", listShortName(src), rulesCacheDir, err)
+			}
+			ss.Rules = nil
+		}
+	}
+	for _, ps := range s.Profiles {
+		for pk, f := range ps.FolderRules {
+			if f.Rules != nil {
+				delete(ps.FolderRules, pk)
+			}
+		}
+	}
+}
+
+// Get the stored dedup index if it is recent enough to trust, leaving out the folders
+// about to be recreated: their old rules are gone once the folders are deleted
+func getDedupIndex(profileID string, skip map[string]bool) (map[string]bool, bool) {
+	stateMutex.Lock()
+	ps, exists := state.Profiles[profileID]
+	fresh := exists && !ps.DedupIndexScanned.IsZero() && time.Since(ps.DedupIndexScanned) <= dedupIndexMaxAge
+	stateMutex.Unlock()
+
+	var index map[string][]string
+	if !fresh || !loadCached("dedup", profileID, &index) {
+		return nil, false
+	}
+	for folder := range skip {
+		delete(index, folder)
+	}
+	return dedupSet(index), true
+}
+
+// Store the result of a full existing-rules scan, by folder
+func setDedupIndex(profileID string, folders map[string][]string) {
+	if err := saveCached("dedup", profileID, folders); err != nil {
+		warnf("could not store the dedup index: %v", err)
+		return
+	}
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	profileStateLocked(profileID).DedupIndexScanned = time.Now().UTC()
+}
+
+// Take a deleted folder's rules out of the stored dedup index
+func forgetDedupFolder(profileID, name string) {
+	var index map[string][]string
+	if !loadCached("dedup", profileID, &index) {
+		return
+	}
+	if _, exists := index[name]; !exists {
+		return
+	}
+	delete(index, name)
+	if err := saveCached("dedup", profileID, index); err != nil {
+		warnf("could not update the dedup index: %v", err)
+	}
+}
+
+// Snapshot the managed folders as they exist in the profile right now
+func recordAppliedState(profileID string, applied []FolderResult) {
+	groups, err := listFolderDetails(profileID)
+	if err != nil {
+		warnf("could not record applied state for profile %s: %v", maskID(profileID), err)
+		return
+	}
+
+	managed := make(map[string]FolderResult)
+	for _, folder := range applied {
+		managed[folder.Name] = folder
+	}
+
+	previous, _ := getProfileState(profileID)
+
+	folders := make(map[string]FolderState)
+	for _, g := range groups {
+		name := strings.TrimSpace(g.Group)
+		folder, ok := managed[name]
+		if !ok {
+			// Keep managed folders this run didn't touch so the sweeper can find them
+			if old, exists := previous.Folders[name]; exists && old.PK == interfaceToString(g.PK) {
+				old.Rules = g.Count
+				folders[name] = old
+			}
+			continue
+		}
+		fs := FolderState{
+			PK:       interfaceToString(g.PK),
+			Do:       g.Action.Do,
+			Status:   g.Action.Status,
+			Rules:    g.Count,
+			Source:   folder.Source,
+			Version:  folder.Version,
+			RunID:    runID,
+			Template: sourceTemplate(folder.Source),
+		}
+		if folder.SourceRules > 0 {
+			// Duplicates of other folders and hostnames the API refuses are never in the folder
+			expected := folder.SourceRules - folder.Duplicates - folder.Rejected
+			fs.RuleDelta = expected - g.Count
+			if fs.RuleDelta != 0 {
+				logger.Printf("Profile %s: folder '%s' has %d rules, expected %d from the source", maskID(profileID), name, g.Count, expected)
+			}
+			if alertThresholds.MaxRuleDelta > 0 && abs(fs.RuleDelta) > alertThresholds.MaxRuleDelta {
+				fs.RuleDeltaStreak = previous.Folders[name].RuleDeltaStreak + 1
+			}
+		}
+		folders[name] = fs
+	}
+
+	setProfileState(profileID, folders)
+}
+
+// Compare current profile state against the last-applied snapshot, log a summary and return the rule drift
+func logDrift(profileID string, groups []APIGroup) int {
+	snapshot, exists := getProfileState(profileID)
+	if !exists || len(snapshot.Folders) == 0 {
+		return 0
+	}
+
+	current := make(map[string]APIGroup)
+	for _, g := range groups {
+		current[strings.TrimSpace(g.Group)] = g
+	}
+
+	var modified, removed []string
+	driftRules := 0
+	for name, applied := range snapshot.Folders {
+		g, exists := current[name]
+		if !exists {
+			driftRules += applied.Rules
+		} else if g.Count > applied.Rules {
+			driftRules += g.Count - applied.Rules
+		} else {
+			driftRules += applied.Rules - g.Count
+		}
+
+		switch {
+		case !exists:
+			removed = append(removed, name)
+		case g.Action != (Action{Do: applied.Do, Status: applied.Status}):
+			modified = append(modified, fmt.Sprintf("%s: %s→%s", name, actionStatusLabel(Action{Do: applied.Do, Status: applied.Status}), actionStatusLabel(g.Action)))
+		case interfaceToString(g.PK) != applied.PK, g.Count != applied.Rules:
+			modified = append(modified, name)
+		}
+	}
+
+	if len(modified) == 0 && len(removed) == 0 {
+		logger.Printf("Profile %s: no drift since last sync (%s)", maskID(profileID), snapshot.LastSync.Format(time.RFC3339))
+		return 0
+	}
+
+	sort.Strings(modified)
+	sort.Strings(removed)
+
+	var parts []string
+	if len(modified) > 0 {
+		parts = append(parts, fmt.Sprintf("%d folders modified manually (%s)", len(modified), strings.Join(modified, ", ")))
+	}
+	if len(removed) > 0 {
+		parts = append(parts, fmt.Sprintf("%d folders removed manually (%s)", len(removed), strings.Join(removed, ", ")))
+	}
+	logger.Printf("Profile %s: drift detected: %s", maskID(profileID), strings.Join(parts, "; "))
+	return driftRules
+}
+
+// Forget the stored snapshot for a profile
+func clearProfileState(profileID string) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	delete(state.Profiles, profileID)
+}
+
+// Drop some folders from a profile's last-applied state
+func forgetFolders(profileID string, names []string) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	if ps, exists := state.Profiles[profileID]; exists {
+		for _, name := range names {
+			delete(ps.Folders, name)
+		}
+	}
+}
+
+// Get the cached rule listing of a folder if its rule count is still count
+func cachedFolderRules(profileID, folderID string, count int) ([]string, bool) {
+	stateMutex.Lock()
+	entry, ok := state.Profiles[profileID].folderRules()[folderID]
+	stateMutex.Unlock()
+
+	var rules []string
+	if !ok || entry.Count != count || !loadCached("folders", profileID+"/"+folderID, &rules) {
+		return nil, false
+	}
+	return rules, true
+}
+
+// Cache the rule listing of a folder
+func storeFolderRules(profileID, folderID string, rules []string) {
+	if err := saveCached("folders", profileID+"/"+folderID, rules); err != nil {
+		warnf("could not cache the rules of folder %s: %v", folderID, err)
+	}
+}
+
+// Record the rule counts of a profile's folders, dropping the listings of folders that no longer exist
+func setFolderRulesCache(profileID string, counts map[string]FolderRulesCache) {
+	stateMutex.Lock()
+	ps := profileStateLocked(profileID)
+	old := ps.FolderRules
+	ps.FolderRules = counts
+	stateMutex.Unlock()
+
+	for folderID := range old {
+		if _, exists := counts[folderID]; !exists {
+			removeCached("folders", profileID+"/"+folderID)
+		}
+	}
+}
+
+func (ps *ProfileState) folderRules() map[string]FolderRulesCache {
+	if ps == nil {
+		return nil
+	}
+	return ps.FolderRules
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
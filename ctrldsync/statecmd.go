@@ -0,0 +1,177 @@
+package ctrldsync
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Bumped when the export layout changes incompatibly
+const StateExportFormat = 1
+
+// Portable copy of the state file
+type StateExport struct {
+	Format   int       `json:"format"`
+	Exported time.Time `json:"exported"`
+	Version  string    `json:"version"`
+	State    *State    `json:"state"`
+}
+
+// state export [-o file] | state import [--merge] [--force] <file>
+func runStateCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: ctrld-hagezi-sync state export [-o file] | state import [--merge] [--force] <file>")
+		return 2
+	}
+	if err := loadState(stateFilePath()); err != nil {
+		logger.Printf("Failed to load state: %v", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "export":
+		return exportState(args[1:])
+	case "import":
+		return importState(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown state command %q\n", args[0])
+		return 2
+	}
+}
+
+func exportState(args []string) int {
+	fs := flag.NewFlagSet("state export", flag.ExitOnError)
+	output := fs.String("o", "", "write to this file instead of stdout")
+	fs.Parse(args)
+
+	stateMutex.Lock()
+	data, err := json.MarshalIndent(StateExport{
+		Format:   StateExportFormat,
+		Exported: time.Now().UTC(),
+		Version:  Version,
+		State:    state,
+	}, "", "  ")
+	stateMutex.Unlock()
+	if err != nil {
+		logger.Printf("Failed to encode state: %v", err)
+		return 1
+	}
+	data = append(data, '\n')
+
+	if *output == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := os.WriteFile(*output, data, 0600); err != nil {
+		logger.Printf("Failed to write %s: %v", *output, err)
+		return 1
+	}
+	logger.Printf("Exported state for %d profiles to %s", len(state.Profiles), *output)
+	return 0
+}
+
+func importState(args []string) int {
+	fs := flag.NewFlagSet("state import", flag.ExitOnError)
+	merge := fs.Bool("merge", false, "keep local profiles, sources, rejected hostnames and quarantined sources that the export doesn't have")
+	force := fs.Bool("force", false, "replace a non-empty local state")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: ctrld-hagezi-sync state import [--merge] [--force] <file>")
+		return 2
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		logger.Printf("Failed to read export: %v", err)
+		return 1
+	}
+	var export StateExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		logger.Printf("Failed to decode export: %v", err)
+		return 1
+	}
+	if export.Format != StateExportFormat || export.State == nil {
+		logger.Printf("Unsupported export format %d (expected %d)", export.Format, StateExportFormat)
+		return 1
+	}
+
+	imported := export.State
+	moveRulesToCache(imported)
+
+	stateMutex.Lock()
+	local := state
+	if imported.Profiles == nil {
+		imported.Profiles = make(map[string]*ProfileState)
+	}
+	localProfiles := len(local.Profiles)
+	switch {
+	case *merge:
+		for id, ps := range imported.Profiles {
+			local.Profiles[id] = ps
+		}
+		if len(imported.Sources) > 0 && local.Sources == nil {
+			local.Sources = make(map[string]*SourceState)
+		}
+		for url, src := range imported.Sources {
+			local.Sources[url] = src
+		}
+		// Digest and history are per-machine logs; only adopt them when there are none locally
+		if len(local.Digest) == 0 {
+			local.Digest = imported.Digest
+		}
+		if len(local.History) == 0 {
+			local.History = imported.History
+		}
+		mergeRejected(local, imported.Rejected)
+		if len(imported.Quarantine) > 0 && local.Quarantine == nil {
+			local.Quarantine = make(map[string]*QuarantinedSource)
+		}
+		for url, q := range imported.Quarantine {
+			local.Quarantine[url] = q
+		}
+		// A pause on either side holds; the local one wins when both have one
+		if local.Paused == nil {
+			local.Paused = imported.Paused
+		}
+	case localProfiles > 0 && !*force:
+		stateMutex.Unlock()
+		logger.Printf("Local state already has %d profiles; use --merge or --force", localProfiles)
+		return 1
+	default:
+		state = imported
+	}
+	stateMutex.Unlock()
+
+	if err := saveState(); err != nil {
+		logger.Printf("Failed to save state: %v", err)
+		return 1
+	}
+	logger.Printf("Imported state for %d profiles (exported %s by version %s)", len(imported.Profiles), export.Exported.Format(time.RFC3339), export.Version)
+	return 0
+}
+
+// Add imported rejection counts to the local ones, keeping the larger count and the wider time span
+func mergeRejected(local *State, imported map[string]*RejectedHostname) {
+	if len(imported) > 0 && local.Rejected == nil {
+		local.Rejected = make(map[string]*RejectedHostname)
+	}
+	for hostname, r := range imported {
+		l, exists := local.Rejected[hostname]
+		if !exists {
+			local.Rejected[hostname] = r
+			continue
+		}
+		if r.Count > l.Count {
+			l.Count = r.Count
+			l.LastRun = r.LastRun
+		}
+		if r.FirstSeen.Before(l.FirstSeen) {
+			l.FirstSeen = r.FirstSeen
+		}
+		if r.LastSeen.After(l.LastSeen) {
+			l.LastSeen = r.LastSeen
+		}
+	}
+}
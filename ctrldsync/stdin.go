@@ -0,0 +1,37 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+)
+
+// Source name of the list read by --stdin
+const StdinSource = "stdin"
+
+// Set by --stdin: the run syncs one folder from standard input instead of the configured lists
+var stdinMode bool
+
+// Read a list from standard input and make it the only source of this run; returns its domain count
+func loadStdinSource(folder string) (int, error) {
+	body, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return 0, err
+	}
+	src := StdinSource + "#" + url.Values{"name": {folder}}.Encode()
+	data, err := folderFromBody(src, body)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", StdinSource, err)
+	}
+
+	cacheMutex.Lock()
+	cache[src] = data
+	cacheMutex.Unlock()
+
+	stdinMode = true
+	FolderURLs = []string{src}
+	configProfileLists = nil
+	profileTagMap = nil
+	return len(data.Rules), nil
+}
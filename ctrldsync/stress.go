@@ -0,0 +1,171 @@
+package ctrldsync
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Outcome of one sync run against the mock API
+type stressRun struct {
+	Duration time.Duration
+	ExitErr  error
+	Requests int64
+	Pushed   int64
+	Wrong    []string // folders missing, duplicated or with the wrong rule count
+}
+
+// Environment for a stress sync: only what the run needs, so local config, hooks and webhooks stay out of it
+func stressEnv(base string, m *mockAPI, dir string, failureRate float64) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		for _, keep := range []string{"PATH=", "HOME=", "TMPDIR="} {
+			if strings.HasPrefix(kv, keep) {
+				env = append(env, kv)
+			}
+		}
+	}
+	return append(env,
+		"TOKEN=stress",
+		"PROFILE="+strings.Join(m.order, ","),
+		"API_BASE="+base+"/profiles",
+		"SOURCES="+strings.Join(m.listURLs(base), ","),
+		"STATE_FILE="+filepath.Join(dir, "state.json"),
+		"CONFIG_FILE="+filepath.Join(dir, "ctrld-sync.yaml"),
+		fmt.Sprintf("CHAOS=%g", failureRate),
+	)
+}
+
+// Check every profile holds each generated list exactly once with all its rules
+func (m *mockAPI) verify() []string {
+	var wrong []string
+	for _, pk := range m.order {
+		folders := m.folderCounts(pk)
+		for i := 1; i <= m.lists; i++ {
+			name := fmt.Sprintf("stress-%d", i)
+			counts := folders[name]
+			switch {
+			case len(counts) == 0:
+				wrong = append(wrong, fmt.Sprintf("%s: folder '%s' missing", pk, name))
+			case len(counts) > 1:
+				wrong = append(wrong, fmt.Sprintf("%s: folder '%s' exists %d times", pk, name, len(counts)))
+			case counts[0] != m.rules:
+				wrong = append(wrong, fmt.Sprintf("%s: folder '%s' has %d rules, want %d", pk, name, counts[0], m.rules))
+			}
+		}
+	}
+	sort.Strings(wrong)
+	return wrong
+}
+
+// stress [--profiles n] [--folders n] [--rules n] [--failure-rate f] [--latency d] [--runs n] [-v] [-- sync flags]
+func runStressCommand(args []string) int {
+	fs := flag.NewFlagSet("stress", flag.ExitOnError)
+	profiles := fs.Int("profiles", 3, "profiles on the mock account")
+	folders := fs.Int("folders", 4, "lists synced to each profile")
+	rules := fs.Int("rules", 2000, "domains per list")
+	failureRate := fs.Float64("failure-rate", 0.05, "share of API requests failed or slowed down, as with CHAOS")
+	latency := fs.Duration("latency", 0, "delay the mock API adds to every request")
+	runs := fs.Int("runs", 2, "syncs to run one after another against the same mock account")
+	verbose := fs.Bool("v", false, "show the sync output")
+	fs.Parse(args)
+
+	if *profiles < 1 || *folders < 1 || *rules < 1 || *runs < 1 || *failureRate < 0 || *failureRate > 1 {
+		fmt.Fprintln(os.Stderr, "--profiles, --folders, --rules and --runs must be positive, --failure-rate between 0 and 1")
+		return 2
+	}
+	extra := fs.Args()
+	if len(extra) > 0 && extra[0] == "--" {
+		extra = extra[1:]
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		logger.Printf("Failed to locate executable: %v", err)
+		return 1
+	}
+	dir, err := os.MkdirTemp("", "ctrld-sync-stress-")
+	if err != nil {
+		logger.Printf("Failed to create work directory: %v", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	m := newMockAPI(*profiles, *folders, *rules, *latency)
+	base, err := m.start()
+	if err != nil {
+		logger.Printf("Failed to start mock API: %v", err)
+		return 1
+	}
+	logger.Printf("Mock API at %s: %d profiles, %d lists of %s domains, %.0f%% failed requests", base, *profiles, *folders, formatNumber(*rules), *failureRate*100)
+
+	var results []stressRun
+	for i := 1; i <= *runs; i++ {
+		cmd := exec.Command(self, append([]string{"sync"}, extra...)...)
+		cmd.Dir = dir
+		cmd.Env = stressEnv(base, m, dir, *failureRate)
+		logPath := filepath.Join(dir, fmt.Sprintf("run-%d.log", i))
+		logFile, err := os.Create(logPath)
+		if err != nil {
+			logger.Printf("Failed to create run log: %v", err)
+			return 1
+		}
+		if *verbose {
+			cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		} else {
+			cmd.Stdout, cmd.Stderr = logFile, logFile
+		}
+
+		requests, pushed := m.requests.Load(), m.pushed.Load()
+		start := time.Now()
+		runErr := cmd.Run()
+		logFile.Close()
+
+		r := stressRun{
+			Duration: time.Since(start),
+			ExitErr:  runErr,
+			Requests: m.requests.Load() - requests,
+			Pushed:   m.pushed.Load() - pushed,
+			Wrong:    m.verify(),
+		}
+		results = append(results, r)
+
+		status := "ok"
+		if r.ExitErr != nil {
+			status = "sync failed: " + r.ExitErr.Error()
+		}
+		logger.Printf("Run %d: %s in %v, %s API requests, %s rules pushed (%.0f/s), %d folder problems",
+			i, status, r.Duration.Round(time.Millisecond), formatNumber(int(r.Requests)), formatNumber(int(r.Pushed)),
+			float64(r.Pushed)/r.Duration.Seconds(), len(r.Wrong))
+		for _, w := range r.Wrong {
+			logger.Printf("  %s", w)
+		}
+		if (r.ExitErr != nil || len(r.Wrong) > 0) && !*verbose {
+			if out, err := os.ReadFile(logPath); err == nil {
+				lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+				if len(lines) > 20 {
+					lines = lines[len(lines)-20:]
+				}
+				logger.Printf("Last lines of the sync output:\n%s", strings.Join(lines, "\n"))
+			}
+		}
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.ExitErr != nil || len(r.Wrong) > 0 {
+			failed++
+		}
+	}
+	expected := *profiles * *folders
+	logger.Printf("Stress test done: %d/%d runs left all %d folders complete", len(results)-failed, len(results), expected)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,219 @@
+package ctrldsync
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Identifies this run in the state file, the report and events
+var runID = newRunID()
+
+// GitHub Actions run ID when available, otherwise a timestamp with a random suffix
+func newRunID() string {
+	if id := getenv("GITHUB_RUN_ID"); id != "" {
+		return "gh-" + id
+	}
+	b := make([]byte, 3)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+// Delete a profile's orphaned folders while syncing it (--delete-orphans)
+var deleteOrphans bool
+
+// Managed folder whose source is no longer configured anywhere
+type Orphan struct {
+	Profile string
+	Name    string
+	Folder  FolderState
+}
+
+// Every source URL in the configured lists, the tag list files and the presets,
+// and the entries with placeholders they were expanded from
+func configuredSources() map[string]bool {
+	sources := make(map[string]bool)
+	urls, err := loadLists()
+	if err != nil {
+		warnf("could not load %s: %v", listsOrigin(), err)
+	}
+	addSources(sources, urls)
+	for _, list := range configProfileLists {
+		addSources(sources, list)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(listsDir, "lists-*.txt"))
+	for _, filename := range files {
+		urls, err := loadFolderURLs(filename)
+		if err != nil {
+			warnf("could not load %s: %v", filename, err)
+		}
+		addSources(sources, urls)
+	}
+	for _, p := range presets() {
+		addSources(sources, p.URLs())
+	}
+	return sources
+}
+
+func addSources(sources map[string]bool, urls []string) {
+	for _, u := range urls {
+		sources[u] = true
+		if t := sourceTemplate(u); t != "" {
+			sources[t] = true
+		}
+	}
+}
+
+// Names of the managed folders whose list isn't in sources. A folder from an entry with
+// placeholders counts as configured while the entry is, until the entry's current
+// expansion has a folder of its own, e.g. yesterday's {date} list once today's is synced.
+func orphanedFolders(folders map[string]FolderState, sources map[string]bool) []string {
+	superseded := make(map[string]bool)
+	for _, folder := range folders {
+		if folder.Template != "" && sources[folder.Source] {
+			superseded[folder.Template] = true
+		}
+	}
+
+	var names []string
+	for name, folder := range folders {
+		switch {
+		case folder.Source == "" || sources[folder.Source]:
+		case folder.Template != "" && sources[folder.Template] && !superseded[folder.Template]:
+		default:
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Managed folders in the state file whose source isn't configured
+func findOrphans(sources map[string]bool) []Orphan {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	var orphans []Orphan
+	for profileID, ps := range state.Profiles {
+		for _, name := range orphanedFolders(ps.Folders, sources) {
+			orphans = append(orphans, Orphan{Profile: profileID, Name: name, Folder: ps.Folders[name]})
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		if orphans[i].Profile != orphans[j].Profile {
+			return orphans[i].Profile < orphans[j].Profile
+		}
+		return orphans[i].Name < orphans[j].Name
+	})
+	return orphans
+}
+
+// Managed folders of one profile whose source isn't among its lists, leaving alone
+// folders this run fills anyway or couldn't fetch (keep, lowercased names)
+func profileOrphans(profileID string, urls []string, keep map[string]bool) []Orphan {
+	configured := make(map[string]bool, len(urls))
+	addSources(configured, urls)
+	ps, _ := getProfileState(profileID)
+
+	var orphans []Orphan
+	for _, name := range orphanedFolders(ps.Folders, configured) {
+		if !keep[strings.ToLower(name)] {
+			orphans = append(orphans, Orphan{Profile: profileID, Name: name, Folder: ps.Folders[name]})
+		}
+	}
+	return orphans
+}
+
+// Delete an orphaned folder if it is still the one we created, then forget it;
+// reports whether there was a folder to delete
+func removeOrphan(o Orphan) (bool, error) {
+	groups, err := listFolderDetails(o.Profile)
+	if err != nil {
+		return false, err
+	}
+	deleted := false
+	for _, g := range groups {
+		if strings.TrimSpace(g.Group) == o.Name && interfaceToString(g.PK) == o.Folder.PK {
+			if !deleteFolder(o.Profile, o.Name, o.Folder.PK) {
+				return false, fmt.Errorf("delete failed")
+			}
+			deleted = true
+			break
+		}
+	}
+
+	// Its rules are gone from the profile, so they no longer count as duplicates
+	forgetDedupFolder(o.Profile, o.Name)
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	if ps, exists := state.Profiles[o.Profile]; exists {
+		delete(ps.Folders, o.Name)
+	}
+	return deleted, nil
+}
+
+// sweep [--delete]
+func runSweepCommand(args []string) int {
+	fs := flag.NewFlagSet("sweep", flag.ExitOnError)
+	remove := fs.Bool("delete", false, "delete orphaned folders instead of only reporting them")
+	fs.Parse(args)
+
+	if err := loadState(stateFilePath()); err != nil {
+		logger.Printf("Failed to load state: %v", err)
+		return 1
+	}
+
+	orphans := findOrphans(configuredSources())
+	if len(orphans) == 0 {
+		fmt.Println("No orphaned folders")
+		return 0
+	}
+	for _, o := range orphans {
+		fmt.Printf("%s\t%s\t%d rules\trun %s\t%s\n", maskID(o.Profile), o.Name, o.Folder.Rules, o.Folder.RunID, o.Folder.Source)
+	}
+	if !*remove {
+		fmt.Printf("%d orphaned folders; run with --delete to remove them\n", len(orphans))
+		return 0
+	}
+
+	token = getenv("TOKEN")
+	if token == "" {
+		fmt.Fprintln(os.Stderr, "sweep --delete requires TOKEN")
+		return 2
+	}
+	if err := initClients(); err != nil {
+		logger.Printf("Failed to set up HTTP clients: %v", err)
+		return 1
+	}
+
+	failed := 0
+	for _, o := range orphans {
+		release, err := acquireLock(o.Profile)
+		if err != nil {
+			logger.Printf("Profile %s: could not acquire lock: %v", maskID(o.Profile), err)
+			failed++
+			continue
+		}
+		if _, err := removeOrphan(o); err != nil {
+			logger.Printf("Profile %s: could not remove orphaned folder '%s': %v", maskID(o.Profile), o.Name, err)
+			failed++
+		}
+		release()
+	}
+
+	if err := saveState(); err != nil {
+		warnf("could not save state: %v", err)
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,276 @@
+// Package ctrldsync syncs blocklists into Control D profiles. It is the ctrld-hagezi-sync command,
+// and other Go programs, e.g. an admin panel that syncs a customer's profiles on request, can run
+// the same syncs in-process:
+//
+//	s, err := ctrldsync.New(token,
+//		ctrldsync.WithProfiles("abc123", "def456"),
+//		ctrldsync.WithSources("https://raw.githubusercontent.com/hagezi/dns-blocklists/main/controld/spam-tlds-folder.json"),
+//		ctrldsync.WithDryRun(),
+//		ctrldsync.WithLogger(logger),
+//		ctrldsync.WithObserver(func(e ctrldsync.Event) { progress.Update(e) }),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	res, err := s.Run(ctx)
+//
+// A run reads its settings like the command does, from the config file and the environment, with
+// the Syncer's options on top. The settings and the loaded state are process-wide, so runs in one
+// process take turns; the jobs command runs syncs for several accounts at once as separate processes.
+package ctrldsync
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A run didn't start because syncs are paused (see the pause command)
+var ErrPaused = errors.New("syncs are paused")
+
+// A run finished, but some profiles failed; its Result says which
+var ErrProfilesFailed = errors.New("not every profile succeeded")
+
+// Outcome of a run
+type Result struct {
+	RunID     string
+	DryRun    bool
+	Profiles  []ProfileResult // every profile synced, deleted or planned, staging profiles included
+	Succeeded int
+	Skipped   int // profiles locked by another instance
+	Duration  time.Duration
+	Report    *RunReport // the report sent to webhooks and hooks; nil for dry runs
+}
+
+// A configured sync; see New
+type Syncer struct {
+	token     string
+	profiles  []string
+	sources   []string
+	dryRun    bool
+	stateFile string
+	args      []string
+	env       map[string]string
+	logger    *log.Logger
+	observers []func(Event)
+}
+
+// Configures a Syncer
+type Option func(*Syncer)
+
+// Profiles to sync, by ID, name or glob pattern; without it PROFILE from the environment is used
+func WithProfiles(profiles ...string) Option {
+	return func(s *Syncer) { s.profiles = append(s.profiles, profiles...) }
+}
+
+// Lists to sync, written as in lists.txt, e.g. "https://example.com/ads.txt name=Ads";
+// without it the usual SOURCES, LISTS_FILE or lists.txt is used
+func WithSources(sources ...string) Option {
+	return func(s *Syncer) { s.sources = append(s.sources, sources...) }
+}
+
+// Plan the sync without changing anything
+func WithDryRun() Option {
+	return func(s *Syncer) { s.dryRun = true }
+}
+
+// Receive the sync's log output; nil discards it. The default is log.Default().
+func WithLogger(l *log.Logger) Option {
+	return func(s *Syncer) { s.logger = l }
+}
+
+// Call fn with every progress event as it happens; observers run one at a time, in order
+func WithObserver(fn func(Event)) Option {
+	return func(s *Syncer) { s.observers = append(s.observers, fn) }
+}
+
+// State file of the sync, so syncs for different accounts don't share one
+func WithStateFile(path string) Option {
+	return func(s *Syncer) { s.stateFile = path }
+}
+
+// Sync flags, e.g. "--no-dedup" or "--max-new-rules", "5000"
+func WithArgs(args ...string) Option {
+	return func(s *Syncer) { s.args = append(s.args, args...) }
+}
+
+// Settings as KEY=value, read in place of the program's environment variables of the same name
+func WithEnv(env ...string) Option {
+	return func(s *Syncer) {
+		if s.env == nil {
+			s.env = make(map[string]string)
+		}
+		for _, kv := range env {
+			name, value, _ := strings.Cut(kv, "=")
+			s.env[name] = value
+		}
+	}
+}
+
+// Set up a sync with a Control D API token
+func New(token string, opts ...Option) (*Syncer, error) {
+	s := &Syncer{token: token, logger: log.Default()}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if token == "" {
+		return nil, errors.New("ctrldsync: a Control D API token is required")
+	}
+	for _, p := range s.profiles {
+		if strings.Contains(p, ",") {
+			return nil, fmt.Errorf("ctrldsync: profile %q contains a comma", p)
+		}
+	}
+	for _, src := range s.sources {
+		if strings.Contains(src, ",") {
+			return nil, fmt.Errorf("ctrldsync: source %q contains a comma", src)
+		}
+	}
+	for name := range s.env {
+		if name == "" {
+			return nil, errors.New("ctrldsync: WithEnv expects KEY=value")
+		}
+	}
+	return s, nil
+}
+
+// Runs started through a Syncer take turns; see the package documentation
+var runMutex sync.Mutex
+
+// Run the sync and wait for it. A run in which some profiles failed returns its Result along
+// with ErrProfilesFailed. Cancelling ctx stops the run from starting more profiles; those in
+// progress finish, and Run returns ctx's error with the result.
+func (s *Syncer) Run(ctx context.Context) (*Result, error) {
+	runMutex.Lock()
+	defer runMutex.Unlock()
+
+	runEnv = map[string]string{"TOKEN": s.token}
+	if len(s.profiles) > 0 {
+		runEnv["PROFILE"] = strings.Join(s.profiles, ",")
+	}
+	if len(s.sources) > 0 {
+		runEnv["SOURCES"] = strings.Join(s.sources, ",")
+	}
+	if s.stateFile != "" {
+		runEnv["STATE_FILE"] = s.stateFile
+	}
+	for name, value := range s.env {
+		runEnv[name] = value
+	}
+	logger = s.logger
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	if len(s.observers) > 0 {
+		eventObserver = func(e Event) {
+			for _, fn := range s.observers {
+				fn(e)
+			}
+		}
+	}
+	defer func() {
+		runEnv = nil
+		logger = log.Default()
+		eventObserver = nil
+	}()
+
+	resetRun()
+	if err := loadSettings(); err != nil {
+		return nil, fmt.Errorf("ctrldsync: invalid config: %w", err)
+	}
+	args := s.args
+	if s.dryRun {
+		args = append([]string{"--dry-run"}, args...)
+	}
+	run, err := prepareSync(args, false, flag.ContinueOnError)
+	if err != nil {
+		return nil, fmt.Errorf("ctrldsync: %w", err)
+	}
+	return run.execute(ctx)
+}
+
+// Put back the settings and collected data of the previous run in this process,
+// so every run starts out like a new ctrld-hagezi-sync command
+func resetRun() {
+	BatchSize = DefaultBatchSize
+	MaxRetries = DefaultMaxRetries
+	MaxConcurrentProfiles = DefaultConcurrency
+	MaxConcurrentBatches = 0
+	RetryDelay = DefaultRetryDelay
+	HTTPTimeout = DefaultHTTPTimeout
+	MaxBatchBytes = DefaultBatchMaxBytes
+	APIBase = DefaultAPIBase
+	anomalySigma = DefaultAnomalySigma
+	rejectThreshold = DefaultRejectThreshold
+	lockTTL = DefaultLockTTL
+	dedupIndexMaxAge = DefaultDedupIndexMaxAge
+	downloadConnections = DefaultDownloadConnections
+
+	selection = ProfileSelection{}
+	FolderURLs = nil
+	configProfileLists = nil
+	onlyLists = nil
+	bundleMode, stdinMode = false, false
+	folderOverrides = nil
+	profileTagMap = nil
+	alertThresholds = AlertThresholds{}
+	summaryTemplate = nil
+	hooks = Hooks{}
+	runDeadline = time.Time{}
+	runID = newRunID()
+
+	stateMutex.Lock()
+	state = &State{Profiles: make(map[string]*ProfileState)}
+	stateMutex.Unlock()
+
+	cacheMutex.Lock()
+	cache = make(map[string]FolderData)
+	cacheMutex.Unlock()
+	includeMutex.Lock()
+	includeCache = make(map[string][]byte)
+	includeMutex.Unlock()
+	releaseMutex.Lock()
+	releaseCache = make(map[string]*githubRelease)
+	releaseTags = sync.Map{}
+	releaseMutex.Unlock()
+	tagListsMutex.Lock()
+	tagLists = make(map[string][]string)
+	tagListsFrozen = false
+	tagListsMutex.Unlock()
+	sourceTemplatesMutex.Lock()
+	sourceTemplates = make(map[string]string)
+	sourceTemplatesMutex.Unlock()
+	sourcesSeenMutex.Lock()
+	sourcesSeen = make(map[string]bool)
+	sourcesSeenMutex.Unlock()
+	checkedSourcesMutex.Lock()
+	checkedSources = make(map[string]bool)
+	checkedSourcesMutex.Unlock()
+	stagingPinsMutex.Lock()
+	stagingPins = make(map[string]map[string]string)
+	stagingPinsMutex.Unlock()
+	upstreamDiffsMutex.Lock()
+	upstreamDiffs = nil
+	upstreamDiffsMutex.Unlock()
+	activityMutex.Lock()
+	activity = make(map[string]string)
+	activityMutex.Unlock()
+	apiBudgetMutex.Lock()
+	apiBudget = APIBudget{}
+	apiBudgetMutex.Unlock()
+	plannedWorkMutex.Lock()
+	plannedWork = 0
+	plannedWorkMutex.Unlock()
+	warningsMutex.Lock()
+	warnings = nil
+	warningIndex = make(map[string]int)
+	warningsMutex.Unlock()
+	deferWarnings.Store(false)
+	refreshAccountProfiles()
+}
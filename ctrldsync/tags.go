@@ -0,0 +1,150 @@
+package ctrldsync
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultTagsFile maps profiles to tags, one "<profile ID or name>: tag, tag" per line
+const DefaultTagsFile = "tags.txt"
+
+var (
+	// Tags by lowercased profile ID or name; nil when tagging is not in use
+	profileTagMap map[string][]string
+	listsDir      = "."
+
+	tagListsMutex sync.Mutex
+	tagLists      = make(map[string][]string)
+
+	// Set when tagLists came from a bundle; tags missing from it have no lists
+	tagListsFrozen bool
+)
+
+// Tags written in a profile name, e.g. "Kids iPad [family, guest]"
+var nameTagPattern = regexp.MustCompile(`\[([^\]]+)\]`)
+
+// Load the profile tag mapping file; a missing file leaves tagging to profile names only
+func loadProfileTags(filename string) (map[string][]string, error) {
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string][]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tags := make(map[string][]string)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		profile, list, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected \"<profile>: tag, tag\"", filename, lineNum)
+		}
+		key := strings.ToLower(strings.TrimSpace(profile))
+		tags[key] = append(tags[key], normalizeTags(splitList(list))...)
+	}
+	return tags, scanner.Err()
+}
+
+func normalizeTags(tags []string) []string {
+	for i, t := range tags {
+		tags[i] = strings.ToLower(strings.TrimSpace(t))
+	}
+	return tags
+}
+
+// Tags of a profile from the mapping file and its name
+func tagsFor(profileID string) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	add := func(list []string) {
+		for _, t := range list {
+			if t != "" && !seen[t] {
+				seen[t] = true
+				tags = append(tags, t)
+			}
+		}
+	}
+
+	add(profileTagMap[strings.ToLower(profileID)])
+	if name := profileName(profileID); name != "" {
+		add(profileTagMap[strings.ToLower(name)])
+		for _, m := range nameTagPattern.FindAllStringSubmatch(name, -1) {
+			add(normalizeTags(splitList(m[1])))
+		}
+	}
+
+	sort.Strings(tags)
+	return tags
+}
+
+// Report whether any of tags is wanted
+func hasAnyTag(tags, wanted []string) bool {
+	for _, t := range tags {
+		for _, w := range wanted {
+			if t == strings.ToLower(w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Load lists-<tag>.txt, caching the result; nil when the tag has no list file
+func listsForTag(tag string) []string {
+	tagListsMutex.Lock()
+	defer tagListsMutex.Unlock()
+
+	if urls, ok := tagLists[tag]; ok || tagListsFrozen {
+		return urls
+	}
+
+	filename := filepath.Join(listsDir, "lists-"+tag+".txt")
+	urls, err := loadFolderURLs(filename)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		warnf("could not load %s: %v", filename, err)
+	}
+	tagLists[tag] = urls
+	return urls
+}
+
+// Folder URLs for a profile: its lists in the config file, else the union of its tags' list files, else the global lists
+func listsForProfile(profileID string) []string {
+	if urls := configListsFor(profileID); urls != nil {
+		logger.Printf("Profile %s: using %d lists from %s", maskID(profileID), len(urls), configFilePath())
+		return urls
+	}
+	if profileTagMap == nil {
+		return FolderURLs
+	}
+
+	tags := tagsFor(profileID)
+	seen := make(map[string]bool)
+	var urls []string
+	for _, tag := range tags {
+		for _, u := range listsForTag(tag) {
+			if !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		}
+	}
+
+	if len(urls) == 0 {
+		return FolderURLs
+	}
+	logger.Printf("Profile %s: using %d lists for tags %s", maskID(profileID), len(urls), strings.Join(tags, ", "))
+	return urls
+}
@@ -0,0 +1,172 @@
+package ctrldsync
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Domain-level change of one source since it was last fetched
+type SourceDiff struct {
+	Folder          string   `json:"folder"`
+	Source          string   `json:"source"`
+	PreviousVersion string   `json:"previous_version"`
+	Version         string   `json:"version"`
+	Added           []string `json:"added"`
+	Removed         []string `json:"removed"`
+}
+
+// Full diffs of the sources that changed during this run
+var (
+	upstreamDiffs      []SourceDiff
+	upstreamDiffsMutex sync.Mutex
+)
+
+// Compare fetched folder data with the cached content of its source; nil when unknown or unchanged
+func diffSource(prev *SourceState, data FolderData) *SourceDiff {
+	if prev == nil || prev.Version == data.Version {
+		return nil
+	}
+	var previous []string
+	if !loadCached("sources", data.Source, &previous) {
+		return nil
+	}
+	added, removed := diffSorted(previous, sortedRules(data))
+	return &SourceDiff{
+		Folder:          strings.TrimSpace(data.Group.Group),
+		Source:          data.Source,
+		PreviousVersion: prev.Version,
+		Version:         data.Version,
+		Added:           added,
+		Removed:         removed,
+	}
+}
+
+// Hostnames of a folder, sorted
+func sortedRules(data FolderData) []string {
+	rules := make([]string, 0, len(data.Rules))
+	for _, r := range data.Rules {
+		if r.PK != "" {
+			rules = append(rules, r.PK)
+		}
+	}
+	sort.Strings(rules)
+	return rules
+}
+
+// Write diffs as indented JSON
+func writeDiffs(path string, diffs []SourceDiff) error {
+	if diffs == nil {
+		diffs = []SourceDiff{}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Folder < diffs[j].Folder })
+	data, err := json.MarshalIndent(diffs, "", "  ")
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Write the diffs collected during a sync to UPSTREAM_DIFF_FILE
+func writeUpstreamDiffFile(path string) error {
+	upstreamDiffsMutex.Lock()
+	diffs := append([]SourceDiff(nil), upstreamDiffs...)
+	upstreamDiffsMutex.Unlock()
+	return writeDiffs(path, diffs)
+}
+
+// upstream-diff [--json] [-o file]: fetch the synced lists and show what changed since the last run, without syncing
+func runUpstreamDiffCommand(args []string) int {
+	fs := flag.NewFlagSet("upstream-diff", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the diff as JSON")
+	output := fs.String("o", "", "write the JSON diff to this file")
+	summary := fs.Bool("summary", false, "only print per-folder counts")
+	fs.Parse(args)
+
+	if err := loadState(stateFilePath()); err != nil {
+		logger.Printf("Failed to load state: %v", err)
+		return 1
+	}
+	if err := initClients(); err != nil {
+		logger.Printf("Failed to set up HTTP clients: %v", err)
+		return 1
+	}
+
+	urls, err := loadLists()
+	if err != nil {
+		logger.Printf("Failed to load %s: %v", listsOrigin(), err)
+		return 1
+	}
+	seen := make(map[string]bool)
+	for _, list := range configProfileLists {
+		urls = append(urls, list...)
+	}
+
+	var diffs []SourceDiff
+	failed, unknown := 0, 0
+	for _, u := range urls {
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+		data, err := ghGet(u)
+		if err != nil {
+			logger.Printf("Failed to fetch %s: %v", u, err)
+			failed++
+			continue
+		}
+		stateMutex.Lock()
+		prev := state.Sources[u]
+		stateMutex.Unlock()
+		if prev == nil {
+			unknown++
+			continue
+		}
+		if d := diffSource(prev, data); d != nil {
+			diffs = append(diffs, *d)
+		}
+	}
+
+	if *output != "" {
+		if err := writeDiffs(*output, diffs); err != nil {
+			logger.Printf("Failed to write %s: %v", *output, err)
+			return 1
+		}
+	}
+	if *asJSON {
+		if err := writeDiffs("-", diffs); err != nil {
+			return 1
+		}
+	} else {
+		if len(diffs) == 0 {
+			fmt.Println("No upstream changes since the last sync")
+		}
+		for _, d := range diffs {
+			fmt.Printf("%s: +%s / -%s\n", d.Folder, formatNumber(len(d.Added)), formatNumber(len(d.Removed)))
+			if *summary {
+				continue
+			}
+			for _, h := range d.Added {
+				fmt.Printf("  + %s\n", h)
+			}
+			for _, h := range d.Removed {
+				fmt.Printf("  - %s\n", h)
+			}
+		}
+		if unknown > 0 {
+			fmt.Printf("%d lists have not been synced before and have nothing to compare with\n", unknown)
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
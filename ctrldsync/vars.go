@@ -0,0 +1,80 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values for {name} placeholders in list entries, from variables: in the config file; VAR_<NAME> wins
+var listVars map[string]string
+
+// List entries with placeholders as written, by the source they expanded to, so the
+// folder of "{date}" still counts as configured when the date has moved on
+var (
+	sourceTemplates      = make(map[string]string)
+	sourceTemplatesMutex sync.Mutex
+)
+
+// {name} or {name:default}
+var placeholderPattern = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)(?::([^{}]*))?\}`)
+
+// Value of a list variable: VAR_<NAME>, the config file, a built-in date, then the placeholder's default
+func listVar(name string) (string, bool) {
+	if v, ok := lookupEnv("VAR_" + strings.ToUpper(name)); ok {
+		return v, true
+	}
+	if v, ok := listVars[strings.ToLower(name)]; ok {
+		return v, true
+	}
+	now := time.Now().UTC()
+	switch strings.ToLower(name) {
+	case "date":
+		return now.Format("2006-01-02"), true
+	case "year":
+		return now.Format("2006"), true
+	case "month":
+		return now.Format("01"), true
+	case "day":
+		return now.Format("02"), true
+	}
+	return "", false
+}
+
+// Fill in the placeholders of a list entry, e.g. ".../controld/{variant}-folder.json"
+func expandListVars(line string) (string, error) {
+	var missing string
+	expanded := placeholderPattern.ReplaceAllStringFunc(line, func(m string) string {
+		parts := placeholderPattern.FindStringSubmatch(m)
+		if v, ok := listVar(parts[1]); ok {
+			return v
+		}
+		if strings.Contains(m, ":") {
+			return parts[2]
+		}
+		if missing == "" {
+			missing = parts[1]
+		}
+		return m
+	})
+	if missing != "" {
+		return "", fmt.Errorf("unknown variable {%s}; set it under variables: in %s or as VAR_%s", missing, configFilePath(), strings.ToUpper(missing))
+	}
+	return expanded, nil
+}
+
+// Remember the entry a source was expanded from, when it had placeholders
+func recordSourceTemplate(src, entry string) {
+	sourceTemplatesMutex.Lock()
+	defer sourceTemplatesMutex.Unlock()
+	sourceTemplates[src] = entry
+}
+
+// Entry a source was expanded from, or "" when it had no placeholders
+func sourceTemplate(src string) string {
+	sourceTemplatesMutex.Lock()
+	defer sourceTemplatesMutex.Unlock()
+	return sourceTemplates[src]
+}
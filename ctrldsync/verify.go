@@ -0,0 +1,51 @@
+package ctrldsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// Check that a random sample of pushed hostnames exists in the folder with the folder's action
+func verifySample(profileID, folderName, folderID string, do int, pushed []string, n int) error {
+	if n > len(pushed) {
+		n = len(pushed)
+	}
+	sampled := make([]string, n)
+	for i, j := range rand.Perm(len(pushed))[:n] {
+		sampled[i] = pushed[j]
+	}
+
+	endpoint := fmt.Sprintf("%s/%s/rules/%s", APIBase, profileID, folderID)
+	resp, err := apiGet(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var apiResp APIRulesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+		return fmt.Errorf("failed to decode rules: %w", err)
+	}
+	rules := make(map[string]Rule, len(apiResp.Body.Rules))
+	for _, rule := range apiResp.Body.Rules {
+		rules[rule.PK] = rule
+	}
+
+	var problems []string
+	for _, hostname := range sampled {
+		rule, exists := rules[hostname]
+		switch {
+		case !exists:
+			problems = append(problems, hostname+" is missing")
+		case rule.Action != nil && rule.Action.Do != do:
+			problems = append(problems, fmt.Sprintf("%s has action %s", hostname, actionLabel(rule.Action.Do)))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d/%d sampled rules wrong: %s", len(problems), n, strings.Join(problems, ", "))
+	}
+	logger.Printf("Folder '%s': verified %d sampled rules", folderName, n)
+	return nil
+}
@@ -0,0 +1,64 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// A distinct warning and how often it was raised
+type Warning struct {
+	Message string `json:"message"`
+	Count   int    `json:"count"`
+}
+
+var (
+	warningsMutex sync.Mutex
+	warnings      []Warning
+	warningIndex  = make(map[string]int)
+)
+
+// Set while a sync processes its profiles: warnings are then only collected and printed
+// grouped at the end of the run. Other commands, and a sync while it starts up, log them
+// as they happen.
+var deferWarnings atomic.Bool
+
+// Collect a warning for the end-of-run summary, logging it right away unless warnings are deferred
+func warnf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if !deferWarnings.Load() {
+		logger.Printf("Warning: %s", msg)
+	}
+
+	warningsMutex.Lock()
+	defer warningsMutex.Unlock()
+	if i, seen := warningIndex[msg]; seen {
+		warnings[i].Count++
+		return
+	}
+	warningIndex[msg] = len(warnings)
+	warnings = append(warnings, Warning{Message: msg, Count: 1})
+}
+
+// Distinct warnings raised so far, in first-seen order
+func collectedWarnings() []Warning {
+	warningsMutex.Lock()
+	defer warningsMutex.Unlock()
+	return append([]Warning(nil), warnings...)
+}
+
+// Print every distinct warning once, with how often it occurred
+func logWarnings() {
+	list := collectedWarnings()
+	if len(list) == 0 {
+		return
+	}
+	logger.Printf("%d distinct warnings during this run:", len(list))
+	for _, w := range list {
+		if w.Count > 1 {
+			logger.Printf("  - %s (×%d)", w.Message, w.Count)
+		} else {
+			logger.Printf("  - %s", w.Message)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package ctrldsync
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Header carrying the HMAC-SHA256 of the request body, GitHub style: "sha256=<hex>"
+const SignatureHeader = "X-Signature-256"
+
+// Sign a payload with the webhook secret
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// POST a JSON payload to a webhook, signing it when a secret is set
+func postWebhook(url, secret, event string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook payload: %w", err)
+	}
+
+	// The digest command sends its webhook without having set up the clients
+	if webhookClient == nil {
+		if err := initClients(); err != nil {
+			return err
+		}
+	}
+	client := webhookClient
+	resp, err := retryRequest(func() (*http.Response, error) {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "ctrld-hagezi-sync/"+Version)
+		req.Header.Set("X-Ctrld-Sync-Event", event)
+		if secret != "" {
+			req.Header.Set(SignatureHeader, signPayload(secret, body))
+		}
+		return client.Do(req)
+	})
+	if err != nil {
+		return fmt.Errorf("webhook delivery failed: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Send the run report to WEBHOOK_URL, if configured
+func sendReportWebhook(report RunReport) error {
+	url := getenv("WEBHOOK_URL")
+	if url == "" {
+		return nil
+	}
+	return postWebhook(url, getenv("WEBHOOK_SECRET"), "run_finished", report)
+}
@@ -0,0 +1,92 @@
+package ctrldsync
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Daily maintenance window, possibly crossing midnight
+type TimeWindow struct {
+	Start, End time.Duration // offsets from midnight
+	Location   *time.Location
+}
+
+// Parse "02:00-06:00" with an optional IANA time zone, e.g. "22:00-04:00 Europe/Berlin"; local time otherwise
+func parseTimeWindow(s string) (*TimeWindow, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	if len(fields) > 2 {
+		return nil, fmt.Errorf("expected HH:MM-HH:MM [zone], got %q", s)
+	}
+
+	w := &TimeWindow{Location: time.Local}
+	if len(fields) == 2 {
+		loc, err := time.LoadLocation(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		w.Location = loc
+	}
+
+	from, to, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return nil, fmt.Errorf("expected HH:MM-HH:MM, got %q", fields[0])
+	}
+	var err error
+	if w.Start, err = parseClock(from); err != nil {
+		return nil, err
+	}
+	if w.End, err = parseClock(to); err != nil {
+		return nil, err
+	}
+	if w.Start == w.End {
+		return nil, fmt.Errorf("window %q is empty", fields[0])
+	}
+	return w, nil
+}
+
+// Offset from midnight of an HH:MM time
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Time since midnight in the window's zone
+func (w *TimeWindow) offset(now time.Time) time.Duration {
+	now = now.In(w.Location)
+	return time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+}
+
+// Report whether now falls inside the window
+func (w *TimeWindow) contains(now time.Time) bool {
+	off := w.offset(now)
+	if w.Start < w.End {
+		return off >= w.Start && off < w.End
+	}
+	return off >= w.Start || off < w.End
+}
+
+// How long until the window next opens; zero when it is open
+func (w *TimeWindow) untilOpen(now time.Time) time.Duration {
+	if w.contains(now) {
+		return 0
+	}
+	wait := w.Start - w.offset(now)
+	if wait < 0 {
+		wait += 24 * time.Hour
+	}
+	return wait
+}
+
+func (w *TimeWindow) String() string {
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%s-%s %s", clock(w.Start), clock(w.End), w.Location)
+}
@@ -3,3 +3,17 @@ module ctrld-hagezi-sync
 go 1.21
 
 require github.com/joho/godotenv v1.5.1
+
+require gopkg.in/yaml.v3 v3.0.1
+
+require github.com/klauspost/compress v1.17.11
+
+require (
+	golang.org/x/net v0.33.0
+	golang.org/x/text v0.21.0 // indirect
+)
+
+require (
+	golang.org/x/crypto v0.31.0
+	golang.org/x/sys v0.28.0 // indirect
+)